@@ -65,16 +65,17 @@ class MainActivity: FlutterActivity() {
 
             } else if (call.method == "getServerStatus") {
                 val serverAddress = call.argument<String>("serverAddress") ?: ""
+                val stripColors = call.argument<Boolean>("stripColors") ?: false
                 Thread {
-                    val json = Minewire.getServerStatus(serverAddress)
+                    val json = Minewire.getServerStatus(serverAddress, stripColors)
                     runOnUiThread {
                         result.success(json)
                     }
                 }.start()
             } else if (call.method == "updateConfig") {
                 val rules = call.argument<String>("rules") ?: ""
-                Minewire.updateConfig(rules)
-                result.success(true)
+                val json = Minewire.updateConfig(rules)
+                result.success(json)
             } else {
                 result.notImplemented()
             }
@@ -6,6 +6,8 @@ import android.app.NotificationManager
 import android.app.PendingIntent
 import android.content.ComponentName
 import android.content.Intent
+import android.net.ConnectivityManager
+import android.net.Network
 import android.net.VpnService
 import android.os.Build
 import android.os.ParcelFileDescriptor
@@ -18,6 +20,7 @@ class MinewireVpnService : VpnService(), ProtectCallback {
     private var vpnInterface: ParcelFileDescriptor? = null
     private val CHANNEL_ID = "MinewireVPN"
     private var statsTimer: java.util.Timer? = null
+    private var networkCallback: ConnectivityManager.NetworkCallback? = null
 
     override fun onStartCommand(intent: Intent?, flags: Int, startId: Int): Int {
         if (intent?.action == "STOP") {
@@ -43,7 +46,7 @@ class MinewireVpnService : VpnService(), ProtectCallback {
 
                 // 3.1 Запускаем SOCKS сервер (блокирующий вызов в Go, поэтому в треде)
                 // Важно: Сначала запускаем SOCKS, потом VPN
-                Minewire.start(localPort, serverAddr, password, "socks5") 
+                Minewire.start(localPort, "127.0.0.1", serverAddr, password, "socks5", "", "") 
                 
                 // Poll for IsRunning (wait for storage/setup)
                 var attempts = 0
@@ -57,6 +60,9 @@ class MinewireVpnService : VpnService(), ProtectCallback {
 
                 // Запускаем обновление статистики
                 startStatsUpdater(serverAddr)
+
+                // Reconnect the tunnel as soon as the underlying network changes
+                registerNetworkCallback()
                 
                 // Notify QS Tile that VPN is starting
                 requestTileUpdate()
@@ -133,6 +139,37 @@ class MinewireVpnService : VpnService(), ProtectCallback {
         statsTimer = null
     }
 
+    private fun registerNetworkCallback() {
+        if (Build.VERSION.SDK_INT < Build.VERSION_CODES.N || networkCallback != null) {
+            return
+        }
+        val cm = getSystemService(ConnectivityManager::class.java)
+        val callback = object : ConnectivityManager.NetworkCallback() {
+            private var current: Network? = null
+
+            override fun onAvailable(network: Network) {
+                // The first callback reports the network we started on
+                if (current != null && current != network) {
+                    Minewire.networkChanged()
+                }
+                current = network
+            }
+        }
+        cm.registerDefaultNetworkCallback(callback)
+        networkCallback = callback
+    }
+
+    private fun unregisterNetworkCallback() {
+        networkCallback?.let {
+            try {
+                getSystemService(ConnectivityManager::class.java).unregisterNetworkCallback(it)
+            } catch (e: Exception) {
+                e.printStackTrace()
+            }
+        }
+        networkCallback = null
+    }
+
     private fun buildNotification(serverAddr: String, rx: Long, tx: Long): Notification {
         val pendingIntent = PendingIntent.getActivity(this, 0, Intent(this, MainActivity::class.java), PendingIntent.FLAG_IMMUTABLE)
         
@@ -169,6 +206,7 @@ class MinewireVpnService : VpnService(), ProtectCallback {
 
     private fun stopVpn() {
         stopStatsUpdater()
+        unregisterNetworkCallback()
         // Run Go stop in background to avoid blocking Main Thread (ANR)
         Thread {
             Minewire.stop()
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxLogSize   = 10 << 20 // Rotate once the log reaches 10MB
+	keptLogFiles = 2        // minewire_debug.log.1 and .2
+)
+
+// Debug log state. The file grows with every proxied connection, so it is
+// rotated by size to keep always-on sessions from filling the temp directory.
+var (
+	logMu    sync.Mutex
+	debugLog *os.File
+	logPath  string
+	logSize  int64
+	logLevel = levelDebug // Everything by default; this is the debug log
+)
+
+// Log levels, lowest first. Messages below logLevel are dropped.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func init() {
+	openDebugLog(filepath.Join(os.TempDir(), "minewire_debug.log")) // ignore errors, logging is best-effort
+	logInfo("Minewire Core Initialized")
+}
+
+func logAt(level int, format string, v ...interface{}) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if debugLog == nil || level < logLevel {
+		return
+	}
+	prefix := time.Now().Format(time.RFC3339) + " [" + strings.ToUpper(levelNames[level]) + "] "
+	n, _ := fmt.Fprintf(debugLog, prefix+format+"\n", v...)
+	logSize += int64(n)
+	if logSize >= maxLogSize {
+		rotateLogLocked()
+	}
+}
+
+func logDebug(format string, v ...interface{}) { logAt(levelDebug, format, v...) }
+func logInfo(format string, v ...interface{})  { logAt(levelInfo, format, v...) }
+func logWarn(format string, v ...interface{})  { logAt(levelWarn, format, v...) }
+func logError(format string, v ...interface{}) { logAt(levelError, format, v...) }
+
+// setLogLevel drops messages less severe than name ("debug", "info", "warn" or "error")
+func setLogLevel(name string) error {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			logMu.Lock()
+			logLevel = i
+			logMu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", name)
+}
+
+// openDebugLog switches logging to path. Must not be called with logMu held.
+func openDebugLog(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if debugLog != nil {
+		debugLog.Close()
+	}
+	debugLog = f
+	logPath = path
+	logSize = size
+	return nil
+}
+
+// rotateLogLocked shifts log -> log.1 -> log.2, dropping the oldest file,
+// and starts a fresh log. Caller holds logMu.
+func rotateLogLocked() error {
+	if debugLog == nil {
+		return fmt.Errorf("debug log is not open")
+	}
+	debugLog.Close()
+	debugLog = nil
+
+	for i := keptLogFiles; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", logPath, i-1), fmt.Sprintf("%s.%d", logPath, i))
+	}
+	os.Rename(logPath, logPath+".1")
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	debugLog = f
+	logSize = 0
+	return nil
+}
+
+func rotateLog() error {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return rotateLogLocked()
+}
+
+// flushLog makes sure everything logged so far is on disk
+func flushLog() error {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if debugLog == nil {
+		return nil
+	}
+	return debugLog.Sync()
+}
+
+// setLogPath moves the debug log, e.g. somewhere the UI can show the user
+func setLogPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("log path is empty")
+	}
+	if err := openDebugLog(path); err != nil {
+		return fmt.Errorf("could not open log file: %v", err)
+	}
+	logInfo("Logging to %s", path)
+	return nil
+}
+
+func currentLogPath() string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logPath
+}
@@ -4,7 +4,12 @@ go 1.24.3
 
 require (
 	github.com/hashicorp/yamux v0.1.2
+	golang.org/x/net v0.48.0
 	golang.org/x/sys v0.39.0
 )
 
 require github.com/yl2chen/cidranger v1.0.2
+
+require minewire v0.0.0-00010101000000-000000000000
+
+replace minewire => ../go
@@ -3,8 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,43 +14,85 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"minewire/localproxy"
+	"minewire/mcversion"
+	"minewire/udpflow"
 )
 
+// config holds the settings of the current Start call.
+type config struct {
+	LocalPort     string
+	ServerAddress string   // As passed to Start
+	Servers       []string // ServerAddress split into the failover list
+	Password      string
+	ProxyType     string
+	SocksUser     string // SOCKS5 credentials; both empty means no auth
+	SocksPass     string
+
+	Options
+}
+
 // Global Config & State (Replicated from minewire.go but simplified)
 var (
-	cfg struct {
-		LocalPort     string
-		ServerAddress string
-		Password      string
-		ProxyType     string
-	}
+	cfg        config // guarded by serverLock, read via getConfig
 	isRunning  bool
 	serverLock sync.Mutex
 	listener   net.Listener
 	httpServer *http.Server
-	stopSignal chan struct{}
-	debugLog   *os.File
+	// runCtx is cancelled by Stop; the session, proxy and noise loops of a
+	// Start all end with it.
+	runCtx    context.Context
+	runCancel context.CancelFunc
+	udpFlows  *udpflow.Table
+
+	proxyStarted *proxyReady
 )
 
-func init() {
-	var err error
-	tempDir := os.TempDir()
-	logPath := filepath.Join(tempDir, "minewire_debug.log")
-	debugLog, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		// ignore
-	}
-	logDebug("Minewire Core Initialized")
+// proxyReady is signaled once by the proxy goroutine: with the bound address
+// when the local listener is up, or with the error that prevented it.
+type proxyReady struct {
+	done chan struct{}
+	once sync.Once
+	addr *net.TCPAddr
+	err  error
+}
+
+func (r *proxyReady) signal(addr net.Addr, err error) {
+	r.once.Do(func() {
+		r.addr, _ = addr.(*net.TCPAddr)
+		r.err = err
+		close(r.done)
+	})
 }
 
-func logDebug(format string, v ...interface{}) {
-	if debugLog != nil {
-		fmt.Fprintf(debugLog, time.Now().Format(time.RFC3339)+" "+format+"\n", v...)
+// WaitForProxy blocks until the local proxy is bound and returns its address.
+func WaitForProxy(timeout time.Duration) (*net.TCPAddr, error) {
+	serverLock.Lock()
+	ready := proxyStarted
+	serverLock.Unlock()
+	if ready == nil {
+		return nil, fmt.Errorf("not started")
+	}
+
+	select {
+	case <-ready.done:
+		if ready.err != nil {
+			return nil, ready.err
+		}
+		if ready.addr == nil {
+			return nil, fmt.Errorf("stopped before listening")
+		}
+		return ready.addr, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for local proxy")
 	}
 }
 
@@ -61,27 +105,49 @@ type Command struct {
 
 type CommandArgs struct {
 	LocalPort     string `json:"localPort"`
-	ServerAddress string `json:"serverAddress"`
+	LocalAddress  string `json:"localAddress"`  // Listen IP, default 127.0.0.1
+	ServerAddress string `json:"serverAddress"` // For start, a comma separated failover list
 	Password      string `json:"password"`
 	ProxyType     string `json:"proxyType"`
+	SocksUser     string `json:"socksUser"`
+	SocksPass     string `json:"socksPass"`
 	Link          string `json:"link"`
-	Rules         string `json:"rules"` // Comma separated paths to zone files
+	Name          string `json:"name"`        // for buildLink
+	Rules         string `json:"rules"`       // Comma separated paths to zone files
+	LogPath       string `json:"logPath"`     // for setLogPath
+	LogLevel      string `json:"logLevel"`    // for setLogLevel: debug, info, warn or error
+	ProxyBypass   string `json:"proxyBypass"` // ProxyOverride list, ";" separated; empty for the LAN default
+	UsePAC        bool   `json:"usePac"`      // Also set AutoConfigURL to a PAC file built from the rules
+	StripColors   bool   `json:"stripColors"` // for getServerStatus: remove § formatting codes
+
+	Servers []string `json:"servers"` // for getServerStatusBatch
+
+	Count int `json:"count"` // for pingN: number of probes
+
+	// Options tune the tunnel for start; see Options
+	Options
 }
 
 type Response struct {
 	ID      string `json:"id"`
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
+	Warning string `json:"warning,omitempty"`
 	Data    any    `json:"data,omitempty"`
 }
 
+// keepProxyOnExit is set while a kill switch session runs
+var keepProxyOnExit atomic.Bool
+
 func main() {
 	// Setup Signal Handler for Cleanup
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		unsetSystemProxy()
+		if !keepProxyOnExit.Load() {
+			unsetSystemProxy()
+		}
 		os.Exit(0)
 	}()
 
@@ -95,25 +161,65 @@ func main() {
 		}
 		handleCommand(cmd)
 	}
+
+	// stdin closed: the UI process is gone, so don't leave the tunnel running
+	// or the system proxy pointing at a dead port, unless the kill switch
+	// wants traffic to fail rather than go out directly.
+	Stop()
+	if !keepProxyOnExit.Load() {
+		unsetSystemProxy()
+	}
 }
 
 func handleCommand(cmd Command) {
 	switch cmd.Method {
 	case "start":
-		err := Start(cmd.Args.LocalPort, cmd.Args.ServerAddress, cmd.Args.Password, cmd.Args.ProxyType)
+		proxyType := localproxy.NormalizeProxyType(cmd.Args.ProxyType)
+		err := Start(cmd.Args.LocalPort, cmd.Args.LocalAddress, cmd.Args.ServerAddress, cmd.Args.Password, proxyType, cmd.Args.SocksUser, cmd.Args.SocksPass, cmd.Args.Options)
 		if err != nil {
 			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
 			return
 		}
-		// Set System Proxy
-		if err := setSystemProxy("127.0.0.1"+cmd.Args.LocalPort, cmd.Args.ProxyType); err != nil {
+		// Wait for the listener so we can report (and proxy to) the real port
+		addr, err := WaitForProxy(5 * time.Second)
+		if err != nil {
 			Stop()
+			respond(Response{ID: cmd.ID, Success: false, Error: "Local proxy failed: " + err.Error()})
+			return
+		}
+		ports := map[string]int{}
+		if proxyType == "http" {
+			ports["httpPort"] = addr.Port
+		} else {
+			ports["socksPort"] = addr.Port
+		}
+
+		// Set System Proxy, optionally with a PAC file mirroring the split-tunnel rules
+		var pacURL string
+		if cmd.Args.UsePAC {
+			if pacURL, err = startPACServer(proxyAddress(addr), proxyType); err != nil {
+				Stop()
+				respond(Response{ID: cmd.ID, Success: false, Error: "PAC server failed: " + err.Error()})
+				return
+			}
+		}
+		previous, err := setSystemProxy(proxyAddress(addr), proxyType, cmd.Args.ProxyBypass, pacURL)
+		if err != nil {
+			Stop()
+			unsetSystemProxy()
 			respond(Response{ID: cmd.ID, Success: false, Error: "System Proxy Error: " + err.Error()})
 			return
 		}
-		respond(Response{ID: cmd.ID, Success: true})
+		var warning string
+		if previous != "" {
+			warning = "Replaced existing system proxy " + previous + "; it will be restored on stop"
+			logWarn("%s", warning)
+		}
+		keepProxyOnExit.Store(cmd.Args.KillSwitch)
+		respond(Response{ID: cmd.ID, Success: true, Warning: warning, Data: ports})
 
 	case "stop":
+		keepProxyOnExit.Store(false)
 		Stop()
 		unsetSystemProxy()
 		respond(Response{ID: cmd.ID, Success: true})
@@ -124,23 +230,51 @@ func handleCommand(cmd Command) {
 		serverLock.Unlock()
 		respond(Response{ID: cmd.ID, Success: true, Data: running})
 
+	case "connectionState":
+		respond(Response{ID: cmd.ID, Success: true, Data: connectionState()})
+
 	case "ping":
 		latency := Ping(cmd.Args.ServerAddress)
 		respond(Response{ID: cmd.ID, Success: true, Data: latency})
 
+	case "pingN":
+		respond(Response{ID: cmd.ID, Success: true, Data: PingN(cmd.Args.ServerAddress, cmd.Args.Count)})
+
+	case "pingApplication":
+		latency := PingApplication(cmd.Args.ServerAddress)
+		respond(Response{ID: cmd.ID, Success: true, Data: latency})
+
+	case "activeServer":
+		respond(Response{ID: cmd.ID, Success: true, Data: GetActiveServer()})
+
+	case "tunnelHealthCheck":
+		respond(Response{ID: cmd.ID, Success: true, Data: TunnelHealthCheck()})
+
 	case "parseLink":
 		res := ParseConnectionLink(cmd.Args.Link)
 		respond(Response{ID: cmd.ID, Success: true, Data: res})
 
+	case "buildLink":
+		link := BuildConnectionLink(cmd.Args.Name, cmd.Args.ServerAddress, cmd.Args.Password)
+		if link == "" {
+			respond(Response{ID: cmd.ID, Success: false, Error: "Invalid server address"})
+		} else {
+			respond(Response{ID: cmd.ID, Success: true, Data: link})
+		}
+
 	case "getServerStatus":
-		res := GetServerStatus(cmd.Args.ServerAddress)
+		res := GetServerStatus(cmd.Args.ServerAddress, cmd.Args.StripColors)
+		respond(Response{ID: cmd.ID, Success: true, Data: res})
+
+	case "getServerStatusBatch":
+		res := GetServerStatusBatch(cmd.Args.Servers, cmd.Args.StripColors)
 		respond(Response{ID: cmd.ID, Success: true, Data: res})
 
 	case "updateConfig":
 		paths := strings.Split(cmd.Args.Rules, ",")
 		st := GetSplitTunnelManager()
 
-		logDebug("Updating Rules: %s", cmd.Args.Rules)
+		logInfo("Updating Rules: %s", cmd.Args.Rules)
 
 		if err := st.UpdateRules(paths); err != nil {
 			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
@@ -148,19 +282,113 @@ func handleCommand(cmd Command) {
 			respond(Response{ID: cmd.ID, Success: true})
 		}
 
+	case "setLogPath":
+		if err := setLogPath(cmd.Args.LogPath); err != nil {
+			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
+		} else {
+			respond(Response{ID: cmd.ID, Success: true, Data: currentLogPath()})
+		}
+
+	case "setLogLevel":
+		if err := setLogLevel(cmd.Args.LogLevel); err != nil {
+			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
+		} else {
+			respond(Response{ID: cmd.ID, Success: true})
+		}
+
+	case "flushLog":
+		if err := flushLog(); err != nil {
+			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
+		} else {
+			respond(Response{ID: cmd.ID, Success: true})
+		}
+
+	case "rotateLog":
+		if err := rotateLog(); err != nil {
+			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
+		} else {
+			respond(Response{ID: cmd.ID, Success: true})
+		}
+
+	case "reconnect":
+		if err := Reconnect(); err != nil {
+			respond(Response{ID: cmd.ID, Success: false, Error: err.Error()})
+		} else {
+			respond(Response{ID: cmd.ID, Success: true})
+		}
+
+	case "heartbeat":
+		respond(Response{ID: cmd.ID, Success: true, Data: heartbeat.Load()})
+
+	case "stats":
+		respond(Response{ID: cmd.ID, Success: true, Data: GetStats()})
+
+	case "resetStats":
+		ResetStats()
+		respond(Response{ID: cmd.ID, Success: true})
+
+	case "getRuleStats":
+		respond(Response{ID: cmd.ID, Success: true, Data: GetRuleStats()})
+
 	default:
 		respond(Response{ID: cmd.ID, Success: false, Error: "Unknown method"})
 	}
 }
 
+// Event is an unsolicited stdout line. It has an "event" field where command
+// responses have "success", so the UI can tell the two apart.
+type Event struct {
+	Event   string `json:"event"`
+	Data    any    `json:"data,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// stdoutMu keeps responses and events from interleaving mid-line
+var stdoutMu sync.Mutex
+
 func respond(res Response) {
-	b, _ := json.Marshal(res)
+	writeLine(res)
+}
+
+// emitEvent reports a state change, e.g. emitEvent("stateChange", "connected", "")
+func emitEvent(event string, data any, message string) {
+	writeLine(Event{Event: event, Data: data, Message: message})
+}
+
+func writeLine(v any) {
+	b, _ := json.Marshal(v)
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
 	fmt.Println(string(b))
 }
 
 // --- Core Logic (Adapted from minewire.go/client main.go) ---
 
-func Start(localPort, serverAddr, password, proxyType string) error {
+// proxyAddress is where local apps reach a proxy bound to addr
+func proxyAddress(addr *net.TCPAddr) string {
+	host := "127.0.0.1"
+	if !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
+
+// splitServerList parses Start's comma separated server addresses
+func splitServerList(list string) []string {
+	var servers []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// Start runs the local proxy and the tunnel to serverAddr, which may be a
+// comma separated list of servers tried in order on every connect; after a
+// drop the next server is tried first. Zero fields of opts take their
+// defaults.
+func Start(localPort, localAddress, serverAddr, password, proxyType, socksUser, socksPass string, opts Options) error {
 	serverLock.Lock()
 	defer serverLock.Unlock()
 
@@ -168,12 +396,46 @@ func Start(localPort, serverAddr, password, proxyType string) error {
 		return fmt.Errorf("already running")
 	}
 
-	cfg.LocalPort = localPort
-	cfg.ServerAddress = serverAddr
-	cfg.Password = password
-	cfg.ProxyType = proxyType
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+	warnWeakPassword(password)
+	if err := mcversion.Check(opts.ProtocolVersion); err != nil {
+		return err
+	}
+	if err := checkTransport(opts); err != nil {
+		return err
+	}
+
+	localPort, err := localproxy.ResolveListenAddress(localAddress, localPort)
+	if err != nil {
+		return err
+	}
+	servers := splitServerList(serverAddr)
+	if len(servers) == 0 {
+		return errors.New("server address required")
+	}
+
+	cfg = config{
+		LocalPort:     localPort,
+		ServerAddress: serverAddr,
+		Servers:       servers,
+		Password:      password,
+		ProxyType:     localproxy.NormalizeProxyType(proxyType),
+		SocksUser:     socksUser,
+		SocksPass:     socksPass,
 
-	stopSignal = make(chan struct{})
+		Options: opts,
+	}
+	conf := cfg
+	ready := &proxyReady{done: make(chan struct{})}
+	proxyStarted = ready
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx, runCancel = ctx, cancel
+	udpFlows = udpflow.NewTable(udpIdleTimeout, udpFlowFallback)
+	bytesUploaded.session.Store(0)
+	bytesDownloaded.session.Store(0)
 	isRunning = true
 
 	// 1. Reset Session
@@ -181,19 +443,21 @@ func Start(localPort, serverAddr, password, proxyType string) error {
 
 	// 2. Start Tunnel Maintenance
 	go func() {
-		maintainSession()
+		maintainSession(ctx)
 	}()
 
 	// 3. Start Local Proxy
 	go func() {
 		var err error
-		if cfg.ProxyType == "http" {
-			err = startHTTPProxy()
+		if conf.ProxyType == "http" {
+			err = startHTTPProxy(ctx, conf.LocalPort, ready)
 		} else {
-			err = startSOCKSProxy()
+			err = startSOCKSProxy(ctx, conf.LocalPort, ready)
 		}
+		// Unblocks WaitForProxy if the proxy never came up
+		ready.signal(nil, err)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Proxy Error: %v\n", err)
+			logError("Proxy Error: %v", err)
 			Stop() // safe? locking inside Stop
 		}
 	}()
@@ -201,6 +465,26 @@ func Start(localPort, serverAddr, password, proxyType string) error {
 	return nil
 }
 
+// getConfig returns a copy of the current configuration.
+func getConfig() config {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	return cfg
+}
+
+// handshakeServerHost is the host written in the handshake when connecting
+// to addr: SpoofHost if set, otherwise the host part of addr, as a player's
+// client would send it
+func (o Options) handshakeServerHost(addr string) string {
+	if o.SpoofHost != "" {
+		return o.SpoofHost
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 func Stop() {
 	serverLock.Lock()
 	defer serverLock.Unlock()
@@ -209,9 +493,10 @@ func Stop() {
 		return
 	}
 	isRunning = false
-
-	if stopSignal != nil {
-		close(stopSignal)
+	runCancel()
+	if udpFlows != nil {
+		udpFlows.Close()
+		udpFlows = nil
 	}
 
 	if listener != nil {
@@ -226,19 +511,35 @@ func Stop() {
 	CloseSession() // In tunnel.go
 }
 
-func startSOCKSProxy() error {
-	var err error
-	listener, err = net.Listen("tcp", cfg.LocalPort)
+// IsRunning returns true if the tunnel is running
+func IsRunning() bool {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	return isRunning
+}
+
+func startSOCKSProxy(ctx context.Context, localPort string, ready *proxyReady) error {
+	l, err := net.Listen("tcp", localPort)
 	if err != nil {
 		return err
 	}
 
+	// Publish for Stop() but accept on the local copy (Stop nils the global)
+	serverLock.Lock()
+	if ctx.Err() != nil {
+		serverLock.Unlock()
+		l.Close()
+		return nil
+	}
+	listener = l
+	serverLock.Unlock()
+	ready.signal(l.Addr(), nil)
+
 	for {
-		c, err := listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
-			// Check if stopped
-			if !isRunning {
-				return nil
+			if ctx.Err() != nil {
+				return nil // Stopped
 			}
 			return err
 		}
@@ -246,42 +547,188 @@ func startSOCKSProxy() error {
 	}
 }
 
-func startHTTPProxy() error {
-	httpServer = &http.Server{
-		Addr:    cfg.LocalPort,
+func startHTTPProxy(ctx context.Context, localPort string, ready *proxyReady) error {
+	l, err := net.Listen("tcp", localPort)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{
+		Addr:    localPort,
 		Handler: http.HandlerFunc(handleHTTP), // In proxy.go
 	}
 
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		if !isRunning {
-			return nil
+	serverLock.Lock()
+	if ctx.Err() != nil {
+		serverLock.Unlock()
+		l.Close()
+		return nil
+	}
+	httpServer = hs
+	serverLock.Unlock()
+	ready.signal(l.Addr(), nil)
+
+	if err := hs.Serve(l); err != http.ErrServerClosed {
+		if ctx.Err() != nil {
+			return nil // Stopped
 		}
 		return err
 	}
 	return nil
 }
 
+// Ping times a TCP connect to serverAddr; an empty serverAddr means the
+// active server. Returns latency in milliseconds, or -1 on any error.
 func Ping(serverAddr string) int64 {
+	latency, err := pingTCP(serverAddr)
+	if err != nil {
+		return -1
+	}
+	return latency.Milliseconds()
+}
+
+func pingTCP(serverAddr string) (time.Duration, error) {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
 	start := time.Now()
 	conn, err := net.DialTimeout("tcp", serverAddr, 5*time.Second)
 	if err != nil {
-		return -1
+		return 0, err
 	}
 	conn.Close()
-	return time.Since(start).Milliseconds()
+	return time.Since(start), nil
+}
+
+// PingStats summarizes a series of Ping probes. Latencies are in
+// milliseconds and are -1 when no probe succeeded.
+type PingStats struct {
+	Sent     int   `json:"sent"`
+	Received int   `json:"received"`
+	MinMs    int64 `json:"minMs"`
+	AvgMs    int64 `json:"avgMs"`
+	MaxMs    int64 `json:"maxMs"`
+	JitterMs int64 `json:"jitterMs"` // Mean deviation from AvgMs
+}
+
+const (
+	maxPingCount = 20
+	pingSpacing  = 200 * time.Millisecond
+)
+
+// PingN runs count TCP pings (at most 20) spaced pingSpacing apart and
+// summarizes them; failed probes are left out of the figures. Received tells
+// the caller how many succeeded, so a flaky link shows up even when the
+// average looks fine. An empty serverAddr means the active server.
+func PingN(serverAddr string, count int) *PingStats {
+	count = max(1, min(count, maxPingCount))
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+
+	var samples []time.Duration
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(pingSpacing)
+		}
+		if latency, err := pingTCP(serverAddr); err == nil {
+			samples = append(samples, latency)
+		}
+	}
+	return summarizePings(count, samples)
+}
+
+func summarizePings(sent int, samples []time.Duration) *PingStats {
+	st := &PingStats{Sent: sent, Received: len(samples), MinMs: -1, AvgMs: -1, MaxMs: -1, JitterMs: -1}
+	if len(samples) == 0 {
+		return st
+	}
+
+	var sum time.Duration
+	lo, hi := samples[0], samples[0]
+	for _, d := range samples {
+		sum += d
+		lo, hi = min(lo, d), max(hi, d)
+	}
+	avg := sum / time.Duration(len(samples))
+
+	var dev time.Duration
+	for _, d := range samples {
+		dev += (d - avg).Abs()
+	}
+
+	st.MinMs = lo.Milliseconds()
+	st.AvgMs = avg.Milliseconds()
+	st.MaxMs = hi.Milliseconds()
+	st.JitterMs = (dev / time.Duration(len(samples))).Milliseconds()
+	return st
+}
+
+// PingApplication measures the Minecraft-level round trip: it runs the status
+// handshake and times a Ping/Pong exchange. An empty serverAddr means the
+// active server. Returns latency in milliseconds, or -1 on any error.
+func PingApplication(serverAddr string) int64 {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+	latency, err := pingStatus(serverAddr)
+	if err != nil {
+		return -1
+	}
+	return latency.Milliseconds()
 }
 
 // GetServerStatus queries the server for MOTD, Icon, and Player count.
-func GetServerStatus(serverAddr string) string {
-	conn, err := net.DialTimeout("tcp", serverAddr, 5*time.Second)
+// Returns a ServerStatus as JSON, or an error JSON. stripColors removes §
+// formatting codes from the text fields. An empty serverAddr means the
+// active server.
+func GetServerStatus(serverAddr string, stripColors bool) string {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+	st, err := queryServerStatus(serverAddr)
 	if err != nil {
 		return fmt.Sprintf(`{"error": "%s"}`, err.Error())
 	}
-	defer conn.Close()
+	if stripColors {
+		st = st.withoutColors()
+	}
+	b, _ := json.Marshal(st)
+	return string(b)
+}
 
+// queryServerStatus runs the server list ping, falling back to the legacy
+// ping if the server doesn't speak the 1.7+ status protocol
+func queryServerStatus(serverAddr string) (ServerStatus, error) {
+	conn, err := net.DialTimeout("tcp", serverAddr, statusTimeout)
+	if err != nil {
+		return ServerStatus{}, err
+	}
+	jsonStr, err := readStatusJSON(conn, bufio.NewReader(conn), serverAddr)
+	conn.Close()
+	if errors.Is(err, errStatusTimeout) {
+		// Pre-1.7 servers reject the handshake outright; one that stays
+		// silent is hung, and asking again would only double the wait
+		return ServerStatus{}, err
+	} else if err != nil {
+		if st, lerr := queryLegacyStatus(serverAddr); lerr == nil {
+			return st, nil
+		}
+		return ServerStatus{}, err
+	}
+	st, err := parseStatusJSON(jsonStr)
+	if err != nil {
+		return ServerStatus{}, errors.New("invalid status response")
+	}
+	return st, nil
+}
+
+// readStatusJSON sends the status handshake and request on conn and returns
+// the Status Response JSON, read through br
+func readStatusJSON(conn net.Conn, br *bufio.Reader, serverAddr string) (string, error) {
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		tcpConn.SetNoDelay(true)
 	}
+	conn.SetDeadline(time.Now().Add(statusTimeout))
 
 	// 1. Handshake State 1 (Status)
 	host, portStr, _ := net.SplitHostPort(serverAddr)
@@ -296,38 +743,46 @@ func GetServerStatus(serverAddr string) string {
 	WriteShort(buf, uint16(port)) // Port
 	WriteVarInt(buf, 1)           // State 1 (Status)
 	if err := WritePacket(conn, 0x00, buf.Bytes()); err != nil {
-		return fmt.Sprintf(`{"error": "%s"}`, err.Error())
+		return "", err
 	}
 
 	// 2. Status Request
 	if err := WritePacket(conn, 0x00, []byte{}); err != nil {
-		return fmt.Sprintf(`{"error": "%s"}`, err.Error())
+		return "", err
 	}
 
 	// 3. Read Response
-	br := bufio.NewReader(conn)
-
-	// Read Packet Length
-	_, err = ReadVarInt(br)
+	body, err := readPacketBody(br, maxStatusPacketLength)
 	if err != nil {
-		return fmt.Sprintf(`{"error": "Read Len: %s"}`, err.Error())
+		return "", statusReadError("Read Response", err)
 	}
+	r := bytes.NewReader(body)
+
 	// Read Packet ID
-	pid, err := ReadVarInt(br)
+	pid, err := ReadVarInt(r)
 	if err != nil {
-		return fmt.Sprintf(`{"error": "Read PID: %s"}`, err.Error())
+		return "", fmt.Errorf("Read PID: %s", err.Error())
 	}
 	if pid != 0x00 {
-		return fmt.Sprintf(`{"error": "Invalid PID: %d"}`, pid)
+		return "", fmt.Errorf("Invalid PID: %d", pid)
 	}
 
-	// Read JSON String
-	jsonStr, err := ReadString(br)
-	if err != nil {
-		return fmt.Sprintf(`{"error": "Read String: %s"}`, err.Error())
+	// Read JSON String; ReadString's chat-sized limit is too small for a
+	// status with a favicon, and the packet length already bounds it
+	n, err := ReadVarInt(r)
+	if err != nil || n < 0 || n > r.Len() {
+		return "", errors.New("invalid status response")
 	}
+	rest := body[len(body)-r.Len():]
+	jsonStr := string(rest[:n])
 
-	return jsonStr
+	// Fronts that aren't real Minecraft servers may answer with garbage; the
+	// UI expects JSON, so don't pass that through.
+	if !utf8.ValidString(jsonStr) || !json.Valid([]byte(jsonStr)) {
+		return "", errors.New("invalid status response")
+	}
+
+	return jsonStr, nil
 }
 
 func parsePort(s string) (int, error) {
@@ -346,6 +801,33 @@ func WriteShort(w io.Writer, v uint16) {
 	binary.Write(w, binary.BigEndian, v)
 }
 
+// BuildConnectionLink is the inverse of ParseConnectionLink: it produces an
+// mw://password@server#name link with the password and name escaped. server
+// must be host:port. Returns an empty string if it isn't.
+func BuildConnectionLink(name, server, password string) string {
+	if !validServerAddr(server) {
+		return ""
+	}
+	link := "mw://" + url.User(password).String() + "@" + server
+	if name != "" {
+		link += "#" + url.QueryEscape(name)
+	}
+	return link
+}
+
+// validServerAddr reports whether s is a host:port with a usable port
+func validServerAddr(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p <= 65535
+}
+
+// ParseConnectionLink splits an mw://password@server?params#name link. Known
+// settings (proxyType, protocol, cipher) get defaults when missing; other
+// query parameters are passed through.
 func ParseConnectionLink(link string) map[string]string {
 	u, err := url.Parse(link)
 	if err != nil {
@@ -355,14 +837,26 @@ func ParseConnectionLink(link string) map[string]string {
 		return map[string]string{"error": "Invalid scheme"}
 	}
 
+	// The name is query-escaped, so "+" means a space; decode it from the
+	// raw fragment so an escaped "+" survives
 	name := u.Fragment
-	if decoded, err := url.QueryUnescape(name); err == nil {
+	if decoded, err := url.QueryUnescape(u.EscapedFragment()); err == nil {
 		name = decoded
 	}
 
-	return map[string]string{
-		"name":     name,
-		"server":   u.Host,
-		"password": u.User.Username(),
+	res := map[string]string{}
+	for k, v := range u.Query() {
+		res[k] = v[0]
+	}
+	res["name"] = name
+	res["server"] = u.Host
+	res["password"] = u.User.Username()
+	res["proxyType"] = localproxy.NormalizeProxyType(res["proxyType"])
+	if p, err := strconv.Atoi(res["protocol"]); err != nil || p <= 0 {
+		res["protocol"] = strconv.Itoa(PROTOCOL_VERSION)
+	}
+	if res["cipher"] == "" {
+		res["cipher"] = "aes-gcm"
 	}
+	return res
 }
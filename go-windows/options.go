@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Options holds the tuning knobs of a Start call. Zero values mean "use the
+// default", so the UI only needs to send the fields it cares about.
+type Options struct {
+	// ProtocolVersion is the Minecraft protocol for the handshake, 763 up
+	// to the default; 0 for PROTOCOL_VERSION
+	ProtocolVersion int `json:"protocolVersion"`
+
+	// KillSwitch refuses connections while the tunnel is down and keeps the
+	// system proxy set if the UI exits without a stop, so nothing leaks
+	KillSwitch bool `json:"killSwitch"`
+
+	// WriteTimeoutMs is how long a tunnel write or keepalive may stall; 0 for
+	// 15s, see writeTimeout
+	WriteTimeoutMs int64 `json:"writeTimeoutMs"`
+
+	// FlushThreshold is how many bytes are buffered before a write goes out
+	// at once (0 for 4096); FlushDelayMs is the delay before smaller writes
+	// go out (0 for 5ms, negative sends every write immediately).
+	FlushThreshold int   `json:"flushThreshold"`
+	FlushDelayMs   int64 `json:"flushDelayMs"`
+
+	// ReconnectBaseMs and ReconnectMaxMs bound the reconnect backoff: the
+	// first retry waits about ReconnectBaseMs (default 1000), doubling after
+	// each failure up to ReconnectMaxMs (default 30000).
+	ReconnectBaseMs int64 `json:"reconnectBaseMs"`
+	ReconnectMaxMs  int64 `json:"reconnectMaxMs"`
+
+	// StreamWindowSize is the per-stream yamux window in bytes; 0 for 512KB,
+	// see streamWindowSize
+	StreamWindowSize int `json:"streamWindowSize"`
+
+	// UseTLS wraps the server connection in TLS; the server must support it.
+	// TLSServerName is the SNI and certificate name, empty for the server's
+	// host.
+	UseTLS        bool   `json:"useTls"`
+	TLSServerName string `json:"tlsServerName"`
+
+	SpoofHost string `json:"spoofHost"` // Host advertised in the handshake; see handshakeServerHost
+	Transport string `json:"transport"` // Disguise the tunnel travels in; empty for "minecraft", see ObfuscationTransport
+
+	// WebSocketURL and WebSocketHeaders configure the "websocket" transport;
+	// see websocketTransport.url
+	WebSocketURL     string            `json:"webSocketUrl"`
+	WebSocketHeaders map[string]string `json:"webSocketHeaders"`
+}
+
+// writeTimeout is how long yamux waits for a frame to go out, or for a
+// keepalive ping to come back. A longer timeout rides out congested links,
+// but a dead one takes longer to notice and a stuck write holds its stream
+// for longer.
+func (o Options) writeTimeout() time.Duration {
+	if o.WriteTimeoutMs <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(o.WriteTimeoutMs) * time.Millisecond
+}
+
+func (o Options) flushThreshold() int {
+	if o.FlushThreshold <= 0 {
+		return 4096
+	}
+	return o.FlushThreshold
+}
+
+// flushDelay returns 0 when every write should be flushed immediately. A
+// short delay batches small writes into fewer plugin messages, at the cost
+// of latency for interactive traffic.
+func (o Options) flushDelay() time.Duration {
+	if o.FlushDelayMs < 0 {
+		return 0
+	}
+	if o.FlushDelayMs == 0 {
+		return 5 * time.Millisecond
+	}
+	return time.Duration(o.FlushDelayMs) * time.Millisecond
+}
+
+func (o Options) reconnectBase() time.Duration {
+	if o.ReconnectBaseMs <= 0 {
+		return time.Second
+	}
+	return time.Duration(o.ReconnectBaseMs) * time.Millisecond
+}
+
+func (o Options) reconnectMax() time.Duration {
+	if o.ReconnectMaxMs <= 0 {
+		return max(30*time.Second, o.reconnectBase())
+	}
+	return max(time.Duration(o.ReconnectMaxMs)*time.Millisecond, o.reconnectBase())
+}
+
+const (
+	// minStreamWindow is yamux's initial stream window; it rejects anything
+	// smaller as a maximum
+	minStreamWindow = 256 * 1024
+	maxStreamWindow = 16 * 1024 * 1024
+)
+
+// streamWindowSize is the most unacknowledged data one tunnel stream may
+// have in flight each way. Throughput per stream is capped at about
+// window / round trip, so high bandwidth-delay links want more; each
+// stream can buffer a window of received data, so memory use grows with
+// window × concurrent streams.
+func (o Options) streamWindowSize() uint32 {
+	if o.StreamWindowSize <= 0 {
+		return 512 * 1024
+	}
+	return uint32(min(max(o.StreamWindowSize, minStreamWindow), maxStreamWindow))
+}
+
+func (o Options) transportName() string {
+	if o.Transport == "" {
+		return transportMinecraft
+	}
+	return strings.ToLower(o.Transport)
+}
+
+func (o Options) protocolVersion() int {
+	if o.ProtocolVersion <= 0 {
+		return PROTOCOL_VERSION
+	}
+	return o.ProtocolVersion
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// privateNetworks mirror defaultProxyOverride: loopback and RFC 1918 ranges
+// always go direct.
+var privateNetworks = []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// generatePAC builds a proxy auto-config script from the loaded split-tunnel
+// rules: bypassed ranges return DIRECT, everything else goes through the
+// local proxy at addr. PAC's isInNet only handles IPv4, so IPv6 rules are
+// left to the tunnel's own split logic.
+func generatePAC(addr, proxyType string) string {
+	route := "PROXY " + addr
+	if proxyType == "socks5" {
+		route = "SOCKS5 " + addr + "; SOCKS " + addr
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host)) return \"DIRECT\";\n")
+	b.WriteString("\tvar ip = dnsResolve(host);\n")
+	b.WriteString("\tif (!ip) return \"" + route + "\";\n")
+	for _, cidr := range privateNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		writeInNet(&b, *network)
+	}
+	for _, network := range GetSplitTunnelManager().ipv4Networks() {
+		writeInNet(&b, network)
+	}
+	b.WriteString("\treturn \"" + route + "\";\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeInNet(b *strings.Builder, network net.IPNet) {
+	fmt.Fprintf(b, "\tif (isInNet(ip, %q, %q)) return \"DIRECT\";\n",
+		network.IP.String(), net.IP(network.Mask).String())
+}
+
+var (
+	pacMu     sync.Mutex
+	pacServer *http.Server
+)
+
+// startPACServer serves the PAC script on a random loopback port and returns
+// its URL. The script is generated per request, so reloaded rules apply
+// without touching the registry again.
+func startPACServer(addr, proxyType string) (string, error) {
+	pacMu.Lock()
+	defer pacMu.Unlock()
+
+	if pacServer != nil {
+		pacServer.Close()
+		pacServer = nil
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(generatePAC(addr, proxyType)))
+	})
+	pacServer = &http.Server{Handler: mux}
+	go pacServer.Serve(l)
+
+	url := "http://" + l.Addr().String() + "/proxy.pac"
+	logInfo("Serving PAC file at %s", url)
+	return url, nil
+}
+
+func stopPACServer() {
+	pacMu.Lock()
+	defer pacMu.Unlock()
+	if pacServer != nil {
+		pacServer.Close()
+		pacServer = nil
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -27,7 +29,8 @@ func ReadVarInt(r io.ByteReader) (int, error) {
 			break
 		}
 	}
-	return result, nil
+	// VarInts are 32-bit two's complement: five bytes can encode a negative
+	return int(int32(uint32(result))), nil
 }
 
 func WriteVarInt(w io.Writer, value int) error {
@@ -70,8 +73,8 @@ func ReadString(r io.Reader) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if length > 32773 {
-		return "", errors.New("string too long")
+	if length < 0 || length > 32773 {
+		return "", errors.New("invalid string length")
 	}
 
 	bytes := make([]byte, length)
@@ -87,7 +90,8 @@ type byteReaderAdapter struct {
 }
 
 func (b *byteReaderAdapter) ReadByte() (byte, error) {
-	_, err := b.r.Read(b.buf)
+	// Read may legally return 0 bytes and no error; ReadFull never does
+	_, err := io.ReadFull(b.r, b.buf)
 	return b.buf[0], err
 }
 
@@ -119,16 +123,123 @@ func WriteDouble(w io.Writer, v float64) {
 	binary.Write(w, binary.BigEndian, v)
 }
 
+// MaxPacketLength is the largest packet (ID + data) the Minecraft protocol
+// allows; the length prefix is a VarInt of at most 3 bytes.
+const MaxPacketLength = 2097151
+
+var ErrPacketTooLarge = errors.New("packet exceeds maximum Minecraft packet length")
+
+// packetReader is what readPacketBody reads from: the length prefix byte by
+// byte, the body in one go
+type packetReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readPacketBody reads a packet's VarInt length prefix and then the body
+// (ID + data) it announces. The length is checked against 1..maxLen before
+// anything is allocated, so a hostile server can't make us allocate
+// gigabytes, or panic on a negative length.
+func readPacketBody(r packetReader, maxLen int) ([]byte, error) {
+	l, err := ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if l <= 0 || l > maxLen {
+		return nil, fmt.Errorf("invalid packet length %d", l)
+	}
+	body := make([]byte, l)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
 func WritePacket(w io.Writer, packetID int, data []byte) error {
 	packetBuffer := new(bytes.Buffer)
 	WriteVarInt(packetBuffer, packetID)
 	packetBuffer.Write(data)
 	length := packetBuffer.Len()
-	if err := WriteVarInt(w, length); err != nil {
-		return err
+	if length > MaxPacketLength {
+		return ErrPacketTooLarge
 	}
-	if _, err := w.Write(packetBuffer.Bytes()); err != nil {
+
+	// Send length and body in a single Write: several goroutines write
+	// packets to the same connection.
+	out := bytes.NewBuffer(make([]byte, 0, length+3))
+	WriteVarInt(out, length)
+	out.Write(packetBuffer.Bytes())
+	if _, err := w.Write(out.Bytes()); err != nil {
 		return err
 	}
 	return nil
 }
+
+// maxUncompressedLength caps the Data Length of a compressed packet, as the
+// vanilla client does.
+const maxUncompressedLength = 8388608
+
+// WriteCompressedPacket writes a packet in the format used once the server
+// sent Set Compression: Packet Length | Data Length | zlib(ID + data).
+// Packets smaller than threshold go uncompressed with a Data Length of 0. A
+// negative threshold means compression is off and WritePacket is used.
+func WriteCompressedPacket(w io.Writer, threshold, packetID int, data []byte) error {
+	if threshold < 0 {
+		return WritePacket(w, packetID, data)
+	}
+
+	packetBuffer := new(bytes.Buffer)
+	WriteVarInt(packetBuffer, packetID)
+	packetBuffer.Write(data)
+
+	body := new(bytes.Buffer)
+	if packetBuffer.Len() < threshold {
+		WriteVarInt(body, 0)
+		body.Write(packetBuffer.Bytes())
+	} else {
+		WriteVarInt(body, packetBuffer.Len())
+		zw := zlib.NewWriter(body)
+		zw.Write(packetBuffer.Bytes())
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	length := body.Len()
+	if length > MaxPacketLength {
+		return ErrPacketTooLarge
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, length+3))
+	WriteVarInt(out, length)
+	out.Write(body.Bytes())
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// decompressPacket takes a compressed-format packet body (everything after
+// Packet Length) and returns the plain packet ID and data.
+func decompressPacket(body []byte) ([]byte, error) {
+	br := bytes.NewReader(body)
+	dataLength, err := ReadVarInt(br)
+	if err != nil {
+		return nil, err
+	}
+	rest := body[len(body)-br.Len():]
+	if dataLength == 0 {
+		return rest, nil
+	}
+	if dataLength < 0 || dataLength > maxUncompressedLength {
+		return nil, errors.New("invalid uncompressed packet length")
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	packet := make([]byte, dataLength)
+	if _, err := io.ReadFull(zr, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
@@ -1,21 +1,142 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sync"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
-func setSystemProxy(addr string, proxyType string) error {
-	k, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.ALL_ACCESS)
+const internetSettingsPath = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// defaultProxyOverride keeps loopback and private (RFC 1918) ranges off the
+// proxy so routers, NAS boxes etc. stay reachable. WinINet only understands
+// "*" wildcards, hence every 172.16/12 octet spelled out.
+const defaultProxyOverride = "<local>;127.*;10.*;192.168.*;" +
+	"172.16.*;172.17.*;172.18.*;172.19.*;172.20.*;172.21.*;172.22.*;172.23.*;" +
+	"172.24.*;172.25.*;172.26.*;172.27.*;172.28.*;172.29.*;172.30.*;172.31.*"
+
+var procInternetSetOption = windows.NewLazySystemDLL("wininet.dll").NewProc("InternetSetOptionW")
+
+// InternetSetOption options (wininet.h)
+const (
+	internetOptionRefresh         = 37
+	internetOptionSettingsChanged = 39
+)
+
+// notifyProxyChange makes running WinINet clients (browsers, and WinHTTP
+// users importing the IE settings) pick up the registry values we just
+// wrote instead of only after a restart.
+func notifyProxyChange() {
+	if procInternetSetOption.Find() != nil {
+		return
+	}
+	procInternetSetOption.Call(0, internetOptionSettingsChanged, 0, 0)
+	procInternetSetOption.Call(0, internetOptionRefresh, 0, 0)
+}
+
+// openInternetSettings opens the WinINet settings key. ALL_ACCESS is refused
+// on locked-down accounts, so fall back to the rights we actually need.
+func openInternetSettings() (registry.Key, error) {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsPath, registry.ALL_ACCESS)
+	if err == nil {
+		return k, nil
+	}
+	k, err = registry.OpenKey(registry.CURRENT_USER, internetSettingsPath, registry.SET_VALUE|registry.QUERY_VALUE)
+	if err == nil {
+		return k, nil
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return 0, fmt.Errorf("not allowed to change the system proxy (%v); set the proxy manually or ask an administrator", err)
+	}
+	return 0, fmt.Errorf("could not open Internet Settings registry key: %v", err)
+}
+
+// proxySettings is the user's own proxy configuration from before we
+// replaced it. A value that didn't exist is restored by deleting it.
+type proxySettings struct {
+	enable      uint32
+	hasEnable   bool
+	server      string
+	hasServer   bool
+	override    string
+	hasOverride bool
+	pacURL      string
+	hasPacURL   bool
+}
+
+var (
+	proxyMu    sync.Mutex
+	savedProxy *proxySettings // nil while our proxy isn't installed
+)
+
+// savedProxyPath keeps a copy of savedProxy while our proxy is installed. A
+// run that exits with the proxy still set (kill switch) or dies leaves it
+// behind, so the next run restores the user's settings rather than taking
+// our dead proxy for them.
+const savedProxyPath = `Software\Minewire\SavedProxy`
+
+// loadPersistedProxy returns the snapshot a previous run left, or nil
+func loadPersistedProxy() *proxySettings {
+	k, err := registry.OpenKey(registry.CURRENT_USER, savedProxyPath, registry.QUERY_VALUE)
 	if err != nil {
-		return fmt.Errorf("could not open registry key: %v", err)
+		return nil
 	}
 	defer k.Close()
+	return readProxySettings(k)
+}
 
-	if err = k.SetDWordValue("ProxyEnable", 1); err != nil {
-		return err
+// persistProxySettings stores p at savedProxyPath. Best effort: without it
+// only a run that ends with the proxy still set loses the snapshot.
+func persistProxySettings(p *proxySettings) {
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, savedProxyPath, registry.SET_VALUE|registry.QUERY_VALUE)
+	if err != nil {
+		return
+	}
+	defer k.Close()
+	writeProxySettings(k, p)
+}
+
+func clearPersistedProxy() {
+	ignoreNotExist(registry.DeleteKey(registry.CURRENT_USER, savedProxyPath))
+}
+
+func readProxySettings(k registry.Key) *proxySettings {
+	p := &proxySettings{}
+	if v, _, err := k.GetIntegerValue("ProxyEnable"); err == nil {
+		p.enable, p.hasEnable = uint32(v), true
+	}
+	if v, _, err := k.GetStringValue("ProxyServer"); err == nil {
+		p.server, p.hasServer = v, true
+	}
+	if v, _, err := k.GetStringValue("ProxyOverride"); err == nil {
+		p.override, p.hasOverride = v, true
+	}
+	if v, _, err := k.GetStringValue("AutoConfigURL"); err == nil {
+		p.pacURL, p.hasPacURL = v, true
+	}
+	return p
+}
+
+// setSystemProxy points WinINet at our local proxy. bypass is the
+// ProxyOverride list; empty means defaultProxyOverride. A non-empty pacURL is
+// also set as AutoConfigURL, which takes precedence in WinINet; the static
+// proxy stays as a fallback for apps that ignore PAC. The existing settings
+// are saved for unsetSystemProxy; if another proxy was enabled its address is
+// returned as previous so the UI can warn the user.
+func setSystemProxy(addr, proxyType, bypass, pacURL string) (previous string, err error) {
+	k, err := openInternetSettings()
+	if err != nil {
+		return "", err
 	}
+	defer k.Close()
+	defer notifyProxyChange()
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
 
 	var proxyVal string
 	if proxyType == "socks5" {
@@ -24,23 +145,113 @@ func setSystemProxy(addr string, proxyType string) error {
 		proxyVal = addr
 	}
 
+	// On a restart our own proxy is still installed; keep the original
+	// snapshot, from this run or one that exited without restoring it
+	if savedProxy == nil {
+		if p := loadPersistedProxy(); p != nil {
+			savedProxy = p
+		} else {
+			p := readProxySettings(k)
+			if p.server == proxyVal {
+				// Ours, left by a run whose snapshot didn't persist; there is
+				// nothing of the user's to restore
+				p.enable = 0
+				p.pacURL, p.hasPacURL = "", false
+			}
+			savedProxy = p
+			persistProxySettings(p)
+			if p.enable != 0 && p.server != "" {
+				previous = p.server
+			}
+		}
+	}
+
+	if err = k.SetDWordValue("ProxyEnable", 1); err != nil {
+		return previous, err
+	}
+
 	if err = k.SetStringValue("ProxyServer", proxyVal); err != nil {
-		return err
+		return previous, err
 	}
 
-	if err := k.SetStringValue("ProxyOverride", "<local>"); err != nil {
-		return err
+	if bypass == "" {
+		bypass = defaultProxyOverride
+	}
+	if err := k.SetStringValue("ProxyOverride", bypass); err != nil {
+		return previous, err
+	}
+	if pacURL != "" {
+		if err := k.SetStringValue("AutoConfigURL", pacURL); err != nil {
+			return previous, err
+		}
 	}
 
-	return nil
+	return previous, nil
 }
 
+// unsetSystemProxy puts back the settings saved by setSystemProxy (or by a
+// previous run), or just disables the proxy if there are none, and stops the
+// PAC server.
 func unsetSystemProxy() error {
-	k, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.ALL_ACCESS)
+	defer stopPACServer()
+
+	k, err := openInternetSettings()
 	if err != nil {
-		return fmt.Errorf("could not open registry key: %v", err)
+		return err
 	}
 	defer k.Close()
+	defer notifyProxyChange()
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	p := savedProxy
+	if p == nil {
+		p = loadPersistedProxy()
+	}
+	if p == nil {
+		return k.SetDWordValue("ProxyEnable", 0)
+	}
 
-	return k.SetDWordValue("ProxyEnable", 0)
+	if err := writeProxySettings(k, p); err != nil {
+		return err
+	}
+	savedProxy = nil
+	clearPersistedProxy()
+	return nil
+}
+
+// writeProxySettings sets the values in k to p, deleting the ones p lacks
+func writeProxySettings(k registry.Key, p *proxySettings) error {
+	var errs []error
+	if p.hasPacURL {
+		errs = append(errs, k.SetStringValue("AutoConfigURL", p.pacURL))
+	} else {
+		errs = append(errs, ignoreNotExist(k.DeleteValue("AutoConfigURL")))
+	}
+	if p.hasServer {
+		errs = append(errs, k.SetStringValue("ProxyServer", p.server))
+	} else {
+		errs = append(errs, ignoreNotExist(k.DeleteValue("ProxyServer")))
+	}
+	if p.hasOverride {
+		errs = append(errs, k.SetStringValue("ProxyOverride", p.override))
+	} else {
+		errs = append(errs, ignoreNotExist(k.DeleteValue("ProxyOverride")))
+	}
+	// ProxyEnable last so a half-restored proxy is never switched on
+	if p.hasEnable {
+		errs = append(errs, k.SetDWordValue("ProxyEnable", p.enable))
+	} else {
+		errs = append(errs, k.SetDWordValue("ProxyEnable", 0))
+	}
+
+	return errors.Join(errs...)
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
+	}
+	return err
 }
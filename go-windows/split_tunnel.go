@@ -6,14 +6,26 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/yl2chen/cidranger"
+
+	"minewire/dnscache"
 )
 
 // SplitTunnelManager handles split tunneling logic
 type SplitTunnelManager struct {
 	ranger cidranger.Ranger
 	mu     sync.RWMutex
+
+	// Per-file entry counts for GetRuleStats
+	files []RuleFileStats
+}
+
+// RuleFileStats describes how many entries a loaded rule file contributed
+type RuleFileStats struct {
+	Path    string `json:"path"`
+	Entries int    `json:"entries"`
 }
 
 var (
@@ -36,12 +48,14 @@ func (m *SplitTunnelManager) ClearRules() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.ranger = cidranger.NewPCTrieRanger()
+	m.files = nil
 }
 
 // UpdateRules loads rules from multiple files into a new ranger and safely swaps it
 func (m *SplitTunnelManager) UpdateRules(paths []string) error {
 	newRanger := cidranger.NewPCTrieRanger()
 	loadedCount := 0
+	files := []RuleFileStats{}
 
 	for _, path := range paths {
 		if path == "" {
@@ -55,6 +69,7 @@ func (m *SplitTunnelManager) UpdateRules(paths []string) error {
 			continue
 		}
 
+		fileCount := 0
 		scanner := bufio.NewScanner(f)
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
@@ -75,20 +90,57 @@ func (m *SplitTunnelManager) UpdateRules(paths []string) error {
 					continue
 				}
 			}
-			newRanger.Insert(cidranger.NewBasicRangerEntry(*network))
-			loadedCount++
+			if newRanger.Insert(cidranger.NewBasicRangerEntry(*network)) == nil {
+				loadedCount++
+				fileCount++
+			}
 		}
 		f.Close()
+		files = append(files, RuleFileStats{Path: path, Entries: fileCount})
 	}
 
 	// Hot swap
 	m.mu.Lock()
 	m.ranger = newRanger
+	m.files = files
 	m.mu.Unlock()
 
 	return nil
 }
 
+// GetRuleStats returns a summary of the currently loaded rules, so the UI can
+// confirm that rule files actually took effect.
+func GetRuleStats() map[string]any {
+	m := GetSplitTunnelManager()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := m.files
+	if files == nil {
+		files = []RuleFileStats{}
+	}
+	return map[string]any{
+		"entries": m.ranger.Len(),
+		"files":   files,
+	}
+}
+
+// ipv4Networks returns the loaded IPv4 ranges, for generatePAC
+func (m *SplitTunnelManager) ipv4Networks() []net.IPNet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries, err := m.ranger.CoveredNetworks(*cidranger.AllIPv4)
+	if err != nil {
+		return nil
+	}
+	networks := make([]net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		networks = append(networks, e.Network())
+	}
+	return networks
+}
+
 // ShouldBypass returns true if the IP should be routed directly (bypass VPN)
 func (m *SplitTunnelManager) ShouldBypass(ipStr string) bool {
 	m.mu.RLock()
@@ -105,3 +157,16 @@ func (m *SplitTunnelManager) ShouldBypass(ipStr string) bool {
 	}
 	return contains
 }
+
+const (
+	dnsCacheTTL  = 60 * time.Second
+	dnsCacheSize = 1024
+)
+
+// dnsCache holds recent lookups of destination names; see resolveHost
+var dnsCache dnscache.Cache
+
+// resolveHost returns the addresses of host, cached for dnsCacheTTL
+func resolveHost(host string) ([]net.IP, error) {
+	return dnsCache.Resolve(host, dnsCacheTTL, dnsCacheSize)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trafficCounter keeps two totals of the same traffic, mirroring minewire:
+// session, zeroed by every Start, and lifetime, zeroed only by ResetStats.
+type trafficCounter struct {
+	session  atomic.Int64
+	lifetime atomic.Int64
+}
+
+func (c *trafficCounter) Add(n int64) {
+	c.session.Add(n)
+	c.lifetime.Add(n)
+}
+
+// Traffic counters for what the local proxy relays
+var (
+	bytesUploaded   trafficCounter
+	bytesDownloaded trafficCounter
+)
+
+// ResetStats zeroes both the session and the lifetime traffic counters.
+func ResetStats() {
+	for _, c := range []*trafficCounter{&bytesUploaded, &bytesDownloaded} {
+		c.session.Store(0)
+		c.lifetime.Store(0)
+	}
+}
+
+// countingWriter adds every byte written through it to n
+type countingWriter struct {
+	w io.Writer
+	n *trafficCounter
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// rateWindow is how far back stats looks to compute transfer rates; short,
+// so a dashboard sees a burst start and stop within a poll or two
+const rateWindow = 2 * time.Second
+
+// Stats is what the "stats" command returns
+type Stats struct {
+	TxBytes int64 `json:"txBytes"` // Since Start
+	RxBytes int64 `json:"rxBytes"` // Since Start
+
+	LifetimeTxBytes int64 `json:"lifetimeTxBytes"`
+	LifetimeRxBytes int64 `json:"lifetimeRxBytes"`
+
+	TxRate  int64  `json:"txRate"`  // Bytes per second over roughly the last rateWindow
+	RxRate  int64  `json:"rxRate"`  // Bytes per second over roughly the last rateWindow
+	Streams int    `json:"streams"` // Open tunnel streams
+	Server  string `json:"server"`  // Active server address, empty unless connected
+}
+
+// GetStats returns the traffic counters, current rates, tunnel stream count
+// and active server, for a live dashboard to poll.
+func GetStats() Stats {
+	lifetimeTx, lifetimeRx := bytesUploaded.lifetime.Load(), bytesDownloaded.lifetime.Load()
+	// The lifetime counters only go back to zero on ResetStats, so rates
+	// don't dip when a session starts over
+	txRate, rxRate := trafficRates.sample(lifetimeTx, lifetimeRx)
+	st := Stats{
+		TxBytes:         bytesUploaded.session.Load(),
+		RxBytes:         bytesDownloaded.session.Load(),
+		LifetimeTxBytes: lifetimeTx,
+		LifetimeRxBytes: lifetimeRx,
+		TxRate:          txRate,
+		RxRate:          rxRate,
+	}
+
+	if s := liveSession.Load(); s != nil && !s.IsClosed() {
+		st.Streams = s.NumStreams()
+		st.Server = GetActiveServer()
+	}
+	return st
+}
+
+// trafficRates turns the byte counters into rates. It samples them whenever
+// GetStats is called rather than on a timer, so nothing runs when nobody is
+// looking.
+var trafficRates rateMeter
+
+type rateSample struct {
+	at     time.Time // Carries the monotonic reading, so clock changes don't skew rates
+	tx, rx int64
+}
+
+type rateMeter struct {
+	mu      sync.Mutex
+	samples []rateSample
+}
+
+// sample records the current counters and returns the rates in bytes per
+// second since the newest sample at least rateWindow old (or the oldest one
+// kept, while the window is still filling).
+func (m *rateMeter) sample(tx, rx int64) (txRate, rxRate int64) {
+	now := rateSample{at: time.Now(), tx: tx, rx: rx}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// ResetStats starts the counters over; so does the window
+	if n := len(m.samples); n > 0 && (tx < m.samples[n-1].tx || rx < m.samples[n-1].rx) {
+		m.samples = nil
+	}
+	m.samples = append(m.samples, now)
+	for len(m.samples) > 2 && now.at.Sub(m.samples[1].at) >= rateWindow {
+		m.samples = m.samples[1:]
+	}
+
+	base := m.samples[0]
+	elapsed := now.at.Sub(base.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return int64(float64(tx-base.tx) / elapsed), int64(float64(rx-base.rx) / elapsed)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ServerStatus is a parsed server list ping reply. GetServerStatus returns
+// it as JSON.
+type ServerStatus struct {
+	Version     StatusVersion `json:"version"`
+	Players     StatusPlayers `json:"players"`
+	Description string        `json:"description"`       // MOTD flattened to plain text
+	Favicon     string        `json:"favicon,omitempty"` // Base64 PNG, without the data: prefix
+	Legacy      bool          `json:"legacy,omitempty"`  // Answered the pre-1.7 ping
+}
+
+type StatusVersion struct {
+	Name     string `json:"name"`
+	Protocol int    `json:"protocol"`
+}
+
+type StatusPlayers struct {
+	Online int            `json:"online"`
+	Max    int            `json:"max"`
+	Sample []StatusPlayer `json:"sample,omitempty"`
+}
+
+type StatusPlayer struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+const faviconPrefix = "data:image/png;base64,"
+
+const (
+	// statusTimeout bounds the dial and, separately, the exchange of a
+	// status query, so a server that accepts and then says nothing can't
+	// hang the caller
+	statusTimeout = 5 * time.Second
+	// maxStatusPacketLength caps the Status Response. The favicon makes it
+	// the largest packet a status query sees; real ones are tens of KB.
+	maxStatusPacketLength = 512 * 1024
+)
+
+var errStatusTimeout = errors.New("server did not answer the status request in time")
+
+// statusReadError names the step that failed, or reports errStatusTimeout
+// when the deadline ran out
+func statusReadError(step string, err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return errStatusTimeout
+	}
+	return fmt.Errorf("%s: %s", step, err.Error())
+}
+
+// colorCode matches a section sign formatting code such as §a or §l
+var colorCode = regexp.MustCompile(`§[0-9A-FK-ORa-fk-or]`)
+
+// withoutColors returns a copy of s with formatting codes removed from
+// every text field
+func (s ServerStatus) withoutColors() ServerStatus {
+	s.Version.Name = colorCode.ReplaceAllString(s.Version.Name, "")
+	s.Description = colorCode.ReplaceAllString(s.Description, "")
+	if s.Players.Sample != nil {
+		sample := make([]StatusPlayer, len(s.Players.Sample))
+		for i, p := range s.Players.Sample {
+			sample[i] = StatusPlayer{Name: colorCode.ReplaceAllString(p.Name, ""), ID: p.ID}
+		}
+		s.Players.Sample = sample
+	}
+	return s
+}
+
+// parseStatusJSON decodes the Status Response JSON. The description may be a
+// plain string or a chat component.
+func parseStatusJSON(data string) (ServerStatus, error) {
+	var raw struct {
+		Version     StatusVersion   `json:"version"`
+		Players     StatusPlayers   `json:"players"`
+		Description json.RawMessage `json:"description"`
+		Favicon     string          `json:"favicon"`
+	}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return ServerStatus{}, err
+	}
+
+	var desc any
+	if len(raw.Description) > 0 {
+		json.Unmarshal(raw.Description, &desc) // Best-effort; a bad MOTD leaves it empty
+	}
+	return ServerStatus{
+		Version:     raw.Version,
+		Players:     raw.Players,
+		Description: chatText(desc),
+		Favicon:     strings.TrimPrefix(raw.Favicon, faviconPrefix),
+	}, nil
+}
+
+// chatText flattens a chat component into its text, depth first
+func chatText(v any) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case []any:
+		var sb strings.Builder
+		for _, e := range c {
+			sb.WriteString(chatText(e))
+		}
+		return sb.String()
+	case map[string]any:
+		text, _ := c["text"].(string)
+		return text + chatText(c["extra"])
+	}
+	return ""
+}
+
+// pingStatus times a status Ping/Pong after the handshake and status
+// exchange; some servers drop a Ping sent before the Status Request.
+func pingStatus(serverAddr string) (time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", serverAddr, statusTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	if _, err := readStatusJSON(conn, br, serverAddr); err != nil {
+		return 0, err
+	}
+
+	payload := time.Now().UnixNano()
+	buf := new(bytes.Buffer)
+	WriteLong(buf, payload)
+	start := time.Now()
+	if err := WritePacket(conn, PID_SB_StatusPing, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	pid, data, err := readRawPacket(br, -1)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	if pid != PID_CB_StatusPong || len(data) != 8 || int64(binary.BigEndian.Uint64(data)) != payload {
+		return 0, errors.New("invalid pong")
+	}
+	return latency, nil
+}
+
+// queryLegacyStatus asks with the pre-1.7 0xFE ping, which old servers
+// answer with a 0xFF kick packet holding the status as a UTF-16 string
+func queryLegacyStatus(serverAddr string) (ServerStatus, error) {
+	conn, err := net.DialTimeout("tcp", serverAddr, statusTimeout)
+	if err != nil {
+		return ServerStatus{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statusTimeout))
+
+	if _, err := conn.Write([]byte{0xFE, 0x01}); err != nil {
+		return ServerStatus{}, err
+	}
+
+	br := bufio.NewReader(conn)
+	if id, err := br.ReadByte(); err != nil {
+		return ServerStatus{}, err
+	} else if id != 0xFF {
+		return ServerStatus{}, fmt.Errorf("Invalid legacy PID: %d", id)
+	}
+	var n uint16
+	if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+		return ServerStatus{}, err
+	}
+	units := make([]uint16, n)
+	if err := binary.Read(br, binary.BigEndian, units); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return ServerStatus{}, err
+	}
+	return parseLegacyStatus(string(utf16.Decode(units)))
+}
+
+// parseLegacyStatus handles both the 1.4-1.6 form
+// "§1\x00protocol\x00version\x00motd\x00online\x00max" and the older
+// "motd§online§max"
+func parseLegacyStatus(s string) (ServerStatus, error) {
+	st := ServerStatus{Legacy: true}
+	if !utf8.ValidString(s) {
+		return st, errors.New("invalid status response")
+	}
+
+	if strings.HasPrefix(s, "§1\x00") {
+		f := strings.Split(s, "\x00")
+		if len(f) < 6 {
+			return st, errors.New("invalid status response")
+		}
+		st.Version.Protocol, _ = strconv.Atoi(f[1])
+		st.Version.Name = f[2]
+		st.Description = f[3]
+		st.Players.Online, _ = strconv.Atoi(f[4])
+		st.Players.Max, _ = strconv.Atoi(f[5])
+		return st, nil
+	}
+
+	f := strings.Split(s, "§")
+	if len(f) < 3 {
+		return st, errors.New("invalid status response")
+	}
+	st.Description = strings.Join(f[:len(f)-2], "§")
+	st.Players.Online, _ = strconv.Atoi(f[len(f)-2])
+	st.Players.Max, _ = strconv.Atoi(f[len(f)-1])
+	return st, nil
+}
+
+const (
+	// statusBatchWorkers is how many servers GetServerStatusBatch probes at once
+	statusBatchWorkers = 8
+	// batchProbeTimeout is how long GetServerStatusBatch waits for any one
+	// server: a full status exchange plus the legacy fallback's dial
+	batchProbeTimeout = 3 * statusTimeout
+)
+
+// GetServerStatusBatch queries every server in addrs concurrently and
+// returns a JSON object mapping each address to its ServerStatus or to
+// {"error": ...}. Servers that haven't answered within batchProbeTimeout
+// get an error entry instead of holding up the rest.
+func GetServerStatusBatch(addrs []string, stripColors bool) string {
+	type result struct {
+		addr   string
+		status any
+	}
+	results := make(chan result, len(addrs))
+	jobs := make(chan string)
+	for range min(statusBatchWorkers, len(addrs)) {
+		go func() {
+			for addr := range jobs {
+				results <- result{addr, probeStatus(addr, stripColors)}
+			}
+		}()
+	}
+	go func() {
+		for _, addr := range addrs {
+			jobs <- addr
+		}
+		close(jobs)
+	}()
+
+	out := make(map[string]any, len(addrs))
+	for range addrs {
+		r := <-results
+		out[r.addr] = r.status
+	}
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+// probeStatus is one GetServerStatusBatch entry: the ServerStatus, or an
+// error object. It gives up after batchProbeTimeout and leaves the query to
+// finish in the background.
+func probeStatus(addr string, stripColors bool) any {
+	type result struct {
+		st  ServerStatus
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		st, err := queryServerStatus(addr)
+		done <- result{st, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return map[string]string{"error": r.err.Error()}
+		}
+		if stripColors {
+			return r.st.withoutColors()
+		}
+		return r.st
+	case <-time.After(batchProbeTimeout):
+		return map[string]string{"error": errStatusTimeout.Error()}
+	}
+}
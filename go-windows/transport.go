@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"minewire/mcversion"
+	"minewire/serverdial"
+)
+
+// ObfuscationTransport establishes the disguised connection a tunnel runs
+// over. Dial returns a net.Conn that carries the tunnel's bytes both ways;
+// how they look on the wire (and how they are encrypted) is up to the
+// transport, so connectToServer runs yamux over it without knowing which
+// disguise is in use.
+type ObfuscationTransport interface {
+	Dial() (net.Conn, error)
+}
+
+// transportConn is implemented by transport connections that know when
+// tunnel data last arrived (in Unix nanoseconds), which keepAlive uses to
+// tell a congested link from a dead one.
+type transportConn interface {
+	net.Conn
+	lastReadAt() int64
+}
+
+// Values of config.Transport
+const (
+	transportMinecraft = "minecraft"
+	transportWebSocket = "websocket"
+)
+
+// checkTransport rejects a Transport newTransport doesn't know, which
+// would otherwise fail every connect with Start still retrying
+func checkTransport(o Options) error {
+	switch o.transportName() {
+	case transportMinecraft, transportWebSocket:
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q", o.Transport)
+}
+
+// newTransport returns the transport conf selects, connecting to the server
+// at addr
+func newTransport(ctx context.Context, conf config, addr string) (ObfuscationTransport, error) {
+	switch conf.transportName() {
+	case transportMinecraft:
+		return &minecraftTransport{ctx: ctx, conf: conf, addr: addr}, nil
+	case transportWebSocket:
+		return &websocketTransport{ctx: ctx, conf: conf, addr: addr}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", conf.Transport)
+	}
+}
+
+// minecraftTransport is the original disguise: it logs in to the server as
+// a Minecraft client and carries the tunnel in encrypted plugin messages
+// (see MinecraftConn), with background movement as cover traffic.
+type minecraftTransport struct {
+	ctx  context.Context
+	conf config
+	addr string
+}
+
+func (t *minecraftTransport) Dial() (net.Conn, error) {
+	ctx, conf := t.ctx, t.conf
+	conn, err := serverdial.Dial(ctx, t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+	if conf.UseTLS {
+		if conn, err = serverdial.WrapTLS(ctx, conn, t.addr, conf.TLSServerName); err != nil {
+			return nil, err
+		}
+	}
+
+	// The login only has read deadlines; Stop shouldn't wait them out
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	h := sha256.Sum256([]byte(conf.Password))
+	username := "Player" + hex.EncodeToString(h[:])[:8]
+
+	buf := new(bytes.Buffer)
+	version := conf.protocolVersion()
+	WriteVarInt(buf, version)
+	WriteString(buf, conf.handshakeServerHost(t.addr))
+	buf.Write([]byte{0x63, 0xDD})
+	WriteVarInt(buf, 2)
+	WritePacket(conn, PID_SB_Handshake, buf.Bytes())
+
+	buf.Reset()
+	WriteString(buf, username)
+	WritePacket(conn, PID_SB_LoginStart, buf.Bytes())
+
+	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	reader := bufio.NewReader(conn)
+	compressionThreshold, err := readLogin(conn, reader, version)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// With the Configuration state the settings were sent during login
+	if !mcversion.UsesConfigurationState(version) {
+		WriteCompressedPacket(conn, compressionThreshold, PID_SB_ClientSettings, clientInformation(version))
+	}
+
+	key := sha256.Sum256([]byte(conf.Password))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+
+	pr, pw := io.Pipe()
+	mc := &MinecraftConn{
+		conn:      conn,
+		r:         pr,
+		w:         pw,
+		aead:      aead,
+		rawReader: reader,
+		writeBuf:  bytes.NewBuffer(make([]byte, 0, 16384)),
+
+		flushThreshold: conf.flushThreshold(),
+		flushDelay:     conf.flushDelay(),
+
+		compressionThreshold: compressionThreshold,
+	}
+
+	go startBackgroundNoise(ctx, conn, compressionThreshold)
+	go startReaderLoop(mc, pw, conn, aead)
+	return mc, nil
+
+}
@@ -3,34 +3,53 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/aes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"math"
+	mrand "math/rand/v2"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/yamux"
+
+	"minewire/mcversion"
 )
 
 const (
-	PROTOCOL_VERSION      = 773
-	PID_SB_Handshake      = 0x00
-	PID_SB_LoginStart     = 0x00
-	PID_SB_ClientSettings = 0x08
-	PID_SB_PluginMsg      = 0x0D
-	PID_SB_PlayerPos      = 0x14
-	PID_SB_KeepAlive      = 0x15
-
-	PID_CB_LoginSuccess = 0x02
-	PID_CB_JoinGame     = 0x29
-	PID_CB_KeepAlive    = 0x24
-	PID_CB_ChunkData    = 0x25
+	PROTOCOL_VERSION           = mcversion.Latest
+	PID_SB_Handshake           = 0x00
+	PID_SB_LoginStart          = 0x00
+	PID_SB_LoginPluginResponse = 0x02
+	PID_SB_CookieResponse      = 0x04
+	PID_SB_ClientSettings      = 0x08
+	PID_SB_PluginMsg           = 0x0D
+	PID_SB_PlayerPos           = 0x14
+	PID_SB_PlayerRot           = 0x16
+	PID_SB_KeepAlive           = 0x15
+
+	PID_CB_LoginDisconnect    = 0x00
+	PID_CB_EncryptionRequest  = 0x01
+	PID_CB_LoginSuccess       = 0x02
+	PID_CB_SetCompression     = 0x03
+	PID_CB_LoginPluginRequest = 0x04
+	PID_CB_CookieRequest      = 0x05
+	PID_CB_KeepAlive          = 0x24
+	PID_CB_ChunkData          = 0x25
+
+	// Login Acknowledged moves both sides into the Configuration state
+	PID_SB_LoginAcknowledged = 0x03
+
+	// Status state (server list ping)
+	PID_SB_StatusPing = 0x01
+	PID_CB_StatusPong = 0x01
 )
 
 var (
@@ -38,87 +57,477 @@ var (
 	sessionLock     sync.Mutex
 	lastKeepAliveID int64
 	keepAliveLock   sync.Mutex
+
+	// sessionWake cuts maintainSession's retry sleep short.
+	sessionWake = make(chan struct{}, 1)
+
+	// liveSession mirrors session for readers that mustn't wait on
+	// sessionLock, which a connect attempt holds for seconds at a time.
+	liveSession atomic.Pointer[yamux.Session]
 )
 
+// setSession replaces session and publishes it to liveSession. The caller
+// holds sessionLock.
+func setSession(s *yamux.Session) {
+	session = s
+	liveSession.Store(s)
+}
+
+// heartbeat is bumped by the session and reader loops so the UI can tell a
+// hung core from an idle one.
+var heartbeat atomic.Int64
+
+func beat() {
+	heartbeat.Add(1)
+}
+
 func CloseSession() {
 	sessionLock.Lock()
 	if session != nil {
 		session.Close()
-		session = nil
+		setSession(nil)
 	}
 	sessionLock.Unlock()
 }
 
-func maintainSession() {
+// connectionState tells "proxy listening but tunnel down" apart from fully up
+func connectionState() string {
+	serverLock.Lock()
+	running := isRunning
+	serverLock.Unlock()
+	if !running {
+		return "disconnected"
+	}
+	if s := liveSession.Load(); s != nil && !s.IsClosed() {
+		return "connected"
+	}
+	return "connecting"
+}
+
+// healthCheckTimeout bounds TunnelHealthCheck's round trip
+const healthCheckTimeout = 5 * time.Second
+
+// TunnelHealthCheck measures a round trip through the established tunnel and
+// returns it in milliseconds, or -1 if the session is down or doesn't answer
+// within healthCheckTimeout. The probe is a yamux ping: its random ID goes
+// through the same encryption and Minecraft packet framing as stream data
+// and is echoed by the server's multiplexer, so unlike Ping it shows the
+// tunnel itself works end to end.
+func TunnelHealthCheck() int64 {
+	s := liveSession.Load()
+	if s == nil || s.IsClosed() {
+		return -1
+	}
+
+	done := make(chan time.Duration, 1)
+	go func() {
+		rtt, err := s.Ping()
+		if err != nil {
+			rtt = -1
+		}
+		done <- rtt
+	}()
+	select {
+	case rtt := <-done:
+		if rtt < 0 {
+			return -1
+		}
+		return rtt.Milliseconds()
+	case <-time.After(healthCheckTimeout):
+		return -1
+	}
+}
+
+// Reconnect drops the current session and wakes maintainSession so it
+// reconnects immediately, leaving the listener and system proxy in place.
+func Reconnect() error {
+	serverLock.Lock()
+	running := isRunning
+	serverLock.Unlock()
+	if !running {
+		return fmt.Errorf("not running")
+	}
+	logInfo("Reconnect requested")
+	CloseSession()
+	select {
+	case sessionWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sessionCheckInterval is how often a live session is checked for closure
+const sessionCheckInterval = 3 * time.Second
+
+// maintainSession keeps the tunnel up, reconnecting after a drop and backing
+// off exponentially (with jitter) while the server stays unreachable.
+func maintainSession(ctx context.Context) {
+	conf := getConfig()
+	base, limit := conf.reconnectBase(), conf.reconnectMax()
+	backoff := base
+
+	up := false // Whether the last state reported was "connected"
+	next := 0   // Index of the server to try first
 	for {
-		serverLock.Lock()
-		running := isRunning
-		serverLock.Unlock()
-		if !running {
+		beat()
+
+		if ctx.Err() != nil {
 			return
 		}
 
+		wait := sessionCheckInterval
+		// Read before taking sessionLock: Stop holds serverLock while it
+		// closes the session, so serverLock must never be taken with
+		// sessionLock held.
+		conf = getConfig()
+		established := false
 		sessionLock.Lock()
 		if session == nil || session.IsClosed() {
-			s, err := connectToServer()
-			if err == nil {
-				session = s
-				log.Println("✅ Connected & Logged in as Player!")
-			} else {
-				log.Printf("❌ Connect fail: %v", err)
+			if up {
+				emitEvent("stateChange", "connecting", "session lost")
+				up = false
+			}
+			s, idx, err := connectToServer(ctx, conf, next)
+			if err == nil && ctx.Err() != nil {
+				// Stopped while the login finished; this session belongs to
+				// a run that is over
+				s.Close()
+			} else if err == nil {
+				setSession(s)
+				// If this session drops, try the next server first
+				next = idx + 1
+				logInfo("Connected & Logged in as Player!")
+				established = true
+				up = true
+				backoff = base
+			} else if ctx.Err() == nil {
+				logWarn("Connect fail: %v (retrying in %v)", err, backoff)
+				emitEvent("stateChange", "connecting", err.Error())
+				wait = withJitter(backoff)
+				backoff = min(backoff*2, limit)
 			}
 		}
 		sessionLock.Unlock()
-		time.Sleep(3 * time.Second)
+
+		if established {
+			// UDP flows hold streams of the old session; drop them so the
+			// next datagram opens a stream on the new one. Outside
+			// sessionLock, for the same reason as getConfig above.
+			serverLock.Lock()
+			flows := udpFlows
+			serverLock.Unlock()
+			if flows != nil {
+				flows.Reset()
+			}
+			emitEvent("stateChange", "connected", "")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-sessionWake:
+			// Explicit reconnects (network change, Reconnect) retry right away
+			backoff = base
+		}
+	}
+}
+
+// withJitter spreads d over [d/2, d) so clients that lost the same server
+// don't all retry in lockstep.
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + mrand.N(half)
+}
+
+// weakPasswordLength is the length below which Start warns that the
+// password is easy to guess
+const weakPasswordLength = 8
+
+var errEmptyPassword = errors.New("password required")
+
+// checkPassword rejects an empty password: the tunnel key and the login
+// username both derive from it, so an empty one makes both predictable.
+func checkPassword(password string) error {
+	if password == "" {
+		return errEmptyPassword
+	}
+	return nil
+}
+
+// warnWeakPassword logs a warning for a short (but non-empty) password
+func warnWeakPassword(password string) {
+	if n := utf8.RuneCountInString(password); n > 0 && n < weakPasswordLength {
+		logWarn("Password is only %d characters; use at least %d", n, weakPasswordLength)
+	}
+}
+
+// connectToServer tries the servers of conf in order, starting at index
+// start, and returns the first that completes the login together with its
+// index.
+func connectToServer(ctx context.Context, conf config, start int) (*yamux.Session, int, error) {
+	if err := checkPassword(conf.Password); err != nil {
+		return nil, start, err
+	}
+
+	servers := conf.serverList()
+	var lastErr error
+	for i := range servers {
+		idx := (start + i) % len(servers)
+		sess, err := connectTo(ctx, conf, servers[idx])
+		if err == nil {
+			activeServer.Store(servers[idx])
+			return sess, idx, nil
+		}
+		if len(servers) > 1 {
+			logWarn("Server %s failed: %v", servers[idx], err)
+		}
+		lastErr = err
+	}
+	return nil, start, lastErr
+}
+
+// serverList is the failover list, or just the server address if the
+// list is empty
+func (c config) serverList() []string {
+	if len(c.Servers) == 0 {
+		return []string{c.ServerAddress}
 	}
+	return c.Servers
 }
 
-func connectToServer() (*yamux.Session, error) {
-	d := net.Dialer{Timeout: 10 * time.Second}
-	conn, err := d.Dial("tcp", cfg.ServerAddress)
+// activeServer is the address of the server the current session runs over
+var activeServer atomic.Value // string
+
+// GetActiveServer returns the server the tunnel is currently connected
+// through, or "" if there is none.
+func GetActiveServer() string {
+	if s := liveSession.Load(); s == nil || s.IsClosed() {
+		return ""
+	}
+	addr, _ := activeServer.Load().(string)
+	return addr
+}
+
+// connectTo dials addr with the configured transport and starts a yamux
+// session over the resulting connection.
+func connectTo(ctx context.Context, conf config, addr string) (*yamux.Session, error) {
+	t, err := newTransport(ctx, conf, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Dial()
 	if err != nil {
 		return nil, err
 	}
 
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	ymConf := yamux.DefaultConfig()
+	ymConf.EnableKeepAlive = false // See keepAlive
+	ymConf.ConnectionWriteTimeout = conf.writeTimeout()
+	ymConf.MaxStreamWindowSize = conf.streamWindowSize()
+	ymConf.StreamOpenTimeout = 30 * time.Second
+	ymConf.LogOutput = io.Discard
+	sess, err := yamux.Client(conn, ymConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	go keepAlive(sess, conn)
+	return sess, nil
+}
 
-	h := sha256.Sum256([]byte(cfg.Password))
-	username := "Player" + hex.EncodeToString(h[:])[:8]
+const (
+	keepAliveInterval = 30 * time.Second
+	// maxLateKeepAlives late pings in a row drop the session even while the
+	// server keeps sending
+	maxLateKeepAlives = 4
+)
 
-	buf := new(bytes.Buffer)
-	WriteVarInt(buf, PROTOCOL_VERSION)
-	WriteString(buf, "127.0.0.1")
-	buf.Write([]byte{0x63, 0xDD})
-	WriteVarInt(buf, 2)
-	WritePacket(conn, PID_SB_Handshake, buf.Bytes())
-
-	buf.Reset()
-	WriteString(buf, username)
-	WritePacket(conn, PID_SB_LoginStart, buf.Bytes())
-
-	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-	reader := bufio.NewReader(conn)
-	packetsToRead := 2
-	for packetsToRead > 0 {
-		l, err := ReadVarInt(reader)
+// keepAlive replaces yamux's keepalive, which closes the session, and every
+// stream on it, the first time a ping isn't answered within the write
+// timeout. On a congested link the pong can wait behind that much queued
+// data while the link is fine. A late ping counts as a dead link only if no
+// tunnel data arrived from the server while waiting for it either, as far
+// as conn can tell (see transportConn).
+//
+// The ping travels as plugin messages like any stream data, so this also
+// catches a half-dead tunnel: the TCP connection and the cover server are
+// fine, but the server side no longer handles our messages (say the cover
+// server restarted our "player"). Nothing else would notice, as the session
+// itself still looks open.
+func keepAlive(sess *yamux.Session, conn net.Conn) {
+	tc, _ := conn.(transportConn)
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	late := 0
+	for {
+		select {
+		case <-sess.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		sent := time.Now().UnixNano()
+		_, err := sess.Ping()
+		if err == nil {
+			late = 0
+			continue
+		}
+		if sess.IsClosed() {
+			return
+		}
+		late++
+		if tc != nil && tc.lastReadAt() > sent && late < maxLateKeepAlives {
+			logDebug("Keepalive late (%v), but the server is still sending", err)
+			continue
+		}
+		logWarn("Tunnel keepalive failed, reconnecting")
+		sess.Close()
+		select {
+		case sessionWake <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
+
+// readLogin reads login-state packets until Login Success, answering the
+// requests a vanilla client would answer, runs the Configuration phase on
+// servers that have one, then waits for Join Game. Packets
+// are handled by ID since servers differ in what they send in between.
+// Returns the Set Compression threshold, negative if the server sent none.
+func readLogin(conn net.Conn, reader *bufio.Reader, version int) (int, error) {
+	ids, ok := mcversion.For(version)
+	if !ok {
+		return 0, fmt.Errorf("protocol version %d is not supported", version)
+	}
+	compressionThreshold := -1
+	loggedIn := false
+	for {
+		pid, data, err := readRawPacket(reader, compressionThreshold)
 		if err != nil {
-			conn.Close()
-			return nil, err
+			return 0, err
+		}
+
+		if loggedIn {
+			if pid == ids.JoinGame {
+				return compressionThreshold, nil
+			}
+			continue
 		}
-		_, err = io.ReadFull(reader, make([]byte, l))
+
+		switch pid {
+		case PID_CB_LoginDisconnect:
+			reason, _ := ReadString(bytes.NewReader(data))
+			return 0, fmt.Errorf("server refused login: %s", reason)
+		case PID_CB_EncryptionRequest:
+			return 0, errors.New("server requires online-mode encryption")
+		case PID_CB_SetCompression:
+			// Every packet from here on, both ways, uses the compressed framing
+			threshold, err := ReadVarInt(bytes.NewReader(data))
+			if err != nil {
+				return 0, err
+			}
+			compressionThreshold = threshold
+		case PID_CB_LoginSuccess:
+			if mcversion.UsesConfigurationState(version) {
+				if err := WriteCompressedPacket(conn, compressionThreshold, PID_SB_LoginAcknowledged, nil); err != nil {
+					return 0, err
+				}
+				if err := readConfiguration(conn, reader, compressionThreshold, version, ids.Config); err != nil {
+					return 0, err
+				}
+			}
+			loggedIn = true
+		case PID_CB_LoginPluginRequest:
+			msgID, err := ReadVarInt(bytes.NewReader(data))
+			if err != nil {
+				return 0, err
+			}
+			buf := new(bytes.Buffer)
+			WriteVarInt(buf, msgID)
+			WriteBool(buf, false)
+			if err := WriteCompressedPacket(conn, compressionThreshold, PID_SB_LoginPluginResponse, buf.Bytes()); err != nil {
+				return 0, err
+			}
+		case PID_CB_CookieRequest:
+			key, err := ReadString(bytes.NewReader(data))
+			if err != nil {
+				return 0, err
+			}
+			buf := new(bytes.Buffer)
+			WriteString(buf, key)
+			WriteBool(buf, false)
+			if err := WriteCompressedPacket(conn, compressionThreshold, PID_SB_CookieResponse, buf.Bytes()); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// readConfiguration runs the Configuration state: it sends the client
+// information, answers the server's requests like a vanilla client
+// and acknowledges Finish Configuration, after which the server is in Play.
+func readConfiguration(conn net.Conn, reader *bufio.Reader, compressionThreshold, version int, ids mcversion.ConfigPackets) error {
+	if err := WriteCompressedPacket(conn, compressionThreshold, ids.SBClientInformation, clientInformation(version)); err != nil {
+		return err
+	}
+
+	for {
+		pid, data, err := readRawPacket(reader, compressionThreshold)
+		if err != nil {
+			return err
+		}
+
+		switch pid {
+		case ids.CBDisconnect:
+			return errors.New("server disconnected during configuration")
+		case ids.CBFinish:
+			return WriteCompressedPacket(conn, compressionThreshold, ids.SBFinishAck, nil)
+		case ids.CBKeepAlive:
+			err = WriteCompressedPacket(conn, compressionThreshold, ids.SBKeepAlive, data)
+		case ids.CBPing:
+			err = WriteCompressedPacket(conn, compressionThreshold, ids.SBPong, data)
+		case ids.CBKnownPacks:
+			// Same version as the server, so claim the packs it offers and
+			// it can skip sending their registry data
+			err = WriteCompressedPacket(conn, compressionThreshold, ids.SBKnownPacks, data)
+		case ids.CBAddResourcePack:
+			buf := new(bytes.Buffer)
+			if version >= mcversion.ResourcePackUUID {
+				if len(data) < 16 {
+					return errors.New("short resource pack request")
+				}
+				buf.Write(data[:16]) // Pack UUID
+			}
+			WriteVarInt(buf, 1) // Declined
+			err = WriteCompressedPacket(conn, compressionThreshold, ids.SBResourcePackResp, buf.Bytes())
+		case ids.CBCookieRequest:
+			key, rerr := ReadString(bytes.NewReader(data))
+			if rerr != nil {
+				return rerr
+			}
+			buf := new(bytes.Buffer)
+			WriteString(buf, key)
+			WriteBool(buf, false) // No cookie stored
+			err = WriteCompressedPacket(conn, compressionThreshold, ids.SBCookieResponse, buf.Bytes())
+		case ids.CBCodeOfConduct:
+			err = WriteCompressedPacket(conn, compressionThreshold, ids.SBAcceptConduct, nil)
+		}
+		// Registry data, tags, feature flags etc. need no answer
 		if err != nil {
-			conn.Close()
-			return nil, err
+			return err
 		}
-		packetsToRead--
 	}
-	conn.SetReadDeadline(time.Time{})
+}
 
-	buf.Reset()
+// clientInformation is the body of the Client Settings packet. 1.21.2
+// (protocol 768) appended the particle setting.
+func clientInformation(version int) []byte {
+	buf := new(bytes.Buffer)
 	WriteString(buf, "en_US")
 	WriteByte(buf, 8)
 	WriteVarInt(buf, 0)
@@ -127,114 +536,157 @@ func connectToServer() (*yamux.Session, error) {
 	WriteVarInt(buf, 1)
 	WriteBool(buf, false)
 	WriteBool(buf, true)
-	WritePacket(conn, PID_SB_ClientSettings, buf.Bytes())
-
-	key := sha256.Sum256([]byte(cfg.Password))
-	block, _ := aes.NewCipher(key[:])
-	aead, _ := cipher.NewGCM(block)
-
-	pr, pw := io.Pipe()
-	mc := &MinecraftConn{
-		conn:      conn,
-		r:         pr,
-		w:         pw,
-		aead:      aead,
-		rawReader: reader,
-		writeBuf:  bytes.NewBuffer(make([]byte, 0, 16384)),
-	}
-
-	go startBackgroundNoise(conn)
-	go startReaderLoop(mc, pw, conn, aead)
-
-	conf := yamux.DefaultConfig()
-	conf.KeepAliveInterval = 30 * time.Second
-	conf.ConnectionWriteTimeout = 15 * time.Second
-	conf.MaxStreamWindowSize = 512 * 1024 // 512KB (Optimized)
-	conf.StreamOpenTimeout = 30 * time.Second
-	conf.LogOutput = io.Discard
-	return yamux.Client(mc, conf)
-}
-
-func startBackgroundNoise(conn net.Conn) {
-	posTicker := time.NewTicker(1 * time.Second)
-	// kaTicker removed
-	defer posTicker.Stop()
-	posX, posY, posZ := 100.5, 64.0, 100.5
+	if version >= 768 {
+		WriteVarInt(buf, 0) // Particles: all
+	}
+	return buf.Bytes()
+}
+
+// readRawPacket reads one packet and splits off its ID. A non-negative
+// compressionThreshold means the packet uses the compressed framing.
+func readRawPacket(r *bufio.Reader, compressionThreshold int) (int, []byte, error) {
+	body, err := readPacketBody(r, MaxPacketLength)
+	if err != nil {
+		return 0, nil, err
+	}
+	if compressionThreshold >= 0 {
+		if body, err = decompressPacket(body); err != nil {
+			return 0, nil, err
+		}
+	}
+	br := bytes.NewReader(body)
+	pid, err := ReadVarInt(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if pid < 0 {
+		return 0, nil, fmt.Errorf("negative packet ID %d", pid)
+	}
+	return pid, body[len(body)-br.Len():], nil
+}
+
+func startBackgroundNoise(ctx context.Context, conn net.Conn, compressionThreshold int) {
+	w := newIdleWalker()
+	timer := time.NewTimer(noiseInterval())
+	defer timer.Stop()
 	for {
 		select {
-		case <-posTicker.C:
-			serverLock.Lock()
-			running := isRunning
-			serverLock.Unlock()
-			if !running {
-				return
-			}
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
 
-			jitter := (float64(time.Now().UnixNano()%100) / 5000.0)
-			b := new(bytes.Buffer)
-			WriteDouble(b, posX+jitter)
-			WriteDouble(b, posY)
-			WriteDouble(b, posZ+jitter)
-			WriteBool(b, true)
-			WritePacket(conn, PID_SB_PlayerPos, b.Bytes())
-			// Removed redundant kaTicker logic here
+		pid, data := w.next()
+		if err := WriteCompressedPacket(conn, compressionThreshold, pid, data); err != nil {
+			return // Connection is gone; a reconnect starts a new noise loop
 		}
+		timer.Reset(noiseInterval())
+	}
+}
+
+// noiseInterval is the random gap between cover packets, 0.5-3s, so they
+// don't tick like a metronome.
+func noiseInterval() time.Duration {
+	return 500*time.Millisecond + mrand.N(2500*time.Millisecond)
+}
+
+// idleWalker imitates an idle player: mostly standing, now and then looking
+// around or wandering a few blocks along a slowly turning heading.
+type idleWalker struct {
+	x, y, z    float64
+	yaw, pitch float32
+	heading    float64 // Radians
+	walking    int     // Steps left in the current walk
+}
+
+func newIdleWalker() *idleWalker {
+	return &idleWalker{
+		x:       100.5 + mrand.Float64()*8 - 4,
+		y:       64,
+		z:       100.5 + mrand.Float64()*8 - 4,
+		yaw:     mrand.Float32() * 360,
+		heading: mrand.Float64() * 2 * math.Pi,
+	}
+}
+
+// next returns the next packet to send: a rotation now and then, otherwise
+// the current position.
+func (w *idleWalker) next() (int, []byte) {
+	b := new(bytes.Buffer)
+
+	if w.walking == 0 && mrand.IntN(4) == 0 {
+		w.yaw = float32(math.Mod(float64(w.yaw)+mrand.NormFloat64()*40+360, 360))
+		w.pitch = float32(max(-60, min(60, float64(w.pitch)+mrand.NormFloat64()*10)))
+		WriteFloat(b, w.yaw)
+		WriteFloat(b, w.pitch)
+		WriteBool(b, true)
+		return PID_SB_PlayerRot, b.Bytes()
 	}
+
+	if w.walking == 0 && mrand.IntN(8) == 0 {
+		w.walking = 2 + mrand.IntN(5)
+	}
+	if w.walking > 0 {
+		w.walking--
+		w.heading += mrand.NormFloat64() * 0.4
+		// Walking speed is ~4.3 blocks/s; a step covers part of a second
+		step := 1 + mrand.Float64()*2
+		w.x += math.Cos(w.heading) * step
+		w.z += math.Sin(w.heading) * step
+	}
+	WriteDouble(b, w.x)
+	WriteDouble(b, w.y)
+	WriteDouble(b, w.z)
+	WriteBool(b, true)
+	return PID_SB_PlayerPos, b.Bytes()
 }
 
 func startReaderLoop(mc *MinecraftConn, pw *io.PipeWriter, conn net.Conn, aead cipher.AEAD) {
+	// A panic on a malformed packet must not take the process down. The
+	// closes below still run, which ends the yamux session, so
+	// maintainSession reconnects.
+	defer func() {
+		if r := recover(); r != nil {
+			logError("Recovered in startReaderLoop: %v", r)
+			select {
+			case sessionWake <- struct{}{}:
+			default:
+			}
+		}
+	}()
 	defer pw.Close()
 	defer conn.Close()
-	var r io.ByteReader
-	if br, ok := mc.rawReader.(io.ByteReader); ok {
+	var r packetReader
+	if br, ok := mc.rawReader.(packetReader); ok {
 		r = br
 	} else {
 		r = bufio.NewReader(mc.rawReader)
 	}
 
 	for {
-		l, err := ReadVarInt(r)
+		data, err := readPacketBody(r, MaxPacketLength)
 		if err != nil {
 			return
 		}
-		if l < 0 || l > 2097152 {
-			return
-		}
-
-		data := make([]byte, l)
-		_, err = io.ReadFull(mc.rawReader, data)
-		if err != nil {
-			return
+		beat()
+		if mc.compressionThreshold >= 0 {
+			if data, err = decompressPacket(data); err != nil {
+				continue // The outer length still framed it; skip just this one
+			}
 		}
 
 		pBuf := bytes.NewBuffer(data)
 		pid, _ := ReadVarInt(pBuf)
 
 		if pid == PID_CB_ChunkData {
-			if pBuf.Len() < 8 {
-				continue
-			}
-			pBuf.Next(8)
-
-			if err := skipNBT(pBuf); err != nil {
-				continue
-			}
-
-			payloadSize, err := ReadVarInt(pBuf)
-			if err != nil {
-				continue
-			}
-			if pBuf.Len() < payloadSize {
-				continue
-			}
-
-			enc := pBuf.Next(payloadSize)
-			if len(enc) < aead.NonceSize() {
+			enc, ok := chunkPayload(pBuf)
+			if !ok || len(enc) < aead.NonceSize() {
 				continue
 			}
 			nonce := enc[:aead.NonceSize()]
 			pt, err := aead.Open(nil, nonce, enc[aead.NonceSize():], nil)
 			if err == nil {
+				mc.lastRead.Store(time.Now().UnixNano())
 				pw.Write(pt)
 			}
 
@@ -247,12 +699,41 @@ func startReaderLoop(mc *MinecraftConn, pw *io.PipeWriter, conn net.Conn, aead c
 				// This is optimal event-driven behavior.
 				b := new(bytes.Buffer)
 				WriteLong(b, kId)
-				WritePacket(conn, PID_SB_KeepAlive, b.Bytes())
+				WriteCompressedPacket(conn, mc.compressionThreshold, PID_SB_KeepAlive, b.Bytes())
 			}
 		}
 	}
 }
 
+// chunkPayload returns the sealed tunnel data in the body of a Chunk Data
+// packet (after the ID): chunk X and Z, the heightmaps NBT, then the data
+// with a VarInt length. false means the packet doesn't carry any.
+func chunkPayload(pBuf *bytes.Buffer) ([]byte, bool) {
+	if pBuf.Len() < 8 {
+		return nil, false
+	}
+	pBuf.Next(8)
+
+	if err := skipNBT(pBuf); err != nil {
+		return nil, false
+	}
+
+	payloadSize, err := ReadVarInt(pBuf)
+	// VarInts are signed; Next panics on a negative count
+	if err != nil || payloadSize < 0 || pBuf.Len() < payloadSize {
+		return nil, false
+	}
+	return pBuf.Next(payloadSize), true
+}
+
+// maxNBTDepth is the nesting limit the vanilla client enforces
+const maxNBTDepth = 512
+
+var errNBTTruncated = errors.New("truncated NBT")
+
+// skipNBT and skipNBTPayload move r past one NBT tag. Every read is bounds
+// checked, so a truncated or hostile packet gives an error instead of a
+// panic that would take the reader loop down.
 func skipNBT(r *bytes.Buffer) error {
 	tagType, err := r.ReadByte()
 	if err != nil {
@@ -261,57 +742,115 @@ func skipNBT(r *bytes.Buffer) error {
 	if tagType == 0 {
 		return nil
 	}
-	nameLen := int(binary.BigEndian.Uint16(r.Next(2)))
-	r.Next(nameLen)
-	return skipNBTPayload(r, tagType)
+	if err := skipNBTString(r); err != nil {
+		return err
+	}
+	return skipNBTPayload(r, tagType, 0)
 }
 
-func skipNBTPayload(r *bytes.Buffer, tagType byte) error {
+func skipNBTPayload(r *bytes.Buffer, tagType byte, depth int) error {
+	if depth > maxNBTDepth {
+		return errors.New("NBT nested too deeply")
+	}
 	switch tagType {
 	case 1:
-		r.Next(1)
+		return nbtSkip(r, 1)
 	case 2:
-		r.Next(2)
-	case 3:
-		r.Next(4)
-	case 4:
-		r.Next(8)
-	case 5:
-		r.Next(4)
-	case 6:
-		r.Next(8)
+		return nbtSkip(r, 2)
+	case 3, 5:
+		return nbtSkip(r, 4)
+	case 4, 6:
+		return nbtSkip(r, 8)
 	case 7:
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
-		r.Next(l)
+		l, err := nbtArrayLen(r, 1)
+		if err != nil {
+			return err
+		}
+		return nbtSkip(r, l)
 	case 8:
-		l := int(uint16(binary.BigEndian.Uint16(r.Next(2))))
-		r.Next(l)
+		return skipNBTString(r)
 	case 9:
-		subType, _ := r.ReadByte()
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
+		subType, err := r.ReadByte()
+		if err != nil {
+			return errNBTTruncated
+		}
+		// Every element takes at least a byte, which also bounds the loop
+		l, err := nbtArrayLen(r, 1)
+		if err != nil {
+			return err
+		}
+		if subType == 0 && l > 0 {
+			return errors.New("NBT list of end tags")
+		}
 		for i := 0; i < l; i++ {
-			skipNBTPayload(r, subType)
+			if err := skipNBTPayload(r, subType, depth+1); err != nil {
+				return err
+			}
 		}
+		return nil
 	case 10:
 		for {
-			subType, _ := r.ReadByte()
+			subType, err := r.ReadByte()
+			if err != nil {
+				return errNBTTruncated
+			}
 			if subType == 0 {
-				break
+				return nil
+			}
+			if err := skipNBTString(r); err != nil {
+				return err
+			}
+			if err := skipNBTPayload(r, subType, depth+1); err != nil {
+				return err
 			}
-			nLen := int(binary.BigEndian.Uint16(r.Next(2)))
-			r.Next(nLen)
-			skipNBTPayload(r, subType)
 		}
 	case 11:
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
-		r.Next(l * 4)
+		l, err := nbtArrayLen(r, 4)
+		if err != nil {
+			return err
+		}
+		return nbtSkip(r, l*4)
 	case 12:
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
-		r.Next(l * 8)
+		l, err := nbtArrayLen(r, 8)
+		if err != nil {
+			return err
+		}
+		return nbtSkip(r, l*8)
 	}
+	return fmt.Errorf("unknown NBT tag type %d", tagType)
+}
+
+// nbtSkip discards n bytes of r, failing if it holds fewer
+func nbtSkip(r *bytes.Buffer, n int) error {
+	if n < 0 || n > r.Len() {
+		return errNBTTruncated
+	}
+	r.Next(n)
 	return nil
 }
 
+// nbtArrayLen reads an array or list length and checks that r can still
+// hold that many elements of elemSize bytes
+func nbtArrayLen(r *bytes.Buffer, elemSize int) (int, error) {
+	if r.Len() < 4 {
+		return 0, errNBTTruncated
+	}
+	l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
+	if l < 0 || l > r.Len()/elemSize {
+		return 0, errNBTTruncated
+	}
+	return l, nil
+}
+
+// skipNBTString skips a tag name or string payload: a uint16 length and
+// that many bytes
+func skipNBTString(r *bytes.Buffer) error {
+	if r.Len() < 2 {
+		return errNBTTruncated
+	}
+	return nbtSkip(r, int(binary.BigEndian.Uint16(r.Next(2))))
+}
+
 type MinecraftConn struct {
 	conn      net.Conn
 	r         *io.PipeReader
@@ -322,10 +861,26 @@ type MinecraftConn struct {
 	writeBuf   *bytes.Buffer
 	writeMu    sync.Mutex
 	flushTimer *time.Timer
+	// Write flushes once flushThreshold bytes are buffered, and otherwise
+	// after flushDelay, or right away if that is 0. Both are fixed at
+	// creation.
+	flushThreshold int
+	flushDelay     time.Duration
+
+	// compressionThreshold is the negotiated Set Compression threshold,
+	// negative when packets aren't compressed
+	compressionThreshold int
+
+	// lastRead is when the reader loop last got tunnel data, in Unix
+	// nanoseconds. The cover server's own packets don't count, so a server
+	// that stopped handling our plugin messages shows up as silence.
+	lastRead atomic.Int64
 }
 
 func (mc *MinecraftConn) Read(b []byte) (int, error) { return mc.r.Read(b) }
 
+func (mc *MinecraftConn) lastReadAt() int64 { return mc.lastRead.Load() }
+
 func (mc *MinecraftConn) flushLocked() error {
 	if mc.flushTimer != nil {
 		mc.flushTimer.Stop()
@@ -344,7 +899,7 @@ func (mc *MinecraftConn) flushLocked() error {
 	WriteString(buf, "minecraft:brand")
 	buf.Write(encrypted)
 
-	err := WritePacket(mc.conn, PID_SB_PluginMsg, buf.Bytes())
+	err := WriteCompressedPacket(mc.conn, mc.compressionThreshold, PID_SB_PluginMsg, buf.Bytes())
 
 	mc.writeBuf.Reset()
 	return err
@@ -359,15 +914,14 @@ func (mc *MinecraftConn) Write(b []byte) (int, error) {
 		return 0, err
 	}
 
-	// 4KB threshold for immediate flush
-	if mc.writeBuf.Len() >= 4096 {
+	if mc.writeBuf.Len() >= mc.flushThreshold || mc.flushDelay <= 0 {
 		if err := mc.flushLocked(); err != nil {
 			return n, err
 		}
 	} else {
 		// Delayed flush for small packets
 		if mc.flushTimer == nil {
-			mc.flushTimer = time.AfterFunc(5*time.Millisecond, func() {
+			mc.flushTimer = time.AfterFunc(mc.flushDelay, func() {
 				mc.writeMu.Lock()
 				defer mc.writeMu.Unlock()
 				mc.flushLocked()
@@ -377,8 +931,18 @@ func (mc *MinecraftConn) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// closeFlushTimeout bounds the final flush in Close on a dead connection
+const closeFlushTimeout = time.Second
+
+// Close flushes whatever is still waiting on the flush timer, best-effort
+// and bounded by closeFlushTimeout, so the tail of a short exchange that
+// never filled the buffer isn't dropped.
 func (mc *MinecraftConn) Close() error {
 	mc.writeMu.Lock()
+	if mc.writeBuf.Len() > 0 {
+		mc.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		mc.flushLocked()
+	}
 	if mc.flushTimer != nil {
 		mc.flushTimer.Stop()
 	}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"minewire/serverdial"
+)
+
+const (
+	// wsMaxChunk is the most plaintext sealed into one WebSocket message
+	wsMaxChunk = 16 * 1024
+	// wsMaxMessage bounds a received message, so a broken or hostile peer
+	// can't make us buffer an arbitrary amount
+	wsMaxMessage = 1 << 20
+	// wsHandshakeTimeout bounds the HTTP upgrade
+	wsHandshakeTimeout = 15 * time.Second
+	// wsDefaultPath is requested when WebSocketURL is unset
+	wsDefaultPath = "/minecraft"
+)
+
+var errWSShortMessage = errors.New("websocket message shorter than a nonce")
+
+// websocketTransport carries the tunnel in binary WebSocket messages over
+// HTTPS, for networks that block Minecraft's port but let web traffic
+// through, CDNs and corporate proxies included. Each message is one
+// AES-GCM sealed chunk, nonce followed by ciphertext, with the same key as
+// the Minecraft disguise. The server (or whatever the URL reaches) must
+// speak it.
+type websocketTransport struct {
+	ctx  context.Context
+	conf config
+	addr string
+}
+
+// url is the endpoint to connect to: WebSocketURL, or the server address
+// over wss at wsDefaultPath.
+func (t *websocketTransport) url() (*url.URL, error) {
+	raw := t.conf.WebSocketURL
+	if raw == "" {
+		raw = "wss://" + t.addr + wsDefaultPath
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("websocket URL %q: scheme must be ws or wss", raw)
+	}
+	return u, nil
+}
+
+func (t *websocketTransport) Dial() (net.Conn, error) {
+	ctx, conf := t.ctx, t.conf
+	u, err := t.url()
+	if err != nil {
+		return nil, err
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "ws" {
+			port = "80"
+		}
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := serverdial.Dial(ctx, hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+	if u.Scheme == "wss" {
+		if conn, err = serverdial.WrapTLS(ctx, conn, hostPort, conf.TLSServerName); err != nil {
+			return nil, err
+		}
+	}
+
+	wsConf := &websocket.Config{
+		Location: u,
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   http.Header{},
+	}
+	for k, v := range conf.WebSocketHeaders {
+		wsConf.Header.Set(k, v)
+	}
+	// The handshake always sends an Origin; a page served by the same host
+	// is what a browser would show, unless the headers name another
+	if wsConf.Origin, err = wsOrigin(u, wsConf.Header.Get("Origin")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	wsConf.Header.Del("Origin")
+
+	conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() }) // Don't make Stop wait
+	ws, err := websocket.NewClient(wsConf, conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = wsMaxMessage
+
+	key := sha256.Sum256([]byte(conf.Password))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &wsConn{Conn: ws, aead: aead}, nil
+}
+
+func wsOrigin(u *url.URL, origin string) (*url.URL, error) {
+	if origin != "" {
+		return url.Parse(origin)
+	}
+	scheme := "https"
+	if u.Scheme == "ws" {
+		scheme = "http"
+	}
+	return &url.URL{Scheme: scheme, Host: u.Host}, nil
+}
+
+// wsConn is the tunnel side of a WebSocket connection: Write seals data
+// into messages, Read opens them.
+type wsConn struct {
+	*websocket.Conn // Deadlines, addresses and Close
+	aead            cipher.AEAD
+
+	writeMu sync.Mutex
+
+	pending  []byte       // Opened but not yet read; only touched by Read
+	lastRead atomic.Int64 // Unix nanoseconds of the last message opened
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+			return 0, err
+		}
+		ns := c.aead.NonceSize()
+		if len(msg) < ns {
+			return 0, errWSShortMessage
+		}
+		pt, err := c.aead.Open(msg[ns:ns], msg[:ns], msg[ns:], nil)
+		if err != nil {
+			// Same key on both ends or nothing works; don't limp along
+			return 0, fmt.Errorf("decrypt websocket message: %w", err)
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		c.pending = pt
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(written+wsMaxChunk, len(b))]
+		nonce := make([]byte, c.aead.NonceSize())
+		rand.Read(nonce)
+		if err := websocket.Message.Send(c.Conn, c.aead.Seal(nonce, nonce, chunk, nil)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (c *wsConn) lastReadAt() int64 { return c.lastRead.Load() }
@@ -0,0 +1,71 @@
+package minewire
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// Tunnel settings beyond the original ones (AES-GCM, unsalted key) are
+// announced in the player UUID of Login Start. A real client puts its
+// account's UUID there, 16 random-looking bytes, so unlike a readable tag
+// it doesn't set the connection apart. Bytes 0-14 are random apart from the
+// UUID version and variant bits; byte 15 holds the setting bits, masked
+// with a keyed hash of the password over bytes 0-14 so it reads as random
+// to anyone without the password. A server that reads the bits refuses a
+// login asking for a setting it lacks; one that predates the scheme ignores
+// the UUID and keeps the original settings.
+const (
+	settingChaCha20     byte = 1 << iota // Cipher is chacha20-poly1305
+	settingPBKDF2                        // KeyDerivation is 2
+	settingSingleStream                  // DisableMultiplexing, no yamux
+)
+
+// loginUUID is the player UUID sent in Login Start
+type loginUUID [16]byte
+
+// newLoginUUID returns a fresh UUID announcing the settings of o
+func newLoginUUID(o Options, password string) (loginUUID, error) {
+	var u loginUUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return u, err
+	}
+	u[6] = u[6]&0x0f | 0x40 // Version 4, like an online-mode account's
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	u[15] = o.settingBits() ^ settingsMask(password, u)
+	return u, nil
+}
+
+// salt returns the key derivation salt for the settings of o: the whole
+// UUID with PBKDF2, nil for the legacy key
+func (u loginUUID) salt(o Options) []byte {
+	if o.kdfVersion() != kdfPBKDF2 {
+		return nil
+	}
+	return u[:]
+}
+
+// settings returns the setting bits u announces, as the server reads them
+func (u loginUUID) settings(password string) byte {
+	return u[15] ^ settingsMask(password, u)
+}
+
+func settingsMask(password string, u loginUUID) byte {
+	m := hmac.New(sha256.New, []byte(password))
+	m.Write(u[:15])
+	return m.Sum(nil)[0]
+}
+
+func (o Options) settingBits() byte {
+	var bits byte
+	if o.cipherName() == cipherChaCha20 {
+		bits |= settingChaCha20
+	}
+	if o.kdfVersion() == kdfPBKDF2 {
+		bits |= settingPBKDF2
+	}
+	if o.DisableMultiplexing {
+		bits |= settingSingleStream
+	}
+	return bits
+}
@@ -0,0 +1,143 @@
+package minewire
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/yl2chen/cidranger"
+)
+
+// Blocklist rejects destinations outright (content control). It is a separate
+// policy from split tunneling: blocked destinations are neither tunneled nor
+// dialed directly.
+type Blocklist struct {
+	ranger  cidranger.Ranger
+	domains map[string]struct{}
+	mu      sync.RWMutex
+}
+
+var (
+	blManager *Blocklist
+	blOnce    sync.Once
+)
+
+// GetBlocklist returns the singleton instance
+func GetBlocklist() *Blocklist {
+	blOnce.Do(func() {
+		blManager = &Blocklist{
+			ranger:  cidranger.NewPCTrieRanger(),
+			domains: make(map[string]struct{}),
+		}
+	})
+	return blManager
+}
+
+// UpdateBlocklist replaces the blocklist with the rules from the given
+// comma separated files. Each line is a CIDR, a single IP or a domain name;
+// a domain also blocks all of its subdomains.
+func UpdateBlocklist(rulePaths string) {
+	ranger := cidranger.NewPCTrieRanger()
+	domains := make(map[string]struct{})
+
+	for _, path := range strings.Split(rulePaths, ",") {
+		if path == "" {
+			continue
+		}
+		if err := loadBlocklistFile(path, ranger, domains); err != nil {
+			logWarn("Failed to load blocklist %s: %v", path, err)
+		} else {
+			logInfo("Loaded blocklist: %s", path)
+		}
+	}
+
+	bl := GetBlocklist()
+	bl.mu.Lock()
+	bl.ranger = ranger
+	bl.domains = domains
+	bl.mu.Unlock()
+}
+
+func loadBlocklistFile(path string, ranger cidranger.Ranger, domains map[string]struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if network, ok := parseRule(line); ok {
+			ranger.Insert(cidranger.NewBasicRangerEntry(*network))
+			continue
+		}
+		domains[normalizeDomain(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// IsBlocked reports whether host (an IP literal or a domain) is blocked. A
+// domain is also blocked when it resolves to a blocked range; like split
+// tunneling's bypassAddr it goes through the DNS cache, so the check and the
+// dial see the same addresses.
+func (b *Blocklist) IsBlocked(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return b.containsIP(ip)
+	}
+
+	b.mu.RLock()
+	blocked := b.domainBlocked(host)
+	noRanges := b.ranger.Len() == 0
+	b.mu.RUnlock()
+	// With no ranges loaded nothing else can match; don't do a lookup for nothing
+	if blocked || noRanges {
+		return blocked
+	}
+
+	ips, err := resolveHost(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if b.containsIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Blocklist) containsIP(ip net.IP) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	contains, err := b.ranger.Contains(ip)
+	return err == nil && contains
+}
+
+// domainBlocked matches host and every parent domain against the blocked
+// domains. Caller holds mu.
+func (b *Blocklist) domainBlocked(host string) bool {
+	if len(b.domains) == 0 {
+		return false
+	}
+	d := normalizeDomain(host)
+	for {
+		if _, ok := b.domains[d]; ok {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			return false
+		}
+		d = d[i+1:]
+	}
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(d), ".")
+}
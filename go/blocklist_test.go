@@ -0,0 +1,46 @@
+package minewire
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.txt")
+	rules := "# content control\n10.0.0.0/8\n192.0.2.1\n2001:db8::1\nBlocked.Example.\nnot a rule line\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	UpdateBlocklist(path)
+	t.Cleanup(func() { UpdateBlocklist("") })
+
+	// Names resolve through the cache, so no lookup leaves the test
+	dnsCache.Put("cdn.test", []net.IP{net.ParseIP("10.1.2.3")}, time.Minute, 16)
+	dnsCache.Put("clean.test", []net.IP{net.ParseIP("198.51.100.1")}, time.Minute, 16)
+	t.Cleanup(ClearDNSCache)
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"10.200.0.1", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"blocked.example", true},
+		{"www.blocked.example", true},
+		{"notblocked.example", false},
+		{"cdn.test", true},
+		{"clean.test", false},
+	}
+	bl := GetBlocklist()
+	for _, tt := range tests {
+		if got := bl.IsBlocked(tt.host); got != tt.want {
+			t.Errorf("IsBlocked(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"minewire"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -17,28 +22,71 @@ type Command struct {
 
 type CommandArgs struct {
 	LocalPort     string `json:"localPort"`
+	LocalAddress  string `json:"localAddress"` // Listen IP, default 127.0.0.1
 	ServerAddress string `json:"serverAddress"`
 	Password      string `json:"password"`
 	ProxyType     string `json:"proxyType"`
-	Link          string `json:"link"` // for parseLink
+	SocksUser     string `json:"socksUser"`
+	SocksPass     string `json:"socksPass"`
+	Link          string `json:"link"`        // for parseLink
+	Name          string `json:"name"`        // for buildLink
+	ProxyBypass   string `json:"proxyBypass"` // ProxyOverride list, ";" separated; empty for the LAN default
+
+	ProtocolVersion int `json:"protocolVersion"` // Minecraft protocol for the handshake; 0 for the default
+	Count           int `json:"count"`           // for pingN: number of probes
+
+	// KillSwitch refuses connections while the tunnel is down and keeps the
+	// system proxy set if the UI exits without a stop, so nothing leaks
+	KillSwitch bool `json:"killSwitch"`
+
+	// WriteTimeoutMs is how long a tunnel write or keepalive may stall; 0 for 15s
+	WriteTimeoutMs int64 `json:"writeTimeoutMs"`
+
+	// FlushThreshold and FlushDelayMs tune write batching; a negative
+	// FlushDelayMs sends every write immediately
+	FlushThreshold int   `json:"flushThreshold"`
+	FlushDelayMs   int64 `json:"flushDelayMs"`
+
+	StreamWindowSize int `json:"streamWindowSize"` // Per-stream yamux window in bytes; 0 for 512KB
+
+	// UseTLS wraps the server connection in TLS; the server must support it.
+	// TLSServerName is the SNI, empty for the server's host.
+	UseTLS        bool   `json:"useTls"`
+	TLSServerName string `json:"tlsServerName"`
+
+	SpoofHost string `json:"spoofHost"` // Host advertised in the handshake; empty for the dialed host
+	Transport string `json:"transport"` // Tunnel disguise; empty for "minecraft"
+
+	// WebSocketURL and WebSocketHeaders configure the "websocket" transport
+	WebSocketURL     string            `json:"webSocketUrl"`
+	WebSocketHeaders map[string]string `json:"webSocketHeaders"`
 }
 
 type Response struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
+	Warning string `json:"warning,omitempty"`
 	Data    any    `json:"data,omitempty"`
 }
 
+// keepProxyOnExit is set while a kill switch session runs
+var keepProxyOnExit atomic.Bool
+
 func main() {
 	// Clean up on exit
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		unsetSystemProxy()
+		if !keepProxyOnExit.Load() {
+			unsetSystemProxy()
+		}
 		os.Exit(0)
 	}()
 
+	minewire.SetStateCallback(stateEvents{})
+	minewire.SetControlCallback(stateEvents{})
+
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -50,26 +98,84 @@ func main() {
 
 		handleCommand(cmd)
 	}
+
+	// stdin closed: the UI process is gone, so don't leave the tunnel running
+	// or the system proxy pointing at a dead port, unless the kill switch
+	// wants traffic to fail rather than go out directly.
+	minewire.Stop()
+	if !keepProxyOnExit.Load() {
+		unsetSystemProxy()
+	}
 }
 
 func handleCommand(cmd Command) {
 	switch cmd.Method {
 	case "start":
-		msg := minewire.Start(cmd.Args.LocalPort, cmd.Args.ServerAddress, cmd.Args.Password, cmd.Args.ProxyType)
+		proxyType := minewire.NormalizeProxyType(cmd.Args.ProxyType)
+		opts, _ := json.Marshal(map[string]any{
+			"protocolVersion":  cmd.Args.ProtocolVersion,
+			"killSwitch":       cmd.Args.KillSwitch,
+			"writeTimeoutMs":   cmd.Args.WriteTimeoutMs,
+			"flushThreshold":   cmd.Args.FlushThreshold,
+			"flushDelayMs":     cmd.Args.FlushDelayMs,
+			"streamWindowSize": cmd.Args.StreamWindowSize,
+			"useTls":           cmd.Args.UseTLS,
+			"tlsServerName":    cmd.Args.TLSServerName,
+			"spoofHost":        cmd.Args.SpoofHost,
+			"transport":        cmd.Args.Transport,
+			"webSocketUrl":     cmd.Args.WebSocketURL,
+			"webSocketHeaders": cmd.Args.WebSocketHeaders,
+		})
+		if msg := minewire.SetOptions(string(opts)); msg != "" {
+			respond(Response{Success: false, Error: msg})
+			return
+		}
+		msg := minewire.Start(cmd.Args.LocalPort, cmd.Args.LocalAddress, cmd.Args.ServerAddress, cmd.Args.Password, proxyType, cmd.Args.SocksUser, cmd.Args.SocksPass)
 		if msg != "" {
 			respond(Response{Success: false, Error: msg})
 			return
 		}
+		// Wait for the listener so we can report (and proxy to) the real port
+		if msg := minewire.WaitForProxy(5000); msg != "" {
+			minewire.Stop()
+			respond(Response{Success: false, Error: "Local proxy failed: " + msg})
+			return
+		}
+		var ports map[string]int
+		json.Unmarshal([]byte(minewire.GetListenPorts()), &ports)
+		port := ports["socksPort"]
+		if proxyType == "http" {
+			port = ports["httpPort"]
+		}
+
 		// Set System Proxy
-		err := setSystemProxy("127.0.0.1"+cmd.Args.LocalPort, cmd.Args.ProxyType)
+		// Point the system proxy at the address Start bound to
+		host := cmd.Args.LocalAddress
+		if host == "" {
+			// Start accepted the port, so it normalizes cleanly
+			listenAddr, _ := minewire.NormalizeLocalPort(cmd.Args.LocalPort)
+			host, _, _ = net.SplitHostPort(listenAddr)
+		}
+		host = strings.Trim(host, "[]")
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		previous, err := setSystemProxy(net.JoinHostPort(host, strconv.Itoa(port)), proxyType, cmd.Args.ProxyBypass)
 		if err != nil {
 			minewire.Stop()
+			unsetSystemProxy()
 			respond(Response{Success: false, Error: "Failed to set system proxy: " + err.Error()})
 			return
 		}
-		respond(Response{Success: true})
+		var warning string
+		if previous != "" {
+			warning = "Replaced existing system proxy " + previous + "; it will be restored on stop"
+		}
+		keepProxyOnExit.Store(cmd.Args.KillSwitch)
+		respond(Response{Success: true, Warning: warning, Data: ports})
 
 	case "stop":
+		keepProxyOnExit.Store(false)
 		minewire.Stop()
 		unsetSystemProxy()
 		respond(Response{Success: true})
@@ -78,10 +184,45 @@ func handleCommand(cmd Command) {
 		running := minewire.IsRunning()
 		respond(Response{Success: true, Data: running})
 
+	case "connectionState":
+		respond(Response{Success: true, Data: minewire.GetConnectionState()})
+
 	case "ping":
 		latency := minewire.Ping(cmd.Args.ServerAddress)
 		respond(Response{Success: true, Data: latency})
 
+	case "pingN":
+		respond(Response{Success: true, Data: minewire.PingN(cmd.Args.ServerAddress, cmd.Args.Count)})
+
+	case "pingApplication":
+		latency := minewire.PingApplication(cmd.Args.ServerAddress)
+		respond(Response{Success: true, Data: latency})
+
+	case "tunnelHealthCheck":
+		respond(Response{Success: true, Data: minewire.TunnelHealthCheck()})
+
+	case "pingDetailed":
+		var res map[string]any
+		json.Unmarshal([]byte(minewire.PingDetailed(cmd.Args.ServerAddress)), &res)
+		respond(Response{Success: true, Data: res})
+
+	case "reconnect":
+		if msg := minewire.Reconnect(); msg != "" {
+			respond(Response{Success: false, Error: msg})
+		} else {
+			respond(Response{Success: true})
+		}
+
+	case "stats":
+		respond(Response{Success: true, Data: minewire.GetStats()})
+
+	case "resetStats":
+		minewire.ResetStats()
+		respond(Response{Success: true})
+
+	case "heartbeat":
+		respond(Response{Success: true, Data: minewire.Heartbeat()})
+
 	case "parseLink":
 		// minewire.ParseConnectionLink returns a JSON string, so we need to decode it back
 		// to embed it properly in our Data field, OR just return it as a string.
@@ -91,12 +232,53 @@ func handleCommand(cmd Command) {
 		json.Unmarshal([]byte(jsonStr), &parsed)
 		respond(Response{Success: true, Data: parsed})
 
+	case "buildLink":
+		link := minewire.BuildConnectionLink(cmd.Args.Name, cmd.Args.ServerAddress, cmd.Args.Password)
+		if link == "" {
+			respond(Response{Success: false, Error: "Invalid server address"})
+		} else {
+			respond(Response{Success: true, Data: link})
+		}
+
 	default:
 		respond(Response{Success: false, Error: "Unknown method"})
 	}
 }
 
+// Event is an unsolicited stdout line. It has an "event" field where command
+// responses have "success", so the UI can tell the two apart.
+type Event struct {
+	Event   string `json:"event"`
+	Data    any    `json:"data,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// stdoutMu keeps responses and events from interleaving mid-line
+var stdoutMu sync.Mutex
+
 func respond(res Response) {
-	b, _ := json.Marshal(res)
+	writeLine(res)
+}
+
+func emit(ev Event) {
+	writeLine(ev)
+}
+
+func writeLine(v any) {
+	b, _ := json.Marshal(v)
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
 	fmt.Println(string(b))
 }
+
+// stateEvents forwards core state changes as {"event": "stateChange"} and
+// server-pushed control messages as {"event": "control"}
+type stateEvents struct{}
+
+func (stateEvents) OnStateChange(state, message string) {
+	emit(Event{Event: "stateChange", Data: state, Message: message})
+}
+
+func (stateEvents) OnControlMessage(msgType, messageJSON string) {
+	emit(Event{Event: "control", Data: json.RawMessage(messageJSON)})
+}
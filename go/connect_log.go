@@ -0,0 +1,76 @@
+package minewire
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// connectAttempt is one run of connectToServer
+type connectAttempt struct {
+	Time       int64  `json:"time"` // Unix milliseconds
+	Endpoint   string `json:"endpoint"`
+	DurationMs int64  `json:"durationMs"`
+	OK         bool   `json:"ok"`
+	Stage      string `json:"stage"` // Last step reached: dial, handshake, login, ..., session
+	Error      string `json:"error,omitempty"`
+}
+
+// connectLog keeps the most recent connection attempts, oldest first, so a
+// pattern of failures (always at login, intermittent dials) can be seen.
+type connectLog struct {
+	mu       sync.Mutex
+	attempts []connectAttempt
+	size     int
+}
+
+// clientConnectLog is the log of the tunnel Start runs; see GetConnectLog
+var clientConnectLog connectLog
+
+func (l *connectLog) reset(size int) {
+	l.mu.Lock()
+	l.attempts = nil
+	l.size = size
+	l.mu.Unlock()
+}
+
+func (l *connectLog) record(endpoint string, began time.Time, stage string, err error) {
+	a := connectAttempt{
+		Time:       began.UnixMilli(),
+		Endpoint:   endpoint,
+		DurationMs: time.Since(began).Milliseconds(),
+		OK:         err == nil,
+		Stage:      stage,
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := l.size
+	if size <= 0 {
+		size = 20
+	}
+	l.attempts = append(l.attempts, a)
+	if n := len(l.attempts); n > size {
+		l.attempts = append([]connectAttempt(nil), l.attempts[n-size:]...)
+	}
+}
+
+// json returns the attempts as a JSON array, oldest first
+func (l *connectLog) json() string {
+	l.mu.Lock()
+	b, _ := json.Marshal(l.attempts)
+	l.mu.Unlock()
+	if string(b) == "null" {
+		return "[]"
+	}
+	return string(b)
+}
+
+// GetConnectLog returns the recent connection attempts since Start as a JSON
+// array of {time, endpoint, durationMs, ok, stage, error}, oldest first.
+func GetConnectLog() string {
+	return clientConnectLog.json()
+}
@@ -0,0 +1,319 @@
+package minewire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"minewire/mcversion"
+)
+
+// scriptServer is the server end of a pipe to a connector, driven step by
+// step by the test.
+type scriptServer struct {
+	t         *testing.T
+	conn      net.Conn
+	r         *bufio.Reader
+	threshold int // Compression threshold, negative while off
+}
+
+// pipeConnector returns a connector for opts wired to a scriptServer
+func pipeConnector(t *testing.T, opts Options) (*connector, *scriptServer) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	conf := config{
+		ServerAddress: "mc.example.com:25565",
+		Password:      testPassword,
+		Options:       opts,
+	}
+	c := &connector{conf: conf, addr: conf.ServerAddress, conn: client, compressionThreshold: -1}
+	return c, &scriptServer{t: t, conn: server, r: bufio.NewReader(server), threshold: -1}
+}
+
+func (s *scriptServer) send(pid int, data []byte) {
+	s.t.Helper()
+	if err := WriteCompressedPacket(s.conn, s.threshold, pid, data); err != nil {
+		s.t.Fatalf("sending 0x%02X: %v", pid, err)
+	}
+}
+
+// expect reads the next packet, fails unless it has ID want and returns its
+// body
+func (s *scriptServer) expect(want int) []byte {
+	s.t.Helper()
+	pid, data, err := readRawPacket(s.r, s.threshold)
+	if err != nil {
+		s.t.Fatalf("waiting for 0x%02X: %v", want, err)
+	}
+	if pid != want {
+		s.t.Fatalf("got packet 0x%02X, want 0x%02X", pid, want)
+	}
+	return data
+}
+
+// runStep starts step in the background and returns a func waiting for its error
+func runStep(step func() error) func() error {
+	errc := make(chan error, 1)
+	go func() { errc <- step() }()
+	return func() error {
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(5 * time.Second):
+			return errStepTimeout
+		}
+	}
+}
+
+var errStepTimeout = errors.New("step didn't finish")
+
+func varInt(v int) []byte {
+	var buf bytes.Buffer
+	WriteVarInt(&buf, v)
+	return buf.Bytes()
+}
+
+func mcString(s string) []byte {
+	var buf bytes.Buffer
+	WriteString(&buf, s)
+	return buf.Bytes()
+}
+
+func TestPerformHandshake(t *testing.T) {
+	c, srv := pipeConnector(t, Options{Cipher: cipherChaCha20, KeyDerivation: kdfPBKDF2})
+	wait := runStep(c.performHandshake)
+
+	br := bytes.NewReader(srv.expect(PID_SB_Handshake))
+	version, _ := ReadVarInt(br)
+	host, _ := ReadString(br)
+	var port uint16
+	binary.Read(br, binary.BigEndian, &port)
+	next, _ := ReadVarInt(br)
+	login := bytes.NewReader(srv.expect(PID_SB_LoginStart))
+	name, err := ReadString(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uuid loginUUID
+	if _, err := io.ReadFull(login, uuid[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if version != PROTOCOL_VERSION {
+		t.Errorf("version = %d, want %d", version, PROTOCOL_VERSION)
+	}
+	if host != "mc.example.com" {
+		t.Errorf("host = %q, want the bare server host", host)
+	}
+	if port != 25565 || next != 2 {
+		t.Errorf("port %d, next state %d; want 25565 and 2", port, next)
+	}
+	if uuid != c.uuid || !bytes.Equal(c.salt, uuid[:]) || uuid.settings(testPassword) != settingChaCha20|settingPBKDF2 {
+		t.Errorf("Login Start UUID %x announces %b, want chacha20 and PBKDF2 salted with it", uuid, uuid.settings(testPassword))
+	}
+	if !validUsername.MatchString(name) || !strings.HasPrefix(name, "Player") {
+		t.Errorf("username = %q, want a derived Player name", name)
+	}
+}
+
+// A 1.21.9 server that sends everything a vanilla one may ask during login
+// and configuration, with compression on, gets the answers a client gives.
+func TestPerformLoginAnswersServer(t *testing.T) {
+	c, srv := pipeConnector(t, Options{Brand: "vanilla"})
+	wait := runStep(c.performLogin)
+	ids, _ := mcversion.For(PROTOCOL_VERSION)
+	cp := ids.Config
+
+	srv.send(PID_CB_SetCompression, varInt(256))
+	srv.threshold = 256
+
+	srv.send(PID_CB_LoginPluginRequest, append(varInt(7), mcString("velocity:player_info")...))
+	resp := srv.expect(PID_SB_LoginPluginResponse)
+	if !bytes.Equal(resp, []byte{7, 0}) {
+		t.Errorf("plugin response = % x, want message 7 declined", resp)
+	}
+	srv.send(PID_CB_CookieRequest, mcString("minecraft:session"))
+	if got := srv.expect(PID_SB_CookieResponse); !bytes.Equal(got, append(mcString("minecraft:session"), 0)) {
+		t.Errorf("cookie response = % x, want no cookie", got)
+	}
+
+	srv.send(PID_CB_LoginSuccess, nil)
+	srv.expect(PID_SB_LoginAcknowledged)
+	srv.expect(cp.SBClientInformation)
+	brand := bytes.NewReader(srv.expect(cp.SBPluginMsg))
+	if ch, _ := ReadString(brand); ch != "minecraft:brand" {
+		t.Errorf("plugin message on %q, want the brand", ch)
+	}
+
+	packs := append(varInt(1), mcString("minecraft")...)
+	srv.send(cp.CBKnownPacks, packs)
+	if got := srv.expect(cp.SBKnownPacks); !bytes.Equal(got, packs) {
+		t.Errorf("known packs = % x, want the server's", got)
+	}
+	srv.send(cp.CBPing, []byte{0, 0, 0, 42})
+	if got := srv.expect(cp.SBPong); !bytes.Equal(got, []byte{0, 0, 0, 42}) {
+		t.Errorf("pong = % x", got)
+	}
+	srv.send(cp.CBKeepAlive, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	if got := srv.expect(cp.SBKeepAlive); !bytes.Equal(got, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("keepalive = % x", got)
+	}
+	uuid := bytes.Repeat([]byte{0xAB}, 16)
+	srv.send(cp.CBAddResourcePack, append(uuid, mcString("https://example.com/pack.zip")...))
+	if got := srv.expect(cp.SBResourcePackResp); !bytes.Equal(got, append(uuid, 1)) {
+		t.Errorf("resource pack response = % x, want declined", got)
+	}
+	srv.send(cp.CBCookieRequest, mcString("minecraft:cfg"))
+	srv.expect(cp.SBCookieResponse)
+	srv.send(cp.CBCodeOfConduct, mcString("Be nice"))
+	srv.expect(cp.SBAcceptConduct)
+	srv.send(cp.CBFinish, nil)
+	srv.expect(cp.SBFinishAck)
+
+	srv.send(PID_CB_KeepAlive, make([]byte, 8)) // Play noise before Join Game
+	srv.send(ids.JoinGame, nil)
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if c.compressionThreshold != 256 || !c.configured {
+		t.Errorf("threshold %d, configured %v; want 256 and true", c.compressionThreshold, c.configured)
+	}
+}
+
+// Before 1.20.2 there is no configuration: Join Game follows Login Success.
+func TestPerformLoginWithoutConfiguration(t *testing.T) {
+	c, srv := pipeConnector(t, Options{ProtocolVersion: 763})
+	wait := runStep(c.performLogin)
+	ids, _ := mcversion.For(763)
+
+	srv.send(PID_CB_LoginSuccess, nil)
+	srv.send(ids.JoinGame, nil)
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	if c.configured {
+		t.Error("configured without a Configuration state")
+	}
+}
+
+// 1.20.2 has the older Configuration IDs and resource packs without UUIDs.
+func TestPerformConfiguration1202(t *testing.T) {
+	c, srv := pipeConnector(t, Options{ProtocolVersion: 764})
+	c.reader = bufio.NewReader(c.conn)
+	wait := runStep(c.performConfiguration)
+	cp := mcversion.Config1202
+
+	srv.expect(cp.SBClientInformation)
+	srv.send(cp.CBAddResourcePack, mcString("https://example.com/pack.zip"))
+	if got := srv.expect(cp.SBResourcePackResp); !bytes.Equal(got, []byte{1}) {
+		t.Errorf("resource pack response = % x, want just declined", got)
+	}
+	srv.send(cp.CBFinish, nil)
+	srv.expect(cp.SBFinishAck)
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPerformLoginFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(*scriptServer)
+		want   string
+	}{
+		{
+			name: "disconnect",
+			script: func(s *scriptServer) {
+				s.send(PID_CB_LoginDisconnect, mcString(`{"text":"banned"}`))
+			},
+			want: "banned",
+		},
+		{
+			name: "online mode",
+			script: func(s *scriptServer) {
+				s.send(PID_CB_EncryptionRequest, nil)
+			},
+			want: "online-mode",
+		},
+		{
+			name: "disconnect during configuration",
+			script: func(s *scriptServer) {
+				s.send(PID_CB_LoginSuccess, nil)
+				s.expect(PID_SB_LoginAcknowledged)
+				s.expect(mcversion.Config1205.SBClientInformation)
+				s.send(mcversion.Config1205.CBDisconnect, mcString(`{"text":"bye"}`))
+			},
+			want: "during configuration",
+		},
+		{
+			name: "short resource pack request",
+			script: func(s *scriptServer) {
+				s.send(PID_CB_LoginSuccess, nil)
+				s.expect(PID_SB_LoginAcknowledged)
+				s.expect(mcversion.Config1205.SBClientInformation)
+				s.send(mcversion.Config1205.CBAddResourcePack, []byte{1, 2, 3})
+			},
+			want: "short resource pack",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, srv := pipeConnector(t, Options{})
+			wait := runStep(c.performLogin)
+			tt.script(srv)
+			err := wait()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("performLogin = %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// recordingSink keeps every log line at error level
+type recordingSink struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (s *recordingSink) OnLog(level, message string) {
+	if level == "error" {
+		s.mu.Lock()
+		s.errors = append(s.errors, message)
+		s.mu.Unlock()
+	}
+}
+
+// A refused login with a name the server can't have derived says why.
+func TestLoginRefusedWithUnderivedName(t *testing.T) {
+	for pattern, wantLog := range map[string]bool{"": false, "random": true, "Steve": true, "no spaces!": false} {
+		sink := &recordingSink{}
+		SetLogSink(sink)
+		c, srv := pipeConnector(t, Options{UsernamePattern: pattern})
+		wait := runStep(c.performLogin)
+		srv.send(PID_CB_LoginDisconnect, mcString(`{"text":"bad name"}`))
+		if err := wait(); err == nil {
+			t.Errorf("pattern %q: performLogin succeeded, want it refused", pattern)
+		}
+		SetLogSink(nil)
+		sink.mu.Lock()
+		if logged := len(sink.errors) > 0; logged != wantLog {
+			t.Errorf("pattern %q: logged errors %q, want one: %v", pattern, sink.errors, wantLog)
+		}
+		sink.mu.Unlock()
+	}
+}
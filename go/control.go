@@ -0,0 +1,101 @@
+package minewire
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Control protocol: the client never opens streams towards itself, so every
+// stream the server opens is a control stream. It carries messages framed as
+// a big-endian uint32 length followed by a JSON object with at least a
+// "type" field:
+//
+//	{"type": "notice", "message": "Maintenance at 03:00 UTC"}
+//	{"type": "disconnect", "message": "Account suspended"}
+//	{"type": "config", "data": {...}}
+//
+// Every message is handed to the ControlCallback; "disconnect" additionally
+// stops the client.
+
+// maxControlMessage bounds a single control message
+const maxControlMessage = 64 * 1024
+
+// ControlCallback receives messages pushed by the server. messageJSON is the
+// complete message object as sent.
+type ControlCallback interface {
+	OnControlMessage(msgType string, messageJSON string)
+}
+
+var controlCallback ControlCallback
+
+// SetControlCallback sets the callback for server-pushed control messages
+func SetControlCallback(cb ControlCallback) {
+	controlCallback = cb
+}
+
+type controlMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// acceptControlStreams serves server-opened streams until the session closes
+func acceptControlStreams(sess *yamux.Session) {
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go readControlStream(stream)
+	}
+}
+
+func readControlStream(stream net.Conn) {
+	defer stream.Close()
+	for {
+		raw, err := readControlMessage(stream)
+		if err != nil {
+			if err != io.EOF {
+				logWarn("Control stream: %v", err)
+			}
+			return
+		}
+		var msg controlMessage
+		if err := json.Unmarshal(raw, &msg); err != nil || msg.Type == "" {
+			logWarn("Control stream: ignoring malformed message")
+			continue
+		}
+		handleControlMessage(msg, raw)
+	}
+}
+
+func readControlMessage(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > maxControlMessage {
+		return nil, fmt.Errorf("message too large (%d bytes)", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func handleControlMessage(msg controlMessage, raw []byte) {
+	if controlCallback != nil {
+		controlCallback.OnControlMessage(msg.Type, string(raw))
+	}
+
+	if msg.Type == "disconnect" {
+		logInfo("Server requested disconnect: %s", msg.Message)
+		Stop()
+		notifyState("disconnected", msg.Message)
+	}
+}
@@ -0,0 +1,156 @@
+package minewire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer opens connections through a tunnel of its own, for Go programs
+// that embed minewire rather than talk to its local proxy. It implements
+// proxy.Dialer and proxy.ContextDialer:
+//
+//	d, err := minewire.NewDialer("mc.example.com:25565", password)
+//	conn, err := d.Dial("tcp", "example.com:443")
+//
+// The tunnel is set up on the first Dial and again whenever it has dropped.
+// It is independent of the one Start runs, which doesn't need to be
+// running; split tunneling and the kill switch don't apply to it. Its
+// connect attempts and stalls are its own too, see ConnectLog.
+type Dialer struct {
+	conf   config
+	ctx    context.Context // Lifetime of the tunnel, canceled by Close
+	cancel context.CancelFunc
+
+	log     connectLog
+	stalled atomic.Int64
+	hooks   *connectHooks
+
+	mu     sync.Mutex // Held while connecting, so concurrent Dials share one attempt
+	tunnel Tunnel
+	next   int // Server to try first, the one that last worked
+}
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+var errDialerClosed = errors.New("dialer closed")
+
+// NewDialer returns a Dialer for serverAddr, a server or comma-separated
+// failover list as for Start, using the options set with SetOptions.
+func NewDialer(serverAddr, password string) (*Dialer, error) {
+	conf := config{
+		ServerAddress: serverAddr,
+		Servers:       splitServerList(serverAddr),
+		Password:      password,
+		Options:       getConfig().Options,
+	}
+	if len(conf.Servers) == 0 {
+		return nil, errors.New("server address required")
+	}
+	if password == "" && !conf.AllowEmptyPassword {
+		return nil, errors.New("password required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dialer{conf: conf, ctx: ctx, cancel: cancel}
+	d.log.reset(conf.connectLogSize())
+	// The next Dial reconnects a dropped tunnel; there is no loop to wake
+	d.hooks = &connectHooks{log: &d.log, stalled: &d.stalled, wake: func() {}}
+	return d, nil
+}
+
+// Dial connects to addr through the tunnel. Only TCP is supported.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is Dial bounded by ctx. A tunnel connect it started carries on
+// after ctx is done, for the next Dial to use.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := d.open(addr)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		// Don't leak the stream if it opens after all
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (d *Dialer) open(dest string) (net.Conn, error) {
+	t, err := d.currentTunnel()
+	if err != nil {
+		return nil, err
+	}
+	return openStreamOn(t, dest)
+}
+
+// currentTunnel returns the tunnel, connecting first if there is none or it
+// was lost
+func (d *Dialer) currentTunnel() (Tunnel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx.Err() != nil {
+		return nil, errDialerClosed
+	}
+	if d.tunnel != nil && !d.tunnel.IsClosed() {
+		return d.tunnel, nil
+	}
+
+	t, idx, err := connectAny(d.ctx, d.conf, d.next, d.hooks)
+	if err != nil {
+		return nil, err
+	}
+	d.tunnel, d.next = t, idx
+	return t, nil
+}
+
+// ConnectLog returns the Dialer's recent connection attempts, in the format
+// of GetConnectLog.
+func (d *Dialer) ConnectLog() string {
+	return d.log.json()
+}
+
+// StalledSessionCount is GetStalledSessionCount for the Dialer's tunnel.
+func (d *Dialer) StalledSessionCount() int64 {
+	return d.stalled.Load()
+}
+
+// Close shuts the tunnel down, and with it every connection opened through
+// it. Dials after Close fail.
+func (d *Dialer) Close() error {
+	d.cancel() // Aborts a connect in progress, which holds mu
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tunnel == nil {
+		return nil
+	}
+	return d.tunnel.Close()
+}
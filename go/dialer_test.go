@@ -0,0 +1,45 @@
+package minewire
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+// A Dialer's connects go to its own log, not to the one of Start's tunnel.
+func TestDialerKeepsItsOwnConnectLog(t *testing.T) {
+	srv := newFakeServer(t, testPassword)
+	before := GetConnectLog()
+
+	// Nothing listens on port 1, so the first server fails at the dial
+	d, err := NewDialer("127.0.0.1:1,"+srv.addr(), testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	conn, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hi" {
+		t.Fatalf("echo = %q, %v; want \"hi\"", got, err)
+	}
+
+	var attempts []connectAttempt
+	if err := json.Unmarshal([]byte(d.ConnectLog()), &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[0].OK || attempts[0].Stage != "dial" ||
+		!attempts[1].OK || attempts[1].Endpoint != srv.addr() {
+		t.Errorf("Dialer connect log = %+v, want a failed dial then %s", attempts, srv.addr())
+	}
+	if after := GetConnectLog(); after != before {
+		t.Errorf("GetConnectLog changed to %s by the Dialer", after)
+	}
+	if n := d.StalledSessionCount(); n != 0 {
+		t.Errorf("StalledSessionCount = %d, want 0", n)
+	}
+}
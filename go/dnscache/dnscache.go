@@ -0,0 +1,99 @@
+// Package dnscache keeps recent lookups of destination names, so repeated
+// connections to a host skip resolution and its split tunnel decision stays
+// the same while the entry lives. The library and the standalone Windows
+// build both use it.
+package dnscache
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Cache maps names to their addresses until each entry expires. The zero
+// value is an empty cache ready to use.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// Get returns the cached addresses of host while the entry is fresh
+func (c *Cache) Get(host string) ([]net.IP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.ips, true
+}
+
+// Put caches ips for host for ttl, making room first if the cache already
+// holds size entries
+func (c *Cache) Put(host string, ips []net.IP, ttl time.Duration, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]entry)
+	}
+	if _, ok := c.entries[host]; !ok && len(c.entries) >= size {
+		c.evictLocked()
+	}
+	c.entries[host] = entry{ips: ips, expires: time.Now().Add(ttl)}
+}
+
+// evictLocked drops every expired entry, or the one closest to expiring if
+// none has. Caller holds mu.
+func (c *Cache) evictLocked() {
+	now := time.Now()
+	expired := false
+	var soonest string
+	var soonestTime time.Time
+	for host, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, host)
+			expired = true
+		} else if soonest == "" || e.expires.Before(soonestTime) {
+			soonest, soonestTime = host, e.expires
+		}
+	}
+	if !expired {
+		delete(c.entries, soonest)
+	}
+}
+
+// Clear forgets every entry
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
+
+// Resolve returns the addresses of host, an IP literal or a name, from the
+// cache while the entry is fresh. Answers are kept for ttl in a cache of at
+// most size names; a ttl of 0 or less bypasses the cache. Failed lookups
+// aren't cached.
+func (c *Cache) Resolve(host string, ttl time.Duration, size int) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if ttl > 0 {
+		if ips, ok := c.Get(host); ok {
+			return ips, nil
+		}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		c.Put(host, ips, ttl, size)
+	}
+	return ips, nil
+}
@@ -0,0 +1,41 @@
+package dnscache
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsSoonestToExpire(t *testing.T) {
+	var c Cache
+	ip := []net.IP{net.ParseIP("192.0.2.1")}
+	c.Put("short.test", ip, time.Minute, 2)
+	c.Put("long.test", ip, time.Hour, 2)
+	c.Put("new.test", ip, time.Hour, 2)
+
+	if _, ok := c.Get("short.test"); ok {
+		t.Error("short.test still cached, want it evicted first")
+	}
+	for _, host := range []string{"long.test", "new.test"} {
+		if _, ok := c.Get(host); !ok {
+			t.Errorf("%s not cached", host)
+		}
+	}
+
+	c.Clear()
+	if _, ok := c.Get("long.test"); ok {
+		t.Error("long.test cached after Clear")
+	}
+}
+
+func TestResolveUsesCache(t *testing.T) {
+	var c Cache
+	c.Put("cached.test", []net.IP{net.ParseIP("198.51.100.7")}, time.Minute, 16)
+	ips, err := c.Resolve("cached.test", time.Minute, 16)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("Resolve(cached.test) = %v, %v; want the cached address", ips, err)
+	}
+	if ips, err := c.Resolve("2001:db8::1", 0, 0); err != nil || len(ips) != 1 {
+		t.Errorf("Resolve of an IP literal = %v, %v", ips, err)
+	}
+}
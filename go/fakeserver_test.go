@@ -0,0 +1,325 @@
+package minewire
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"minewire/mcversion"
+)
+
+// fakeServer is a scripted Minecraft server for tests. It walks a client
+// through login and configuration the way a current vanilla server does,
+// then carries the tunnel like the real server: plugin messages up, chunk
+// data down, with yamux on top. Every stream echoes what it receives after
+// the destination string.
+type fakeServer struct {
+	t        *testing.T
+	ln       net.Listener
+	password string
+
+	// stall makes the server accept connections and never answer, so the
+	// client sits in its connect attempt
+	stall atomic.Bool
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	dests  []string    // Destination of every stream opened, in order
+	logins []handshake // Every handshake received, in order
+}
+
+// handshake is what the client announced in its handshake packet
+type handshake struct {
+	version int
+	host    string
+	cipher  string
+	salt    []byte
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, ln: ln, password: password}
+	t.Cleanup(func() {
+		ln.Close()
+		s.dropAll()
+	})
+	go s.acceptLoop()
+	return s
+}
+
+func (s *fakeServer) addr() string { return s.ln.Addr().String() }
+
+func (s *fakeServer) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		if s.stall.Load() {
+			continue // Held open until dropAll
+		}
+		go s.serve(conn)
+	}
+}
+
+// dropAll closes every connection the server accepted, as a server restart
+// would.
+func (s *fakeServer) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeServer) streamDests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.dests...)
+}
+
+func (s *fakeServer) handshakes() []handshake {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]handshake(nil), s.logins...)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	hs, err := serverLogin(conn, r, s.password)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.logins = append(s.logins, hs)
+	s.mu.Unlock()
+
+	aead, err := newAEAD(hs.cipher, deriveKey(s.password, hs.salt))
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	conf := yamux.DefaultConfig()
+	conf.LogOutput = io.Discard
+	sess, err := yamux.Server(&serverTunnelConn{Conn: conn, r: r, aead: aead}, conf)
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go s.echo(stream)
+	}
+}
+
+func (s *fakeServer) echo(stream net.Conn) {
+	defer stream.Close()
+	r := bufio.NewReader(stream)
+	dest, err := ReadString(r)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.dests = append(s.dests, dest)
+	s.mu.Unlock()
+	io.Copy(stream, r)
+}
+
+// serverLogin plays the server side of the handshake, login and (for
+// versions that have it) configuration, ending with Join Game. The settings
+// announced in the Login Start UUID are read with password.
+func serverLogin(conn net.Conn, r *bufio.Reader, password string) (handshake, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	hs, err := readHandshake(r)
+	if err != nil {
+		return hs, err
+	}
+	uuid, err := readLoginStart(r, hs.version)
+	if err != nil {
+		return hs, err
+	}
+	settings := uuid.settings(password)
+	if settings&settingSingleStream != 0 {
+		// Like a server without single-stream mode
+		var reason bytes.Buffer
+		WriteString(&reason, `{"text":"single-stream mode not supported"}`)
+		WritePacket(conn, PID_CB_LoginDisconnect, reason.Bytes())
+		return hs, errors.New("single-stream login refused")
+	}
+	if settings&settingChaCha20 != 0 {
+		hs.cipher = cipherChaCha20
+	}
+	if settings&settingPBKDF2 != 0 {
+		hs.salt = uuid[:]
+	}
+	if err := WritePacket(conn, PID_CB_LoginSuccess, nil); err != nil {
+		return hs, err
+	}
+	ids, ok := mcversion.For(hs.version)
+	if !ok {
+		return hs, fmt.Errorf("unsupported protocol version %d", hs.version)
+	}
+	if mcversion.UsesConfigurationState(hs.version) {
+		if err := expectPacket(r, PID_SB_LoginAcknowledged); err != nil {
+			return hs, err
+		}
+		if err := expectPacket(r, ids.Config.SBClientInformation); err != nil {
+			return hs, err
+		}
+		if err := WritePacket(conn, ids.Config.CBFinish, nil); err != nil {
+			return hs, err
+		}
+		if err := expectPacket(r, ids.Config.SBFinishAck); err != nil {
+			return hs, err
+		}
+	}
+	return hs, WritePacket(conn, ids.JoinGame, nil)
+}
+
+// readHandshake parses the handshake packet
+func readHandshake(r *bufio.Reader) (handshake, error) {
+	hs := handshake{cipher: cipherAESGCM}
+	pid, data, err := readRawPacket(r, -1)
+	if err != nil {
+		return hs, err
+	}
+	if pid != PID_SB_Handshake {
+		return hs, fmt.Errorf("got packet 0x%02X, want a handshake", pid)
+	}
+	br := bytes.NewReader(data)
+	if hs.version, err = ReadVarInt(br); err != nil {
+		return hs, err
+	}
+	hs.host, err = ReadString(br)
+	return hs, err
+}
+
+// readLoginStart reads Login Start and returns its player UUID
+func readLoginStart(r *bufio.Reader, version int) (loginUUID, error) {
+	var uuid loginUUID
+	pid, data, err := readRawPacket(r, -1)
+	if err != nil {
+		return uuid, err
+	}
+	if pid != PID_SB_LoginStart {
+		return uuid, fmt.Errorf("got packet 0x%02X, want Login Start", pid)
+	}
+	br := bytes.NewReader(data)
+	if _, err := ReadString(br); err != nil {
+		return uuid, err
+	}
+	if version < mcversion.LoginUUID {
+		if has, err := br.ReadByte(); err != nil || has != 1 {
+			return uuid, fmt.Errorf("login start without a UUID")
+		}
+	}
+	_, err = io.ReadFull(br, uuid[:])
+	return uuid, err
+}
+
+func expectPacket(r *bufio.Reader, want int) error {
+	pid, _, err := readRawPacket(r, -1)
+	if err != nil {
+		return err
+	}
+	if pid != want {
+		return fmt.Errorf("got packet 0x%02X, want 0x%02X", pid, want)
+	}
+	return nil
+}
+
+// serverTunnelConn is the server's end of MinecraftConn: it opens the
+// client's plugin messages and sends data back in chunk packets.
+type serverTunnelConn struct {
+	net.Conn
+	r    *bufio.Reader
+	aead cipher.AEAD
+
+	pending []byte
+	writeMu sync.Mutex
+}
+
+func (c *serverTunnelConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		pid, data, err := readRawPacket(c.r, -1)
+		if err != nil {
+			return 0, err
+		}
+		if pid != PID_SB_PluginMsg {
+			continue // Movement noise, keepalives
+		}
+		br := bytes.NewReader(data)
+		if _, err := ReadString(br); err != nil {
+			return 0, err
+		}
+		enc := data[len(data)-br.Len():]
+		ns := c.aead.NonceSize()
+		if len(enc) < ns {
+			continue
+		}
+		pt, err := c.aead.Open(nil, enc[:ns], enc[ns:], nil)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = pt
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *serverTunnelConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	nonce := make([]byte, c.aead.NonceSize())
+	rand.Read(nonce)
+	enc := c.aead.Seal(nonce, nonce, b, nil)
+
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, 8)) // Chunk X and Z
+	buf.WriteByte(0)           // Heightmaps: TAG_End
+	WriteVarInt(buf, len(enc))
+	buf.Write(enc)
+	if err := WritePacket(c.Conn, PID_CB_ChunkData, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
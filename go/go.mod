@@ -5,14 +5,16 @@ go 1.24.3
 require (
 	github.com/eycorsican/go-tun2socks v1.16.11
 	github.com/hashicorp/yamux v0.1.2
+	github.com/yl2chen/cidranger v1.0.2
+	golang.org/x/crypto v0.46.0
+	golang.org/x/net v0.48.0
+	golang.org/x/sys v0.39.0
+	golang.org/x/time v0.14.0
 )
 
 require (
-	github.com/yl2chen/cidranger v1.0.2 // indirect
 	golang.org/x/mobile v0.0.0-20251209145715-2553ed8ce294 // indirect
 	golang.org/x/mod v0.31.0 // indirect
-	golang.org/x/net v0.48.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
 	golang.org/x/tools v0.40.0 // indirect
 )
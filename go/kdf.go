@@ -0,0 +1,43 @@
+package minewire
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"unicode/utf8"
+)
+
+// Key derivation versions. Version 1 is the original unsalted SHA-256 of the
+// password; version 2 stretches the password with PBKDF2 over a random salt
+// that the client picks per session: the loginUUID it sends in Login Start.
+const (
+	kdfLegacy = 1
+	kdfPBKDF2 = 2
+
+	kdfIterations = 100_000
+)
+
+// weakPasswordLength is the length below which Start warns that the
+// password is easy to guess
+const weakPasswordLength = 8
+
+// warnWeakPassword logs a warning for a short (but non-empty) password
+func warnWeakPassword(password string) {
+	if n := utf8.RuneCountInString(password); n > 0 && n < weakPasswordLength {
+		logWarn("Password is only %d characters; use at least %d", n, weakPasswordLength)
+	}
+}
+
+// deriveKey returns the 32-byte tunnel key for password. A nil salt gives the
+// legacy key.
+func deriveKey(password string, salt []byte) []byte {
+	if salt == nil {
+		h := sha256.Sum256([]byte(password))
+		return h[:]
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, kdfIterations, 32)
+	if err != nil {
+		// Only possible for invalid parameters, and ours are constant
+		panic(err)
+	}
+	return key
+}
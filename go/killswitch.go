@@ -0,0 +1,48 @@
+package minewire
+
+import (
+	"errors"
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+var errKillSwitch = errors.New("kill switch: tunnel is down")
+
+// killSwitchEngaged reports whether new connections have to be refused: the
+// kill switch is on and the tunnel is running without a live session. It
+// reads currentSession: sessionLock can be held for seconds and is no sign
+// of the session's state either way.
+func killSwitchEngaged() bool {
+	if !getConfig().KillSwitch || !IsRunning() {
+		return false
+	}
+	s := currentSession()
+	return s == nil || s.IsClosed()
+}
+
+// killSwitchTCPHandler refuses VPN connections while the kill switch is
+// engaged, before they reach the local proxy. tun2socks aborts the
+// connection when Handle fails.
+type killSwitchTCPHandler struct {
+	core.TCPConnHandler
+}
+
+func (h killSwitchTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	if killSwitchEngaged() {
+		return errKillSwitch
+	}
+	return h.TCPConnHandler.Handle(conn, target)
+}
+
+// killSwitchUDPHandler is killSwitchTCPHandler for UDP associations
+type killSwitchUDPHandler struct {
+	core.UDPConnHandler
+}
+
+func (h killSwitchUDPHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if killSwitchEngaged() {
+		return errKillSwitch
+	}
+	return h.UDPConnHandler.Connect(conn, target)
+}
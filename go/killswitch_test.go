@@ -0,0 +1,28 @@
+package minewire
+
+import "testing"
+
+func TestKillSwitchFollowsSession(t *testing.T) {
+	if msg := SetOptions(`{"killSwitch": true}`); msg != "" {
+		t.Fatal(msg)
+	}
+	t.Cleanup(func() { SetOptions(`{}`) })
+
+	srv := newFakeServer(t, testPassword)
+	if msg := Start("127.0.0.1:0", "", srv.addr(), testPassword, "socks5", "", ""); msg != "" {
+		t.Fatal(msg)
+	}
+	defer stopAfter(t)
+	waitFor(t, "connected", func() bool { return GetConnectionState() == "connected" })
+
+	sessionLock.Lock()
+	engaged := killSwitchEngaged()
+	sessionLock.Unlock()
+	if engaged {
+		t.Error("kill switch engaged with a live session")
+	}
+
+	srv.stall.Store(true)
+	srv.dropAll()
+	waitFor(t, "kill switch", killSwitchEngaged)
+}
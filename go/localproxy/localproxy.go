@@ -0,0 +1,102 @@
+// Package localproxy parses the settings of the local proxy the client
+// listens with. The library and the standalone Windows build both use it so
+// they accept the same spellings and reach the same results.
+package localproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultHost keeps the proxy off the network unless asked otherwise
+const DefaultHost = "127.0.0.1"
+
+// NormalizeProxyType maps a user supplied proxy type to "http" or "socks5",
+// the only two the client runs. Anything that isn't HTTP, including an empty
+// string, means SOCKS5.
+func NormalizeProxyType(proxyType string) string {
+	switch strings.ToLower(strings.TrimSpace(proxyType)) {
+	case "http", "https":
+		return "http"
+	default:
+		return "socks5"
+	}
+}
+
+// NormalizeLocalPort turns the accepted local port spellings ("1080",
+// ":1080", "127.0.0.1:1080", "[::1]:1080") into the canonical "host:port"
+// form, with an empty host if none was given.
+func NormalizeLocalPort(localPort string) (string, error) {
+	s := strings.TrimSpace(localPort)
+	if s == "" {
+		return "", errors.New("local port is empty")
+	}
+	host, port := "", s
+	if strings.Contains(s, ":") {
+		h, p, err := net.SplitHostPort(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid local port %q: %v", localPort, err)
+		}
+		host, port = h, p
+	}
+	n, err := parsePort(port)
+	if err != nil || port == "" || n > 65535 {
+		return "", fmt.Errorf("invalid local port %q: port must be a number from 0 to 65535", localPort)
+	}
+	if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid local port %q: host must be an IP address", localPort)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n)), nil
+}
+
+// ResolveListenAddress combines localAddress and localPort into the address
+// the proxy listens on. localAddress wins over a host given in localPort;
+// with neither, the proxy binds to DefaultHost.
+func ResolveListenAddress(localAddress, localPort string) (string, error) {
+	hostPort, err := NormalizeLocalPort(localPort)
+	if err != nil {
+		return "", err
+	}
+	host, port, _ := net.SplitHostPort(hostPort)
+	if a := strings.TrimSpace(localAddress); a != "" {
+		host = strings.TrimSuffix(strings.TrimPrefix(a, "["), "]")
+	}
+	if host == "" {
+		host = DefaultHost
+	}
+
+	addr := net.JoinHostPort(host, port)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", fmt.Errorf("invalid local address %q: %v", localAddress, err)
+	}
+	if host != "localhost" && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid local address %q: must be an IP address", localAddress)
+	}
+	return addr, nil
+}
+
+// UDPRelayAddr is where the UDP relay of a SOCKS5 UDP ASSOCIATE listens:
+// the IP the client reached the proxy on (local), so a client on ::1 or on
+// the LAN is told an address it can send to. Anything else gets loopback.
+func UDPRelayAddr(local net.Addr) string {
+	if a, ok := local.(*net.TCPAddr); ok && a.IP != nil && !a.IP.IsUnspecified() {
+		return net.JoinHostPort(a.IP.String(), "0")
+	}
+	return net.JoinHostPort(DefaultHost, "0")
+}
+
+// parsePort parses a string of decimal digits, stopping short of overflow
+func parsePort(s string) (int, error) {
+	var n int
+	for _, ch := range []byte(s) {
+		ch -= '0'
+		if ch > 9 || n > 65535 {
+			return 0, errors.New("invalid port")
+		}
+		n = n*10 + int(ch)
+	}
+	return n, nil
+}
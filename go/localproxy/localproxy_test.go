@@ -0,0 +1,67 @@
+package localproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNormalizeProxyType(t *testing.T) {
+	for in, want := range map[string]string{
+		"http": "http", " HTTPS ": "http", "socks5": "socks5", "socks4": "socks5", "": "socks5",
+	} {
+		if got := NormalizeProxyType(in); got != want {
+			t.Errorf("NormalizeProxyType(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestResolveListenAddress(t *testing.T) {
+	tests := []struct {
+		address, port string
+		want          string // Empty for an error
+	}{
+		{"", "1080", "127.0.0.1:1080"},
+		{"", ":1080", "127.0.0.1:1080"},
+		{"", "0.0.0.0:1080", "0.0.0.0:1080"},
+		{"", "[::1]:1080", "[::1]:1080"},
+		{"::", "127.0.0.1:1080", "[::]:1080"},
+		{"[::1]", "1080", "[::1]:1080"},
+		{"", "localhost:0", "localhost:0"},
+		{"", "", ""},
+		{"", "65536", ""},
+		{"", "18446744073709551617", ""},
+		{"", "10x", ""},
+		{"", "example.com:1080", ""},
+		{"example.com", "1080", ""},
+	}
+	for _, tt := range tests {
+		got, err := ResolveListenAddress(tt.address, tt.port)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ResolveListenAddress(%q, %q) = %q, want an error", tt.address, tt.port, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ResolveListenAddress(%q, %q) = %q, %v; want %q", tt.address, tt.port, got, err, tt.want)
+		}
+	}
+}
+
+func TestUDPRelayAddr(t *testing.T) {
+	tests := []struct {
+		local net.Addr
+		want  string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1080}, "[::1]:0"},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 1080}, "192.168.1.5:0"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 1080}, "127.0.0.1:0"},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 1080}, "127.0.0.1:0"},
+		{&net.UnixAddr{Name: "pipe"}, "127.0.0.1:0"},
+	}
+	for _, tt := range tests {
+		if got := UDPRelayAddr(tt.local); got != tt.want {
+			t.Errorf("UDPRelayAddr(%v) = %q, want %q", tt.local, got, tt.want)
+		}
+	}
+}
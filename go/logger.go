@@ -0,0 +1,64 @@
+package minewire
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels, lowest first. Messages below the configured level are dropped.
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var logLevel atomic.Int32 // Zero value is levelDebug; see init
+
+func init() {
+	logLevel.Store(levelInfo)
+}
+
+// LogSink receives log lines instead of the standard logger, which gomobile
+// already sends to logcat. level is "debug", "info", "warn" or "error".
+type LogSink interface {
+	OnLog(level string, message string)
+}
+
+var logSink atomic.Value // holds LogSink
+
+// SetLogSink routes log output to sink; nil restores the standard logger
+func SetLogSink(sink LogSink) {
+	logSink.Store(&sink)
+}
+
+// parseLogLevel maps a level name to its value, defaulting to info
+func parseLogLevel(name string) int32 {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return int32(i)
+		}
+	}
+	return levelInfo
+}
+
+func logAt(level int32, format string, v ...any) {
+	if level < logLevel.Load() {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if p, _ := logSink.Load().(*LogSink); p != nil && *p != nil {
+		(*p).OnLog(levelNames[level], msg)
+		return
+	}
+	log.Printf("[%s] %s", strings.ToUpper(levelNames[level]), msg)
+}
+
+func logDebug(format string, v ...any) { logAt(levelDebug, format, v...) }
+func logInfo(format string, v ...any)  { logAt(levelInfo, format, v...) }
+func logWarn(format string, v ...any)  { logAt(levelWarn, format, v...) }
+func logError(format string, v ...any) { logAt(levelError, format, v...) }
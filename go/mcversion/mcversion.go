@@ -0,0 +1,147 @@
+// Package mcversion holds the login differences between the Minecraft
+// protocol versions the client can speak: which packet IDs moved and when
+// the login gained new steps. The library and the standalone Windows build
+// both use it so they accept the same versions and log in the same way.
+package mcversion
+
+import "fmt"
+
+// Latest is the newest protocol version the login knows (1.21.9), the
+// default one to announce
+const Latest = 773
+
+const (
+	// Configuration is the first version (1.20.2) with the Configuration
+	// state between Login and Play
+	Configuration = 764
+	// LoginUUID is the first version (1.20.2) whose Login Start always
+	// carries the player UUID; before it a flag says whether one follows
+	LoginUUID = 764
+	// ResourcePackUUID is the first version (1.20.3) whose resource pack
+	// requests and responses carry the pack's UUID
+	ResourcePackUUID = 765
+)
+
+// UsesConfigurationState reports whether a server speaking protocol version
+// expects Login Acknowledged and the Configuration phase after Login Success.
+func UsesConfigurationState(version int) bool {
+	return version >= Configuration
+}
+
+// Packets are the IDs of the login packets that moved between protocol
+// versions. The play-state packets carrying the tunnel keep the same IDs
+// whatever the version.
+type Packets struct {
+	JoinGame int
+	Config   ConfigPackets // Used from 1.20.2 on; see UsesConfigurationState
+}
+
+// ConfigPackets are the Configuration state IDs. NoPacket marks a packet the
+// version doesn't have.
+type ConfigPackets struct {
+	CBCookieRequest   int
+	CBDisconnect      int
+	CBFinish          int
+	CBKeepAlive       int
+	CBPing            int
+	CBAddResourcePack int
+	CBKnownPacks      int
+	CBCodeOfConduct   int
+
+	SBClientInformation int
+	SBCookieResponse    int
+	SBPluginMsg         int
+	SBFinishAck         int
+	SBKeepAlive         int
+	SBPong              int
+	SBResourcePackResp  int
+	SBKnownPacks        int
+	SBAcceptConduct     int
+}
+
+// NoPacket never matches a packet read: packet readers reject negative IDs
+const NoPacket = -1
+
+// Config1202 is the Configuration state as 1.20.2 introduced it
+var Config1202 = ConfigPackets{
+	CBCookieRequest:   NoPacket,
+	CBDisconnect:      0x01,
+	CBFinish:          0x02,
+	CBKeepAlive:       0x03,
+	CBPing:            0x04,
+	CBAddResourcePack: 0x06,
+	CBKnownPacks:      NoPacket,
+	CBCodeOfConduct:   NoPacket,
+
+	SBClientInformation: 0x00,
+	SBCookieResponse:    NoPacket,
+	SBPluginMsg:         0x01,
+	SBFinishAck:         0x02,
+	SBKeepAlive:         0x03,
+	SBPong:              0x04,
+	SBResourcePackResp:  0x05,
+	SBKnownPacks:        NoPacket,
+	SBAcceptConduct:     NoPacket,
+}
+
+// Config1205 is the Configuration state from 1.20.5, which added cookies
+// and known packs; 1.21.9 appended the code of conduct.
+var Config1205 = ConfigPackets{
+	CBCookieRequest:   0x00,
+	CBDisconnect:      0x02,
+	CBFinish:          0x03,
+	CBKeepAlive:       0x04,
+	CBPing:            0x05,
+	CBAddResourcePack: 0x09,
+	CBKnownPacks:      0x0E,
+	CBCodeOfConduct:   NoPacket,
+
+	SBClientInformation: 0x00,
+	SBCookieResponse:    0x01,
+	SBPluginMsg:         0x02,
+	SBFinishAck:         0x03,
+	SBKeepAlive:         0x04,
+	SBPong:              0x05,
+	SBResourcePackResp:  0x06,
+	SBKnownPacks:        0x07,
+	SBAcceptConduct:     NoPacket,
+}
+
+// For returns the login packet IDs of a protocol version, false for a
+// version the login doesn't know.
+func For(version int) (Packets, bool) {
+	switch version {
+	case 763: // 1.20, 1.20.1: no Configuration state
+		return Packets{JoinGame: 0x28}, true
+	case 764: // 1.20.2
+		return Packets{0x29, Config1202}, true
+	case 765: // 1.20.3, 1.20.4: Resource Pack split into Add and Remove
+		config := Config1202
+		config.CBAddResourcePack = 0x07
+		return Packets{0x29, config}, true
+	case 766, 767: // 1.20.5 to 1.21.1
+		return Packets{0x2B, Config1205}, true
+	case 768, 769: // 1.21.2 to 1.21.4
+		return Packets{0x2C, Config1205}, true
+	case 770, 771, 772: // 1.21.5 to 1.21.8
+		return Packets{0x2B, Config1205}, true
+	case Latest:
+		config := Config1205
+		config.CBCodeOfConduct = 0x13
+		config.SBAcceptConduct = 0x09
+		return Packets{0x29, config}, true
+	}
+	return Packets{}, false
+}
+
+// Check rejects a protocol version the login would hang on, waiting for a
+// Join Game under an ID the server never sends. 0 is the default.
+func Check(version int) error {
+	if version <= 0 {
+		return nil
+	}
+	if _, ok := For(version); !ok {
+		return fmt.Errorf("protocol version %d is not supported (763 to %d)", version, Latest)
+	}
+	return nil
+}
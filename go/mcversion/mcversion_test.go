@@ -0,0 +1,24 @@
+package mcversion
+
+import "testing"
+
+func TestFor(t *testing.T) {
+	for version := 763; version <= Latest; version++ {
+		p, ok := For(version)
+		if !ok {
+			t.Errorf("For(%d) unknown, want IDs", version)
+			continue
+		}
+		if UsesConfigurationState(version) && p.Config.SBFinishAck == NoPacket {
+			t.Errorf("For(%d) has Configuration without Finish Acknowledged", version)
+		}
+		if err := Check(version); err != nil {
+			t.Errorf("Check(%d) = %v", version, err)
+		}
+	}
+	for _, version := range []int{340, 762, Latest + 1} {
+		if _, ok := For(version); ok || Check(version) == nil {
+			t.Errorf("protocol version %d accepted, want it refused", version)
+		}
+	}
+}
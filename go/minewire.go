@@ -6,22 +6,29 @@ package minewire
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/eycorsican/go-tun2socks/core"
 	"github.com/eycorsican/go-tun2socks/proxy/socks"
+
+	"minewire/localproxy"
+	"minewire/udpflow"
 )
 
 // ProtectCallback allows Android VpnService to protect the socket
@@ -36,48 +43,312 @@ func SetProtectCallback(cb ProtectCallback) {
 	protector = cb
 }
 
-// UpdateConfig updates the split tunneling rules
-func UpdateConfig(rulePaths string) {
-	st := GetSplitTunnelManager()
-	st.ClearRules()
+// StateCallback lets the host app observe tunnel state changes and errors
+type StateCallback interface {
+	OnStateChange(state string, message string)
+}
 
-	paths := strings.Split(rulePaths, ",")
-	for _, path := range paths {
-		if path == "" {
-			continue
-		}
-		if err := st.LoadRuleFile(path); err != nil {
-			log.Printf("Failed to load rule file %s: %v", path, err)
-		} else {
-			log.Printf("Loaded rule file: %s", path)
-		}
+var stateCallback StateCallback
+
+// SetStateCallback sets the callback for state notifications
+func SetStateCallback(cb StateCallback) {
+	stateCallback = cb
+}
+
+func notifyState(state, message string) {
+	if stateCallback != nil {
+		stateCallback.OnStateChange(state, message)
 	}
 }
 
-// Ping measures latency to the given server address (host:port).
+// UpdateConfig replaces the split tunneling rules with those in the
+// comma-separated rule files. Returns JSON {"loaded", "skipped", "error"};
+// on error the previous rules stay in effect.
+func UpdateConfig(rulePaths string) string {
+	res := struct {
+		Loaded  int    `json:"loaded"`
+		Skipped int    `json:"skipped"`
+		Error   string `json:"error,omitempty"`
+	}{}
+
+	loaded, skipped, err := GetSplitTunnelManager().UpdateRules(strings.Split(rulePaths, ","))
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Loaded, res.Skipped = loaded, skipped
+	}
+
+	b, _ := json.Marshal(res)
+	return string(b)
+}
+
+// Ping measures latency to the given server address (host:port), or to the
+// active server if serverAddr is empty.
 // Returns latency in milliseconds, or -1 on error.
 func Ping(serverAddr string) int64 {
+	latency, err := pingTCP(serverAddr)
+	if err != nil {
+		return -1
+	}
+	return latency.Milliseconds()
+}
+
+// PingApplication measures the Minecraft-level round trip: it runs the status
+// handshake and times a Ping/Pong exchange, which is what tunnel traffic
+// actually sees behind the disguise. An empty serverAddr means the active
+// server. Returns latency in milliseconds, or -1 on any error.
+func PingApplication(serverAddr string) int64 {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+	latency, err := pingStatus(serverAddr)
+	if err != nil {
+		return -1
+	}
+	return latency.Milliseconds()
+}
+
+// PingDetailed is Ping with the failure reason. Returns JSON
+// {"latencyMs", "ok", "error", "message"} where error is one of
+// "dns", "refused", "timeout" or "other".
+func PingDetailed(serverAddr string) string {
+	res := struct {
+		LatencyMs int64  `json:"latencyMs"`
+		OK        bool   `json:"ok"`
+		Error     string `json:"error,omitempty"`
+		Message   string `json:"message,omitempty"`
+	}{LatencyMs: -1}
+
+	latency, err := pingTCP(serverAddr)
+	if err != nil {
+		res.Error = classifyDialError(err)
+		res.Message = err.Error()
+	} else {
+		res.OK = true
+		res.LatencyMs = latency.Milliseconds()
+	}
+
+	b, _ := json.Marshal(res)
+	return string(b)
+}
+
+// PingStats summarizes a series of Ping probes. Latencies are in
+// milliseconds and are -1 when no probe succeeded.
+type PingStats struct {
+	Sent     int   `json:"sent"`
+	Received int   `json:"received"`
+	MinMs    int64 `json:"minMs"`
+	AvgMs    int64 `json:"avgMs"`
+	MaxMs    int64 `json:"maxMs"`
+	JitterMs int64 `json:"jitterMs"` // Mean deviation from AvgMs
+}
+
+const (
+	maxPingCount = 20
+	pingSpacing  = 200 * time.Millisecond
+)
+
+// PingN runs count TCP pings (at most 20) spaced pingSpacing apart and
+// summarizes them; failed probes are left out of the figures. Received tells
+// the caller how many succeeded, so a flaky link shows up even when the
+// average looks fine. An empty serverAddr means the active server.
+func PingN(serverAddr string, count int) *PingStats {
+	count = max(1, min(count, maxPingCount))
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+
+	var samples []time.Duration
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(pingSpacing)
+		}
+		if latency, err := pingTCP(serverAddr); err == nil {
+			samples = append(samples, latency)
+		}
+	}
+	return summarizePings(count, samples)
+}
+
+func summarizePings(sent int, samples []time.Duration) *PingStats {
+	st := &PingStats{Sent: sent, Received: len(samples), MinMs: -1, AvgMs: -1, MaxMs: -1, JitterMs: -1}
+	if len(samples) == 0 {
+		return st
+	}
+
+	var sum time.Duration
+	lo, hi := samples[0], samples[0]
+	for _, d := range samples {
+		sum += d
+		lo, hi = min(lo, d), max(hi, d)
+	}
+	avg := sum / time.Duration(len(samples))
+
+	var dev time.Duration
+	for _, d := range samples {
+		dev += (d - avg).Abs()
+	}
+
+	st.MinMs = lo.Milliseconds()
+	st.AvgMs = avg.Milliseconds()
+	st.MaxMs = hi.Milliseconds()
+	st.JitterMs = (dev / time.Duration(len(samples))).Milliseconds()
+	return st
+}
+
+func pingTCP(serverAddr string) (time.Duration, error) {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
 	start := time.Now()
 	conn, err := net.DialTimeout("tcp", serverAddr, 5*time.Second)
 	if err != nil {
-		return -1
+		return 0, err
 	}
 	conn.Close()
-	return time.Since(start).Milliseconds()
+	return time.Since(start), nil
+}
+
+// classifyDialError maps a dial error to a category the UI can explain
+func classifyDialError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return "timeout"
+		}
+		return "dns"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "refused") {
+		return "refused"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+// statusSlots counts the status probes running, so a UI scrolling through a
+// server list can't exhaust sockets. A probe waits while the running ones
+// reach the limit configured when it asked, so lowering the limit holds new
+// probes back until enough of the earlier ones are done.
+var statusSlots struct {
+	mu    sync.Mutex
+	inUse int
+}
+
+// statusSlotFreed is broadcast whenever a probe gives its slot back
+var statusSlotFreed = sync.NewCond(&statusSlots.mu)
+
+// acquireStatusSlot takes a probe slot, waiting for one unless failFast is
+// set. It returns the release function, or nil if no slot was available.
+func acquireStatusSlot(limit int, failFast bool) func() {
+	statusSlots.mu.Lock()
+	defer statusSlots.mu.Unlock()
+	for statusSlots.inUse >= limit {
+		if failFast {
+			return nil
+		}
+		statusSlotFreed.Wait()
+	}
+	statusSlots.inUse++
+	return func() {
+		statusSlots.mu.Lock()
+		statusSlots.inUse--
+		statusSlots.mu.Unlock()
+		// Waiters may have different limits; let each check its own
+		statusSlotFreed.Broadcast()
+	}
 }
 
 // GetServerStatus queries the server for MOTD, Icon, and Player count.
-// Returns a JSON string with the data, or an error JSON.
-func GetServerStatus(serverAddr string) string {
-	conn, err := net.DialTimeout("tcp", serverAddr, 5*time.Second)
+// Returns a ServerStatus as JSON, or an error JSON. stripColors removes §
+// formatting codes from the text fields. Successful results are cached for
+// StatusCacheTTLMs; see RefreshServerStatus. An empty serverAddr means the
+// active server.
+func GetServerStatus(serverAddr string, stripColors bool) string {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+	opts := getConfig().Options
+	if st, ok := statusCache.get(serverAddr, opts.statusCacheTTL()); ok {
+		return formatServerStatus(st, stripColors)
+	}
+	return fetchServerStatus(serverAddr, opts, stripColors)
+}
+
+// RefreshServerStatus is GetServerStatus without the cache: it always queries
+// the server, and stores the fresh result.
+func RefreshServerStatus(serverAddr string, stripColors bool) string {
+	if serverAddr == "" {
+		serverAddr = GetActiveServer()
+	}
+	return fetchServerStatus(serverAddr, getConfig().Options, stripColors)
+}
+
+func fetchServerStatus(serverAddr string, opts Options, stripColors bool) string {
+	st, err := queryAndCacheStatus(serverAddr, opts)
 	if err != nil {
 		return fmt.Sprintf(`{"error": "%s"}`, err.Error())
 	}
-	defer conn.Close()
+	return formatServerStatus(st, stripColors)
+}
+
+func queryAndCacheStatus(serverAddr string, opts Options) (ServerStatus, error) {
+	st, err := queryServerStatus(serverAddr, opts)
+	if err == nil && opts.statusCacheTTL() > 0 {
+		statusCache.put(serverAddr, st)
+	}
+	return st, err
+}
+
+func formatServerStatus(st ServerStatus, stripColors bool) string {
+	if stripColors {
+		st = st.withoutColors()
+	}
+	b, _ := json.Marshal(st)
+	return string(b)
+}
+
+// queryServerStatus runs the server list ping, falling back to the legacy
+// ping if the server doesn't speak the 1.7+ status protocol
+func queryServerStatus(serverAddr string, opts Options) (ServerStatus, error) {
+	release := acquireStatusSlot(opts.maxStatusQueries(), opts.StatusQueryFailFast)
+	if release == nil {
+		return ServerStatus{}, errors.New("too many concurrent status queries")
+	}
+	defer release()
+
+	conn, err := net.DialTimeout("tcp", serverAddr, statusTimeout)
+	if err != nil {
+		return ServerStatus{}, err
+	}
+	jsonStr, err := readStatusJSON(conn, bufio.NewReader(conn), serverAddr)
+	conn.Close()
+	if errors.Is(err, errStatusTimeout) {
+		// Pre-1.7 servers reject the handshake outright; one that stays
+		// silent is hung, and asking again would only double the wait
+		return ServerStatus{}, err
+	} else if err != nil {
+		if st, lerr := queryLegacyStatus(serverAddr); lerr == nil {
+			return st, nil
+		}
+		return ServerStatus{}, err
+	}
+	st, err := parseStatusJSON(jsonStr)
+	if err != nil {
+		return ServerStatus{}, errors.New("invalid status response")
+	}
+	return st, nil
+}
 
+// readStatusJSON sends the status handshake and request on conn and returns
+// the Status Response JSON, read through br
+func readStatusJSON(conn net.Conn, br *bufio.Reader, serverAddr string) (string, error) {
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		tcpConn.SetNoDelay(true)
 	}
+	conn.SetDeadline(time.Now().Add(statusTimeout))
 
 	// 1. Handshake State 1 (Status)
 	host, portStr, _ := net.SplitHostPort(serverAddr)
@@ -92,38 +363,46 @@ func GetServerStatus(serverAddr string) string {
 	WriteShort(buf, uint16(port)) // Port
 	WriteVarInt(buf, 1)           // State 1 (Status)
 	if err := WritePacket(conn, 0x00, buf.Bytes()); err != nil {
-		return fmt.Sprintf(`{"error": "%s"}`, err.Error())
+		return "", err
 	}
 
 	// 2. Status Request
 	if err := WritePacket(conn, 0x00, []byte{}); err != nil {
-		return fmt.Sprintf(`{"error": "%s"}`, err.Error())
+		return "", err
 	}
 
 	// 3. Read Response
-	br := bufio.NewReader(conn)
-
-	// Read Packet Length
-	_, err = ReadVarInt(br)
+	body, err := readPacketBody(br, maxStatusPacketLength)
 	if err != nil {
-		return fmt.Sprintf(`{"error": "Read Len: %s"}`, err.Error())
+		return "", statusReadError("Read Response", err)
 	}
+	r := bytes.NewReader(body)
+
 	// Read Packet ID
-	pid, err := ReadVarInt(br)
+	pid, err := ReadVarInt(r)
 	if err != nil {
-		return fmt.Sprintf(`{"error": "Read PID: %s"}`, err.Error())
+		return "", fmt.Errorf("Read PID: %s", err.Error())
 	}
 	if pid != 0x00 {
-		return fmt.Sprintf(`{"error": "Invalid PID: %d"}`, pid)
+		return "", fmt.Errorf("Invalid PID: %d", pid)
 	}
 
-	// Read JSON String
-	jsonStr, err := ReadString(br)
-	if err != nil {
-		return fmt.Sprintf(`{"error": "Read String: %s"}`, err.Error())
+	// Read JSON String; ReadString's chat-sized limit is too small for a
+	// status with a favicon, and the packet length already bounds it
+	n, err := ReadVarInt(r)
+	if err != nil || n < 0 || n > r.Len() {
+		return "", errors.New("invalid status response")
 	}
+	rest := body[len(body)-r.Len():]
+	jsonStr := string(rest[:n])
 
-	return jsonStr
+	// Fronts that aren't real Minecraft servers may answer with garbage; the
+	// UI expects JSON, so don't pass that through.
+	if !utf8.ValidString(jsonStr) || !json.Valid([]byte(jsonStr)) {
+		return "", errors.New("invalid status response")
+	}
+
+	return jsonStr, nil
 }
 
 func parsePort(s string) (int, error) {
@@ -149,20 +428,141 @@ func WriteShort(w io.Writer, v uint16) {
 // I see `ReadVarInt`, `WriteVarInt`, `WriteString`, `ReadString`, `WritePacket` in `go/protocol.go`
 // So I don't need to re-implement them if they are in the same package.
 
+// trafficCounter keeps two totals of the same traffic: session, zeroed by
+// every Start (and by StartVpn unless KeepTrafficCounters is set), and
+// lifetime, zeroed only by ResetStats.
+type trafficCounter struct {
+	session  atomic.Int64
+	lifetime atomic.Int64
+}
+
+func (c *trafficCounter) Add(n int64) {
+	c.session.Add(n)
+	c.lifetime.Add(n)
+}
+
 // Traffic counters
 var (
-	bytesUploaded   atomic.Int64
-	bytesDownloaded atomic.Int64
+	bytesUploaded   trafficCounter
+	bytesDownloaded trafficCounter
 )
 
-// GetTxBytes returns total bytes uploaded (Read from TUN)
+// GetTxBytes returns bytes uploaded this session (read from the TUN, or
+// received by the local proxy when no VPN is running)
 func GetTxBytes() int64 {
-	return bytesUploaded.Load()
+	return bytesUploaded.session.Load()
 }
 
-// GetRxBytes returns total bytes downloaded (Written to TUN)
+// GetRxBytes returns bytes downloaded this session (written to the TUN, or
+// sent by the local proxy when no VPN is running)
 func GetRxBytes() int64 {
-	return bytesDownloaded.Load()
+	return bytesDownloaded.session.Load()
+}
+
+// GetLifetimeTxBytes returns bytes uploaded since the library was loaded or
+// ResetStats was last called, across every Start and Stop
+func GetLifetimeTxBytes() int64 {
+	return bytesUploaded.lifetime.Load()
+}
+
+// GetLifetimeRxBytes returns bytes downloaded since the library was loaded
+// or ResetStats was last called, across every Start and Stop
+func GetLifetimeRxBytes() int64 {
+	return bytesDownloaded.lifetime.Load()
+}
+
+// ResetStats zeroes both the session and the lifetime traffic counters.
+func ResetStats() {
+	for _, c := range []*trafficCounter{&bytesUploaded, &bytesDownloaded} {
+		c.session.Store(0)
+		c.lifetime.Store(0)
+	}
+}
+
+// Stats is a snapshot of the traffic counters and the running tunnel
+type Stats struct {
+	TxBytes int64 `json:"txBytes"` // This session; see GetTxBytes
+	RxBytes int64 `json:"rxBytes"` // This session; see GetRxBytes
+
+	LifetimeTxBytes int64 `json:"lifetimeTxBytes"`
+	LifetimeRxBytes int64 `json:"lifetimeRxBytes"`
+
+	TxRate  int64  `json:"txRate"`  // Bytes per second over roughly the last rateWindow
+	RxRate  int64  `json:"rxRate"`  // Bytes per second over roughly the last rateWindow
+	Streams int64  `json:"streams"` // Proxied connections and datagrams in flight
+	Server  string `json:"server"`  // Active server address, empty unless connected
+}
+
+// GetStats returns the traffic counters, current rates, stream count and
+// active server in one call, for a live dashboard to poll.
+func GetStats() *Stats {
+	lifetimeTx, lifetimeRx := bytesUploaded.lifetime.Load(), bytesDownloaded.lifetime.Load()
+	// The lifetime counters only go back to zero on ResetStats, so rates
+	// don't dip when a session starts over
+	txRate, rxRate := trafficRates.sample(lifetimeTx, lifetimeRx)
+	return &Stats{
+		TxBytes:         bytesUploaded.session.Load(),
+		RxBytes:         bytesDownloaded.session.Load(),
+		LifetimeTxBytes: lifetimeTx,
+		LifetimeRxBytes: lifetimeRx,
+		TxRate:          txRate,
+		RxRate:          rxRate,
+		Streams:         openStreams.Load(),
+		Server:          GetActiveServer(),
+	}
+}
+
+// countingWriter adds every byte written through it to n, so totals are kept
+// even when the copy feeding it ends in an error.
+type countingWriter struct {
+	w io.Writer
+	n *trafficCounter
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countProxyTraffic reports whether the proxy handlers should feed the
+// traffic counters. With the VPN up everything already passes through the
+// TUN, which counts it, on its way to the local proxy.
+func countProxyTraffic() bool {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	return tunFile == nil
+}
+
+// countedWriters wraps the upload and download sides of a proxied
+// connection with the traffic counters when countProxyTraffic says so.
+func countedWriters(up, down io.Writer) (io.Writer, io.Writer) {
+	if !countProxyTraffic() {
+		return up, down
+	}
+	return countingWriter{up, &bytesUploaded}, countingWriter{down, &bytesDownloaded}
+}
+
+// heartbeat is bumped by the session and reader loops; see Heartbeat
+var heartbeat atomic.Int64
+
+func beat() {
+	heartbeat.Add(1)
+}
+
+// Heartbeat returns a counter that keeps increasing while the internal loops
+// are alive. A supervisor can poll it and restart the core if the value stops
+// advancing while the core is supposed to be running.
+func Heartbeat() int64 {
+	return heartbeat.Load()
+}
+
+// NormalizeProxyType maps a user supplied proxy type to "http" or "socks5",
+// the only two the client runs. Anything that isn't HTTP, including an empty
+// string, means SOCKS5. Front-ends should use the result for system proxy
+// settings so they always match what Start actually listens with.
+func NormalizeProxyType(proxyType string) string {
+	return localproxy.NormalizeProxyType(proxyType)
 }
 
 // IsRunning returns true if the VPN is running
@@ -176,25 +576,143 @@ func IsRunning() bool {
 var (
 	isRunning  bool
 	serverLock sync.Mutex
+	// runCtx is cancelled by Stop; the session, proxy and read loops of a
+	// Start all end with it.
+	runCtx     context.Context
+	runCancel  context.CancelFunc
 	listener   net.Listener
 	httpServer *http.Server
 	ew         core.LWIPStack
 	tunFile    *os.File // Store reference to close it on Stop
+	udpFlows   *udpflow.Table
 )
 
-// Config internal
-var cfg struct {
-	LocalPort     string
-	ServerAddress string
+// config holds the settings of the current Start call.
+type config struct {
+	LocalPort     string   // Full listen address, "host:port"
+	LocalAddress  string   // Host part of LocalPort
+	ServerAddress string   // As passed to Start
+	Servers       []string // ServerAddress split into the failover list
 	Password      string
 	ProxyType     string
+	SocksUser     string // SOCKS5 credentials; both empty means no auth
+	SocksPass     string
+
+	Options
 }
 
-// Start starts the SOCKS/HTTP proxy and tunnel connection.
-// Returns an error string or empty string on success.
-var readyChan chan struct{}
+// Config internal. Written under serverLock; background goroutines must read it
+// through getConfig to get a consistent snapshot.
+var cfg config
+
+// getConfig returns a copy of the current configuration.
+func getConfig() config {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	return cfg
+}
+
+// proxyReady is signaled once by the proxy goroutine: with the bound address
+// when the local listener is up, or with the error that prevented it.
+type proxyReady struct {
+	done chan struct{}
+	once sync.Once
+	addr net.Addr
+	err  error
+}
+
+func newProxyReady() *proxyReady {
+	return &proxyReady{done: make(chan struct{})}
+}
+
+func (r *proxyReady) signal(addr net.Addr, err error) {
+	r.once.Do(func() {
+		r.addr = addr
+		r.err = err
+		close(r.done)
+	})
+}
+
+// WaitForProxy blocks until the local proxy listener is bound, failed, or
+// timeoutMs elapsed. Returns an error string or empty string on success.
+func WaitForProxy(timeoutMs int64) string {
+	serverLock.Lock()
+	ready := proxyStarted
+	serverLock.Unlock()
+	if ready == nil {
+		return "not started"
+	}
+
+	select {
+	case <-ready.done:
+		if ready.err != nil {
+			return ready.err.Error()
+		}
+		if ready.addr == nil {
+			return "stopped before listening"
+		}
+		return ""
+	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+		return "timed out waiting for local proxy"
+	}
+}
+
+// GetListenPorts returns the ports the local proxy actually bound as JSON,
+// e.g. {"socksPort":1080}, which matters when LocalPort asked for port 0.
+// Returns {} if the proxy isn't listening (yet).
+func GetListenPorts() string {
+	serverLock.Lock()
+	ready := proxyStarted
+	proxyType := cfg.ProxyType
+	serverLock.Unlock()
 
-func Start(localPort, serverAddr, password, proxyType string) string {
+	ports := map[string]int{}
+	if ready != nil {
+		select {
+		case <-ready.done:
+			if tcpAddr, ok := ready.addr.(*net.TCPAddr); ok {
+				if proxyType == "http" {
+					ports["httpPort"] = tcpAddr.Port
+				} else {
+					ports["socksPort"] = tcpAddr.Port
+				}
+			}
+		default:
+		}
+	}
+	b, _ := json.Marshal(ports)
+	return string(b)
+}
+
+var proxyStarted *proxyReady
+
+// NormalizeLocalPort turns the accepted local port spellings ("1080",
+// ":1080", "127.0.0.1:1080", "[::1]:1080") into the canonical "host:port"
+// form, with an empty host if none was given.
+func NormalizeLocalPort(localPort string) (string, error) {
+	return localproxy.NormalizeLocalPort(localPort)
+}
+
+// splitServerList parses Start's comma separated server addresses
+func splitServerList(list string) []string {
+	var servers []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// Start starts the SOCKS/HTTP proxy and tunnel connection. serverAddr may be
+// a comma separated list of servers, tried in order on every connect; after
+// a drop the next server is tried first. The proxy listens
+// on localAddress (default 127.0.0.1; "0.0.0.0" for every interface) at
+// localPort. When socksUser or
+// socksPass is set, SOCKS clients must authenticate with them (RFC 1929);
+// leave both empty for StartVpn, as tun2socks connects without credentials.
+// Returns an error string or empty string on success.
+func Start(localPort, localAddress, serverAddr, password, proxyType, socksUser, socksPass string) string {
 	serverLock.Lock()
 	defer serverLock.Unlock()
 
@@ -202,47 +720,86 @@ func Start(localPort, serverAddr, password, proxyType string) string {
 		return "Already running"
 	}
 
-	cfg.LocalPort = localPort
-	cfg.ServerAddress = serverAddr
-	cfg.Password = password
-	cfg.ProxyType = proxyType
-	readyChan = make(chan struct{})
+	if password == "" && !cfg.AllowEmptyPassword {
+		return "password required"
+	}
+	warnWeakPassword(password)
+
+	listenAddr, err := localproxy.ResolveListenAddress(localAddress, localPort)
+	if err != nil {
+		return err.Error()
+	}
+	servers := splitServerList(serverAddr)
+	if len(servers) == 0 {
+		return "server address required"
+	}
+	if _, err := newAEAD(cfg.cipherName(), make([]byte, 32)); err != nil {
+		return err.Error()
+	}
+	if err := checkTransport(cfg.Options); err != nil {
+		return err.Error()
+	}
+	localAddress, _, _ = net.SplitHostPort(listenAddr)
+
+	cfg = config{
+		LocalPort:     listenAddr,
+		LocalAddress:  localAddress,
+		ServerAddress: serverAddr,
+		Servers:       servers,
+		Password:      password,
+		ProxyType:     NormalizeProxyType(proxyType),
+		SocksUser:     socksUser,
+		SocksPass:     socksPass,
+		Options:       cfg.Options,
+	}
+	conf := cfg
+	proxyStarted = newProxyReady()
+	ready := proxyStarted
 
 	// Reset existing sessions
 	CloseSession()
-
+	resetLatencyHistory()
+	clientConnectLog.reset(conf.connectLogSize())
+	bytesUploaded.session.Store(0)
+	bytesDownloaded.session.Store(0)
+	udpFlows = udpflow.NewTable(conf.udpIdleTimeout(), udpFlowFallback)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx, runCancel = ctx, cancel
 	isRunning = true
 
 	// Start tunnel maintenance goroutine (tunnel.go)
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Println("Recovered in maintainSession:", r)
+				logError("Recovered in maintainSession: %v", r)
 			}
 		}()
-		maintainSession()
+		maintainSession(ctx)
 	}()
 
 	// Start local proxy server goroutine
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				// log.Println("Recovered in proxy:", r)
+				logError("Recovered in proxy: %v", r)
 			}
 		}()
 		var err error
-		if cfg.ProxyType == "http" {
-			err = startHTTPProxy()
+		if conf.ProxyType == "http" {
+			err = startHTTPProxy(ctx, conf.LocalPort, ready)
 		} else {
-			err = startSOCKSProxy()
+			err = startSOCKSProxy(ctx, conf.LocalPort, ready)
 		}
+		// Unblocks waiters if the proxy never came up
+		ready.signal(nil, err)
 		if err != nil {
-			log.Printf("Proxy Error: %v", err)
+			logError("Proxy Error: %v", err)
 			Stop()
 		}
 	}()
 
-	// Note: We don't wait for readyChan here to avoid blocking gomobile context
+	// Note: We don't wait for readiness here to avoid blocking gomobile context
 	// The proxy will signal readiness asynchronously
 
 	return ""
@@ -253,13 +810,20 @@ func Start(localPort, serverAddr, password, proxyType string) string {
 func StartVpn(fd int) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Recovered in StartVpn:", r)
+			logError("Recovered in StartVpn: %v", r)
 		}
 	}()
 
 	// Create file from TUN file descriptor
 	serverLock.Lock()
 	tunFile = os.NewFile(uintptr(fd), "tun")
+	localPort := cfg.LocalPort
+	localAddress := cfg.LocalAddress
+	readyTimeout := cfg.proxyReadyTimeout()
+	keepCounters := cfg.KeepTrafficCounters
+	udpTimeout := cfg.udpIdleTimeout()
+	ready := proxyStarted
+	ctx := runCtx
 	serverLock.Unlock()
 
 	defer func() {
@@ -272,10 +836,26 @@ func StartVpn(fd int) {
 	}()
 
 	// Wait for local proxy to start
+	if ready == nil {
+		notifyState("error", "StartVpn called before Start")
+		return
+	}
+
+	// Wait for local proxy to start. Without it the VPN interface would be up
+	// but carry no traffic, so tell the host instead of returning silently.
 	select {
-	case <-readyChan:
-	case <-time.After(5 * time.Second):
-		log.Println("Proxy startup timeout")
+	case <-ready.done:
+		if ready.err != nil {
+			logError("Proxy failed to start: %v", ready.err)
+			notifyState("error", "Local proxy failed to start: "+ready.err.Error())
+			return
+		}
+		if ready.addr == nil {
+			return // Stopped before the proxy came up
+		}
+	case <-time.After(readyTimeout):
+		logError("Proxy startup timeout")
+		notifyState("error", fmt.Sprintf("Local proxy did not start within %v", readyTimeout))
 		return
 	}
 
@@ -299,54 +879,77 @@ func StartVpn(fd int) {
 	stack := core.NewLWIPStack()
 	ew = stack
 
-	portStr := strings.TrimPrefix(cfg.LocalPort, ":")
+	_, portStr, _ := net.SplitHostPort(localPort)
 	port := uint16(atoi(portStr))
-	socksTarget := "127.0.0.1"
+	if tcpAddr, ok := ready.addr.(*net.TCPAddr); ok {
+		port = uint16(tcpAddr.Port)
+	}
+	// tun2socks dials the proxy where Start bound it
+	socksTarget := localAddress
+	if ip := net.ParseIP(localAddress); ip == nil || ip.IsUnspecified() {
+		socksTarget = "127.0.0.1"
+	}
 
-	// Reset counters on start
-	bytesUploaded.Store(0)
-	bytesDownloaded.Store(0)
+	// Reset counters on start unless the host wants them kept
+	if !keepCounters {
+		bytesUploaded.session.Store(0)
+		bytesDownloaded.session.Store(0)
+	}
 
 	tcpHandler := socks.NewTCPHandler(socksTarget, port)
-	udpHandler := socks.NewUDPHandler(socksTarget, port, 30*time.Second)
+	udpHandler := socks.NewUDPHandler(socksTarget, port, udpTimeout)
 
-	core.RegisterTCPConnHandler(tcpHandler)
-	core.RegisterUDPConnHandler(udpHandler)
+	core.RegisterTCPConnHandler(killSwitchTCPHandler{tcpHandler})
+	core.RegisterUDPConnHandler(killSwitchUDPHandler{udpHandler})
 
 	// Start packet read loop
-	log.Println("StartVpn: Starting Read Loop")
+	logInfo("StartVpn: Starting Read Loop")
 
 	// Optimization: Cache tunFile locally.
 	// If Stop() is called, it will Close() this file, causing Read() to error.
 	f := tunFile
 
+	tunReadLoop(ctx, f, stack)
+	logInfo("StartVpn: Exited")
+}
+
+// tunReadLoop hands every packet read from the TUN device to the tun2socks
+// stack until the read fails, reusing buffers from packetBufPool.
+func tunReadLoop(ctx context.Context, f io.Reader, stack io.Writer) {
 	for {
-		// Allocate fresh buffer to avoid race conditions with tun2socks stack
-		buf := make([]byte, 1500)
+		bp := packetBufPool.Get().(*[]byte)
+		buf := *bp
 
 		n, err := f.Read(buf)
 		if err != nil {
+			packetBufPool.Put(bp)
 			// Log only if we are still running, otherwise it's expected shutdown
-			serverLock.Lock()
-			running := isRunning
-			serverLock.Unlock()
-			if running {
-				log.Printf("StartVpn Read Error: %v", err)
+			if ctx != nil && ctx.Err() == nil {
+				logError("StartVpn Read Error: %v", err)
 			} else {
-				log.Println("StartVpn: Stopping due to app shutdown")
+				logInfo("StartVpn: Stopping due to app shutdown")
 			}
-			break
+			return
 		}
 		if n > 0 {
 			bytesUploaded.Add(int64(n))
-			// Write to local stack variable which is safe
-			_, err = stack.Write(buf[:n])
-			if err != nil {
-				// log.Printf("Stack Write Error: %v", err)
+			if _, err := stack.Write(buf[:n]); err != nil {
+				logDebug("Stack Write Error: %v", err)
 			}
 		}
+		packetBufPool.Put(bp)
 	}
-	log.Println("StartVpn: Exited")
+}
+
+// packetBufPool holds the StartVpn read buffers. Reusing one is safe once
+// stack.Write returns: tun2socks copies TCP and fragmented packets into an
+// lwIP pbuf, and unfragmented UDP, which it only references, is handled
+// synchronously under the lwIP lock and copied before being proxied.
+var packetBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 1500)
+		return &b
+	},
 }
 
 func atoi(s string) int {
@@ -368,6 +971,7 @@ func Stop() {
 		return
 	}
 	isRunning = false
+	runCancel()
 
 	// Capture resources to close and nil them under lock
 	tf := tunFile
@@ -382,77 +986,116 @@ func Stop() {
 	stack := ew
 	ew = nil
 
+	proxyType := cfg.ProxyType
+	drainTimeout := time.Duration(cfg.StopDrainTimeoutMs) * time.Millisecond
+
+	flows := udpFlows
+	udpFlows = nil
+
 	// Release lock BEFORE closing resources to prevent deadlocks
 	// (e.g. ew.Close() triggering OutputFn which needs lock)
 	serverLock.Unlock()
 
-	// Close TUN file to break the StartVpn Read loop
-	if tf != nil {
-		tf.Close()
-	}
-
-	if cfg.ProxyType == "http" && hs != nil {
+	// Stop accepting first so draining only waits for existing connections
+	if proxyType == "http" && hs != nil {
 		hs.Close()
 	} else if l != nil {
 		l.Close()
 	}
 
+	if drainTimeout > 0 && !waitForStreams(drainTimeout) {
+		logWarn("Streams still active after %v, closing them", drainTimeout)
+	}
+
+	// Close TUN file to break the StartVpn Read loop
+	if tf != nil {
+		tf.Close()
+	}
+
 	if stack != nil {
 		stack.Close()
 	}
 
+	if flows != nil {
+		flows.Close()
+	}
+
 	CloseSession()
-	log.Println("Minewire stopped")
+	logInfo("Minewire stopped")
 }
 
-func startSOCKSProxy() error {
-	var err error
-	listener, err = net.Listen("tcp", cfg.LocalPort)
+func startSOCKSProxy(ctx context.Context, localPort string, ready *proxyReady) error {
+	l, err := net.Listen("tcp", localPort)
 	if err != nil {
 		return err
 	}
-	log.Println("Listening for SOCKS5 on " + cfg.LocalPort)
+
+	// Publish the listener for Stop(), but keep using the local variable so a
+	// concurrent Stop() setting listener = nil can't race with the accept loop.
+	serverLock.Lock()
+	if ctx.Err() != nil {
+		serverLock.Unlock()
+		l.Close()
+		return nil
+	}
+	listener = l
+	serverLock.Unlock()
+	logInfo("Listening for SOCKS5 on %s", l.Addr())
 
 	// Signal that proxy is ready
-	close(readyChan)
+	ready.signal(l.Addr(), nil)
 
 	for {
-		c, err := listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
-			// Check if we're shutting down
-			if !IsRunning() {
+			if ctx.Err() != nil {
 				return nil // Normal shutdown
 			}
-			// Additional check for closed connection error
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				return nil
-			}
 			return err
 		}
-		go handleSocks(c)
+		go handleSocks(ctx, c)
 	}
 }
 
-func startHTTPProxy() error {
-	httpServer = &http.Server{
-		Addr:    cfg.LocalPort,
+func startHTTPProxy(ctx context.Context, localPort string, ready *proxyReady) error {
+	// Bind before signaling readiness so the real port is known
+	l, err := net.Listen("tcp", localPort)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{
+		Addr:    localPort,
 		Handler: http.HandlerFunc(handleHTTP),
+		// Requests, and the relays they start, end with the run
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
-	log.Println("Listening for HTTP CONNECT on " + cfg.LocalPort)
+
+	serverLock.Lock()
+	if ctx.Err() != nil {
+		serverLock.Unlock()
+		l.Close()
+		return nil
+	}
+	httpServer = hs
+	serverLock.Unlock()
+	logInfo("Listening for HTTP CONNECT on %s", l.Addr())
 
 	// Signal that proxy is ready
-	close(readyChan)
+	ready.signal(l.Addr(), nil)
 
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		// Check if we're shutting down
-		if !IsRunning() {
-			return nil
+	if err := hs.Serve(l); err != http.ErrServerClosed {
+		if ctx.Err() != nil {
+			return nil // Normal shutdown
 		}
 		return err
 	}
 	return nil
 }
 
+// ParseConnectionLink splits an mw://password@server?params#name link into its
+// parts. Returns JSON {"name", "server", "password", "proxyType", "protocol",
+// "cipher"} plus any other query parameters as given, or an error JSON.
+// Settings missing from the link get their defaults.
 func ParseConnectionLink(link string) string {
 	u, err := url.Parse(link)
 	if err != nil {
@@ -465,18 +1108,39 @@ func ParseConnectionLink(link string) string {
 
 	password := u.User.Username()
 	server := u.Host
-	name := u.Fragment
 
-	if decodedName, err := url.QueryUnescape(name); err == nil {
+	// The name is query-escaped, so "+" means a space; decode it from the
+	// raw fragment so an escaped "+" survives
+	name := u.Fragment
+	if decodedName, err := url.QueryUnescape(u.EscapedFragment()); err == nil {
 		name = decodedName
 	}
 
-	res := map[string]string{
-		"name":     name,
-		"server":   server,
-		"password": password,
+	res := map[string]string{}
+	for k, v := range u.Query() {
+		res[k] = v[0]
+	}
+	res["name"] = name
+	res["server"] = server
+	res["password"] = password
+	res["proxyType"] = NormalizeProxyType(res["proxyType"])
+	if p, err := strconv.Atoi(res["protocol"]); err != nil || p <= 0 {
+		res["protocol"] = strconv.Itoa(PROTOCOL_VERSION)
 	}
+	res["cipher"] = linkCipher(res["cipher"])
 
 	b, _ := json.Marshal(res)
 	return string(b)
 }
+
+// linkCipher maps a link's cipher parameter to an Options.Cipher name,
+// accepting the short "aes" and "chacha20" forms
+func linkCipher(name string) string {
+	switch strings.ToLower(name) {
+	case "", "aes", "aes-gcm":
+		return cipherAESGCM
+	case "chacha20", "chacha20-poly1305":
+		return cipherChaCha20
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,92 @@
+package minewire
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+// tunSource is a TUN device that reads the same packet n times, then fails
+type tunSource struct {
+	packet []byte
+	n      int
+}
+
+func (s *tunSource) Read(b []byte) (int, error) {
+	if s.n == 0 {
+		return 0, io.EOF
+	}
+	s.n--
+	return copy(b, s.packet), nil
+}
+
+// stoppedCtx makes tunReadLoop treat the end of its source as a shutdown
+func stoppedCtx() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// BenchmarkTunReadLoop compares the pooled read loop with the fresh buffer
+// per packet it replaced.
+func BenchmarkTunReadLoop(b *testing.B) {
+	packet := make([]byte, 1400)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(packet)))
+		tunReadLoop(stoppedCtx(), &tunSource{packet: packet, n: b.N}, io.Discard)
+	})
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(packet)))
+		src := &tunSource{packet: packet, n: b.N}
+		for {
+			buf := make([]byte, 1500)
+			n, err := src.Read(buf)
+			if err != nil {
+				break
+			}
+			io.Discard.Write(buf[:n])
+		}
+	})
+}
+
+// The loop reuses its buffers: reading a packet costs no allocation.
+func TestTunReadLoopReusesBuffers(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool doesn't keep buffers under -race")
+	}
+	const packets = 1000
+	ctx := stoppedCtx()
+	packet := make([]byte, 1400)
+	src := &tunSource{packet: packet}
+	allocs := testing.AllocsPerRun(10, func() {
+		src.n = packets
+		tunReadLoop(ctx, src, io.Discard)
+	})
+	if perPacket := allocs / packets; perPacket >= 0.1 {
+		t.Errorf("%.2f allocations per packet, want the buffers reused", perPacket)
+	}
+}
+
+func TestEmptyPasswordRequiresOptIn(t *testing.T) {
+	srv := newFakeServer(t, "")
+	if msg := Start("127.0.0.1:0", "", srv.addr(), "", "socks5", "", ""); msg != "password required" {
+		t.Fatalf("Start with no password = %q, want it refused", msg)
+	}
+	if _, err := NewDialer(srv.addr(), ""); err == nil {
+		t.Error("NewDialer accepted an empty password")
+	}
+
+	if msg := SetOptions(`{"allowEmptyPassword": true}`); msg != "" {
+		t.Fatal(msg)
+	}
+	t.Cleanup(func() { SetOptions(`{}`) })
+	if msg := Start("127.0.0.1:0", "", srv.addr(), "", "socks5", "", ""); msg != "" {
+		t.Fatal(msg)
+	}
+	defer stopAfter(t)
+	waitFor(t, "connected", func() bool { return GetConnectionState() == "connected" })
+}
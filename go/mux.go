@@ -0,0 +1,244 @@
+package minewire
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Tunnel carries logical streams to the server over one disguised connection.
+// Each stream starts with the destination string, exactly as proxyToTunnel
+// writes it, regardless of which implementation is active.
+type Tunnel interface {
+	Open() (net.Conn, error)
+	IsClosed() bool
+	Close() error
+}
+
+// pinger is implemented by tunnels that can measure their round-trip time
+type pinger interface {
+	Ping() (time.Duration, error)
+	CloseChan() <-chan struct{}
+}
+
+// newTunnel starts the configured kind of tunnel over conn, the connection
+// a transport dialed. The tunnel reports stalls and drops to h.
+func newTunnel(conf config, conn net.Conn, h *connectHooks) (Tunnel, error) {
+	if conf.DisableMultiplexing {
+		return newSingleStreamTunnel(conn, h), nil
+	}
+
+	ymConf := yamux.DefaultConfig()
+	ymConf.EnableKeepAlive = false // See keepAlive
+	ymConf.ConnectionWriteTimeout = conf.writeTimeout()
+	ymConf.MaxStreamWindowSize = conf.streamWindowSize()
+	ymConf.StreamOpenTimeout = 30 * time.Second
+	ymConf.LogOutput = io.Discard
+	sess, err := yamux.Client(conn, ymConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t := &yamuxTunnel{Session: sess, hooks: h}
+	go t.keepAlive(conn, conf.keepAliveInterval())
+	return t, nil
+}
+
+// yamuxTunnel multiplexes any number of streams with yamux (the default).
+type yamuxTunnel struct {
+	*yamux.Session
+	hooks *connectHooks
+
+	openFailures atomic.Int32 // consecutive failed Opens
+}
+
+const (
+	// streamOpenTimeout bounds how long Open may block. yamux's own
+	// StreamOpenTimeout only starts once the SYN is sent; a session stuck on
+	// writes can block before that indefinitely.
+	streamOpenTimeout = 15 * time.Second
+	// maxOpenFailures consecutive failures mark a session as wedged
+	maxOpenFailures = 3
+)
+
+var errStreamOpenTimeout = errors.New("timed out opening tunnel stream")
+
+// stalledSessions counts sessions of Start's tunnel closed because they
+// stopped opening streams while yamux still considered them alive.
+var stalledSessions atomic.Int64
+
+// GetStalledSessionCount returns how many sessions were force-closed after
+// failing to open streams, i.e. "connected but nothing works" recoveries.
+func GetStalledSessionCount() int64 {
+	return stalledSessions.Load()
+}
+
+func (t *yamuxTunnel) Open() (net.Conn, error) {
+	type result struct {
+		stream net.Conn
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		s, err := t.Session.Open()
+		ch <- result{s, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			if t.openFailures.Add(1) >= maxOpenFailures {
+				t.closeStalled()
+			}
+			return nil, r.err
+		}
+		t.openFailures.Store(0)
+		return r.stream, nil
+	case <-time.After(streamOpenTimeout):
+		// Don't leak the stream if Open completes after all
+		go func() {
+			if r := <-ch; r.stream != nil {
+				r.stream.Close()
+			}
+		}()
+		t.closeStalled()
+		return nil, errStreamOpenTimeout
+	}
+}
+
+// closeStalled drops a session that yamux hasn't noticed is dead, so
+// maintainSession reconnects right away.
+func (t *yamuxTunnel) closeStalled() {
+	if t.IsClosed() {
+		return
+	}
+	logWarn("Tunnel session stalled, reconnecting")
+	t.hooks.stalled.Add(1)
+	t.Close()
+	t.hooks.wake()
+}
+
+// maxLateKeepAlives late pings in a row drop the session even while the
+// server keeps sending
+const maxLateKeepAlives = 4
+
+// keepAlive replaces yamux's keepalive, which closes the session, and every
+// stream on it, the first time a ping isn't answered within the write
+// timeout. On a congested link the pong can wait behind that much queued
+// data while the link is fine. A late ping counts as a dead link only if no
+// tunnel data arrived from the server while waiting for it either, as far
+// as conn can tell (see transportConn).
+//
+// The ping travels as plugin messages like any stream data, so this also
+// catches a half-dead tunnel: the TCP connection and the cover server are
+// fine, but the server side no longer handles our messages (say the cover
+// server restarted our "player"). Nothing else would notice, as the session
+// itself still looks open.
+func (t *yamuxTunnel) keepAlive(conn net.Conn, interval time.Duration) {
+	tc, _ := conn.(transportConn)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	late := 0
+	for {
+		select {
+		case <-t.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		sent := time.Now().UnixNano()
+		_, err := t.Ping()
+		if err == nil {
+			late = 0
+			continue
+		}
+		if t.IsClosed() {
+			return
+		}
+		late++
+		if tc != nil && tc.lastReadAt() > sent && late < maxLateKeepAlives {
+			logDebug("Keepalive late (%v), but the server is still sending", err)
+			continue
+		}
+		logWarn("Tunnel keepalive failed, reconnecting")
+		t.Close()
+		t.hooks.wake()
+		return
+	}
+}
+
+var errTunnelBusy = errors.New("single-stream tunnel already in use")
+
+// singleStreamTunnel carries exactly one stream directly over the
+// transport's connection, without yamux framing or window management. It is meant for
+// constrained devices that only forward a single connection, and needs a
+// server running in single-stream mode. Closing the stream closes the
+// tunnel; maintainSession then reconnects for the next one.
+type singleStreamTunnel struct {
+	conn       net.Conn
+	readerDone <-chan struct{} // Nil unless conn is a transportConn
+	hooks      *connectHooks
+
+	mu     sync.Mutex
+	opened bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSingleStreamTunnel(conn net.Conn, h *connectHooks) *singleStreamTunnel {
+	t := &singleStreamTunnel{conn: conn, hooks: h, closed: make(chan struct{})}
+	if tc, ok := conn.(transportConn); ok {
+		t.readerDone = tc.readerDone()
+	}
+	return t
+}
+
+func (t *singleStreamTunnel) Open() (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.IsClosed() {
+		return nil, net.ErrClosed
+	}
+	if t.opened {
+		return nil, errTunnelBusy
+	}
+	t.opened = true
+	return &singleStream{Conn: t.conn, tunnel: t}, nil
+}
+
+func (t *singleStreamTunnel) IsClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	case <-t.readerDone: // Reader loop exited, the connection is dead
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *singleStreamTunnel) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.conn.Close()
+		t.hooks.wake() // Reconnect now rather than after the retry sleep
+	})
+	return err
+}
+
+// singleStream is the one stream of a singleStreamTunnel
+type singleStream struct {
+	net.Conn
+	tunnel *singleStreamTunnel
+}
+
+func (s *singleStream) Close() error {
+	return s.tunnel.Close()
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package minewire
+
+const raceEnabled = false
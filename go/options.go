@@ -0,0 +1,456 @@
+package minewire
+
+import (
+	"encoding/json"
+	"maps"
+	"net"
+	"strings"
+	"time"
+
+	"minewire/mcversion"
+)
+
+// Options holds the optional tuning knobs of the client. Zero values mean
+// "use the default", so hosts only need to send the fields they care about.
+type Options struct {
+	// ProxyReadyTimeoutMs is how long StartVpn waits for the local proxy to
+	// bind before giving up (default 5000).
+	ProxyReadyTimeoutMs int64 `json:"proxyReadyTimeoutMs"`
+
+	// DebugPackets logs the ID and length of every packet the reader loop
+	// receives (rate-limited). Meant for diagnosing server version mismatches.
+	DebugPackets bool `json:"debugPackets"`
+
+	// KeepTrafficCounters stops StartVpn from zeroing the session Tx/Rx
+	// counters, so they add up across VPN restarts until the next Start.
+	KeepTrafficCounters bool `json:"keepTrafficCounters"`
+
+	// MaxStatusQueries caps how many GetServerStatus calls may be probing at
+	// once across all callers (default 4). Extra calls wait for a free slot,
+	// or fail immediately when StatusQueryFailFast is set.
+	MaxStatusQueries    int  `json:"maxStatusQueries"`
+	StatusQueryFailFast bool `json:"statusQueryFailFast"`
+
+	// HandshakeNextState is the "next state" sent in the login handshake.
+	// 2 (login, default) is what a client does when joining normally. 3
+	// (transfer, 1.20.5+) is what a client sends after a Transfer packet,
+	// which some proxy-fronted deployments expect instead. Anything else
+	// falls back to 2.
+	HandshakeNextState int `json:"handshakeNextState"`
+
+	// AllowEmptyPassword lets Start accept an empty password. The tunnel key
+	// is derived from the password, so an empty one gives a well-known key
+	// and the tunnel is effectively unencrypted. Off by default.
+	AllowEmptyPassword bool `json:"allowEmptyPassword"`
+
+	// UDPIdleTimeoutMs is how long an idle UDP flow (one client/destination
+	// pair) keeps its tunnel stream before it is reaped (default 30000). Also
+	// used as the tun2socks UDP session timeout.
+	UDPIdleTimeoutMs int64 `json:"udpIdleTimeoutMs"`
+
+	// MaxPluginMessageSize caps the sealed payload of one outgoing plugin
+	// message; larger flushes are split (default and maximum 32767, the
+	// vanilla serverbound limit; minimum 1024).
+	MaxPluginMessageSize int `json:"maxPluginMessageSize"`
+
+	// DisableMultiplexing carries a single stream directly over the
+	// connection instead of running yamux, for low-resource devices that only
+	// forward one connection at a time; every new stream costs a full
+	// reconnect. The mode is announced in the Login Start player UUID like
+	// the cipher. A server opts in by serving such logins without yamux;
+	// one without the mode must refuse them with a login disconnect, which
+	// the client reports, rather than expect yamux framing.
+	DisableMultiplexing bool `json:"disableMultiplexing"`
+
+	// TunnelDNS sends destination port 53 through the tunnel even when the
+	// split tunnel rules would bypass it, so DNS never leaks to the local
+	// network. UDP is always tunneled already.
+	TunnelDNS bool `json:"tunnelDNS"`
+
+	// StatusCacheTTLMs is how long a successful GetServerStatus result is
+	// reused for the same address (default 30000; negative disables caching).
+	StatusCacheTTLMs int64 `json:"statusCacheTtlMs"`
+
+	// DNSCacheTTLMs is how long a resolved destination name is reused
+	// (default 60000; negative disables caching). The system resolver
+	// doesn't expose record TTLs, so this applies to every name.
+	// DNSCacheSize bounds the number of cached names (default 1024).
+	DNSCacheTTLMs int64 `json:"dnsCacheTtlMs"`
+	DNSCacheSize  int   `json:"dnsCacheSize"`
+
+	// KillSwitch refuses every new connection, split tunnel bypasses
+	// included, while the tunnel is running but its session is down, so
+	// nothing goes out directly during a reconnect. The Windows front-end
+	// also leaves the system proxy set if the UI exits without stopping.
+	KillSwitch bool `json:"killSwitch"`
+
+	// Brand, when set, is announced in a plain minecraft:brand plugin message
+	// right after login (e.g. "vanilla" or "fabric"), exactly like a real
+	// client does. The server can't decrypt it and drops it.
+	Brand string `json:"brand"`
+
+	// UseTLS wraps the server connection in TLS before the Minecraft
+	// handshake, so a network observer sees TLS to what could be a
+	// Minecraft-over-TLS proxy rather than a Minecraft login in the clear.
+	// The server (or a front for it) must terminate TLS. TLSServerName is
+	// the SNI and the name the certificate must match; empty means the host
+	// of the server address.
+	UseTLS        bool   `json:"useTls"`
+	TLSServerName string `json:"tlsServerName"`
+
+	// Transport selects the disguise the tunnel travels in (see
+	// ObfuscationTransport): "minecraft" (default) or "websocket", which
+	// needs a server that accepts the tunnel over WebSocket.
+	Transport string `json:"transport"`
+
+	// WebSocketURL is the endpoint of the websocket transport, such as
+	// "wss://cdn.example.com/minecraft". Empty means wss to each server
+	// address at /minecraft; when set, it is used for every server.
+	// WebSocketHeaders are added to the upgrade request (Origin,
+	// User-Agent, a CDN's routing header, ...).
+	WebSocketURL     string            `json:"webSocketUrl"`
+	WebSocketHeaders map[string]string `json:"webSocketHeaders"`
+
+	// SpoofHost is the server address the Minecraft handshake advertises,
+	// as a player typing it into the client would (e.g. "play.example.net").
+	// Empty means the host actually dialed. Vanilla servers ignore the
+	// field; virtual-host proxies in front of the server route on it.
+	SpoofHost string `json:"spoofHost"`
+
+	// DataChannel is the plugin channel carrying tunnel data (default
+	// "minecraft:brand"). Changing it needs a server that accepts the channel.
+	DataChannel string `json:"dataChannel"`
+
+	// DisableNoise stops the once-a-second player position packets. It saves
+	// a little data on metered links, but a "player" that never moves is far
+	// easier to tell apart from a real client; yamux keepalives still keep
+	// the session up.
+	DisableNoise bool `json:"disableNoise"`
+
+	// ConnectLogSize is how many recent connection attempts GetConnectLog
+	// keeps (default 20).
+	ConnectLogSize int `json:"connectLogSize"`
+
+	// CloseUDPOnDisconnect ends SOCKS UDP associations when the tunnel
+	// session they started on drops, so clients re-associate after the
+	// reconnect rather than keep sending into a dead association.
+	CloseUDPOnDisconnect bool `json:"closeUdpOnDisconnect"`
+
+	// DisableNoDelay turns Nagle's algorithm back on for the server
+	// connection. MinecraftConn already batches writes (see FlushThreshold)
+	// into one plugin message, so Nagle mostly just adds latency; it may still
+	// help bulk transfers over links with a small MTU.
+	DisableNoDelay bool `json:"disableNoDelay"`
+
+	// FlushThreshold and FlushDelayMs control how tunnel writes are batched
+	// into plugin messages: once FlushThreshold bytes (default 4096) are
+	// buffered they go out at once, anything smaller after FlushDelayMs
+	// (default 5). A negative FlushDelayMs sends every write immediately,
+	// for interactive traffic (SSH, games) where even 5ms shows; a larger
+	// threshold and delay mean fewer, bigger messages for bulk transfers.
+	FlushThreshold int   `json:"flushThreshold"`
+	FlushDelayMs   int64 `json:"flushDelayMs"`
+
+	// StopDrainTimeoutMs makes Stop stop accepting connections and then wait
+	// up to this long for active streams to finish before closing the tunnel.
+	// 0 (default) closes everything immediately.
+	StopDrainTimeoutMs int64 `json:"stopDrainTimeoutMs"`
+
+	// WriteTimeoutMs is how long yamux waits for a frame to go out, or for a
+	// keepalive ping to come back, before giving up (default 15000). A longer
+	// timeout rides out congested links, but a dead one takes longer to
+	// notice and a stuck write holds its stream for longer. A late keepalive
+	// only drops the session if nothing else arrived from the server either.
+	WriteTimeoutMs int64 `json:"writeTimeoutMs"`
+
+	// StreamWindowSize is the most unacknowledged data, in bytes, one tunnel
+	// stream may have in flight each way (default 524288; minimum 262144,
+	// yamux's initial window; maximum 16777216). A stream's throughput is capped at about
+	// window / round trip, so links with a large bandwidth-delay product
+	// (satellite, long-haul) want more. Each stream can buffer up to a window
+	// of received data, so memory use grows with window × concurrent streams;
+	// memory-constrained devices want the minimum.
+	StreamWindowSize int `json:"streamWindowSize"`
+
+	// KeepAliveIntervalMs is how often the session is checked with a ping
+	// through the tunnel (default 30000). A dead or half-dead tunnel is
+	// rebuilt within about this plus WriteTimeoutMs; shorter costs a few
+	// more bytes while idle.
+	KeepAliveIntervalMs int64 `json:"keepAliveIntervalMs"`
+
+	// ReconnectBaseMs and ReconnectMaxMs bound the reconnect backoff: the
+	// first retry waits about ReconnectBaseMs (default 1000), doubling after
+	// each failure up to ReconnectMaxMs (default 30000). Raising them saves
+	// battery on mobile while the server is down.
+	ReconnectBaseMs int64 `json:"reconnectBaseMs"`
+	ReconnectMaxMs  int64 `json:"reconnectMaxMs"`
+
+	// Cipher is the tunnel AEAD: "aes-gcm" (default) or "chacha20-poly1305",
+	// which is faster on devices without AES instructions. The choice is
+	// announced inside the Login Start player UUID (see loginUUID), where
+	// it looks random without the password; the server has to support it.
+	Cipher string `json:"cipher"`
+
+	// KeyDerivation selects how the tunnel key is made from the password:
+	// 1 (default) is the original unsalted SHA-256, 2 is PBKDF2 salted with
+	// the random per-session Login Start player UUID, which also announces
+	// the choice (see loginUUID). 2 needs server support.
+	KeyDerivation int `json:"keyDerivation"`
+
+	// ProtocolVersion is the Minecraft protocol version sent in the
+	// handshake (default PROTOCOL_VERSION, 773 / 1.21.9), for servers pinned
+	// to another version: 763 (1.20) up to the default. It also picks the
+	// login and Configuration packet IDs; the play-state packets carrying
+	// the tunnel are not remapped.
+	ProtocolVersion int `json:"protocolVersion"`
+
+	// UsernamePattern picks the Login Start name: "derived" (default) is
+	// "Player" plus a hash of the key, shared by everyone using the password;
+	// "random" makes a fresh name per session; anything else is used as the
+	// name itself. Names must be 3-16 characters of [A-Za-z0-9_]; an invalid
+	// one falls back to "derived". Servers that authenticate by checking the
+	// derived name refuse any other, so "random" and fixed names only work
+	// with a server configured not to validate names.
+	UsernamePattern string `json:"usernamePattern"`
+
+	// MaxUploadBps and MaxDownloadBps cap proxied traffic in bytes per
+	// second, shared by all streams (0, the default, is unlimited). They
+	// take effect immediately, including on open connections.
+	MaxUploadBps   int64 `json:"maxUploadBps"`
+	MaxDownloadBps int64 `json:"maxDownloadBps"`
+
+	// IdleTimeoutMs closes a proxied TCP connection once no bytes moved in
+	// either direction for this long (default 300000). Negative disables it.
+	IdleTimeoutMs int64 `json:"idleTimeoutMs"`
+
+	// LogLevel is the least severe level logged: "debug", "info" (default),
+	// "warn" or "error". Packet traces and per-connection messages are
+	// debug. Takes effect immediately.
+	LogLevel string `json:"logLevel"`
+}
+
+// SetOptions merges the given JSON object into the current options.
+// Fields missing from the JSON keep their previous values. Changes apply to
+// the next Start (or the next reconnect for per-session settings).
+// Returns an error string or empty string on success.
+func SetOptions(optionsJSON string) string {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	o := cfg.Options
+	// Unmarshal merges into a non-nil map; the live one is shared with
+	// every getConfig snapshot
+	o.WebSocketHeaders = maps.Clone(cfg.WebSocketHeaders)
+	if err := json.Unmarshal([]byte(optionsJSON), &o); err != nil {
+		return "Invalid options: " + err.Error()
+	}
+	if err := mcversion.Check(o.ProtocolVersion); err != nil {
+		return "Invalid options: " + err.Error()
+	}
+	if err := checkTransport(o); err != nil {
+		return "Invalid options: " + err.Error()
+	}
+	cfg.Options = o
+	applyRateLimits(o)
+	logLevel.Store(parseLogLevel(o.LogLevel))
+	return ""
+}
+
+func (o Options) maxStatusQueries() int {
+	if o.MaxStatusQueries <= 0 {
+		return 4
+	}
+	return o.MaxStatusQueries
+}
+
+func (o Options) handshakeNextState() int {
+	if o.HandshakeNextState == 3 {
+		return 3
+	}
+	return 2
+}
+
+func (o Options) writeTimeout() time.Duration {
+	if o.WriteTimeoutMs <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(o.WriteTimeoutMs) * time.Millisecond
+}
+
+func (o Options) keepAliveInterval() time.Duration {
+	if o.KeepAliveIntervalMs <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(o.KeepAliveIntervalMs) * time.Millisecond
+}
+
+func (o Options) flushThreshold() int {
+	if o.FlushThreshold <= 0 {
+		return 4096
+	}
+	return o.FlushThreshold
+}
+
+// flushDelay returns 0 when every write should be flushed immediately
+func (o Options) flushDelay() time.Duration {
+	if o.FlushDelayMs < 0 {
+		return 0
+	}
+	if o.FlushDelayMs == 0 {
+		return 5 * time.Millisecond
+	}
+	return time.Duration(o.FlushDelayMs) * time.Millisecond
+}
+
+const (
+	// minStreamWindow is yamux's initial stream window; it rejects anything
+	// smaller as a maximum
+	minStreamWindow = 256 * 1024
+	maxStreamWindow = 16 * 1024 * 1024
+)
+
+func (o Options) streamWindowSize() uint32 {
+	if o.StreamWindowSize <= 0 {
+		return 512 * 1024
+	}
+	return uint32(min(max(o.StreamWindowSize, minStreamWindow), maxStreamWindow))
+}
+
+func (o Options) udpIdleTimeout() time.Duration {
+	if o.UDPIdleTimeoutMs <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(o.UDPIdleTimeoutMs) * time.Millisecond
+}
+
+// maxPluginMessageData is the vanilla limit for serverbound plugin message data
+const maxPluginMessageData = 32767
+
+func (o Options) maxPluginMessageSize() int {
+	if o.MaxPluginMessageSize <= 0 || o.MaxPluginMessageSize > maxPluginMessageData {
+		return maxPluginMessageData
+	}
+	return max(o.MaxPluginMessageSize, 1024)
+}
+
+func (o Options) proxyReadyTimeout() time.Duration {
+	if o.ProxyReadyTimeoutMs <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(o.ProxyReadyTimeoutMs) * time.Millisecond
+}
+
+func (o Options) statusCacheTTL() time.Duration {
+	if o.StatusCacheTTLMs < 0 {
+		return 0
+	}
+	if o.StatusCacheTTLMs == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(o.StatusCacheTTLMs) * time.Millisecond
+}
+
+func (o Options) dnsCacheTTL() time.Duration {
+	if o.DNSCacheTTLMs < 0 {
+		return 0
+	}
+	if o.DNSCacheTTLMs == 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(o.DNSCacheTTLMs) * time.Millisecond
+}
+
+func (o Options) dnsCacheSize() int {
+	if o.DNSCacheSize <= 0 {
+		return 1024
+	}
+	return o.DNSCacheSize
+}
+
+func (o Options) dataChannel() string {
+	if o.DataChannel == "" {
+		return "minecraft:brand"
+	}
+	return o.DataChannel
+}
+
+// handshakeServerHost is the host written in the handshake when connecting
+// to addr
+func (o Options) handshakeServerHost(addr string) string {
+	if o.SpoofHost != "" {
+		return o.SpoofHost
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (o Options) connectLogSize() int {
+	if o.ConnectLogSize <= 0 {
+		return 20
+	}
+	return o.ConnectLogSize
+}
+
+func (o Options) reconnectBase() time.Duration {
+	if o.ReconnectBaseMs <= 0 {
+		return time.Second
+	}
+	return time.Duration(o.ReconnectBaseMs) * time.Millisecond
+}
+
+func (o Options) reconnectMax() time.Duration {
+	if o.ReconnectMaxMs <= 0 {
+		return max(30*time.Second, o.reconnectBase())
+	}
+	return max(time.Duration(o.ReconnectMaxMs)*time.Millisecond, o.reconnectBase())
+}
+
+func (o Options) cipherName() string {
+	if o.Cipher == "" {
+		return cipherAESGCM
+	}
+	return strings.ToLower(o.Cipher)
+}
+
+func (o Options) transportName() string {
+	if o.Transport == "" {
+		return transportMinecraft
+	}
+	return strings.ToLower(o.Transport)
+}
+
+func (o Options) kdfVersion() int {
+	if o.KeyDerivation == kdfPBKDF2 {
+		return kdfPBKDF2
+	}
+	return kdfLegacy
+}
+
+func (o Options) protocolVersion() int {
+	if o.ProtocolVersion <= 0 {
+		return PROTOCOL_VERSION
+	}
+	return o.ProtocolVersion
+}
+
+// packets returns the login packet IDs for protocolVersion, which SetOptions
+// only accepts when mcversion.For knows it
+func (o Options) packets() mcversion.Packets {
+	p, ok := mcversion.For(o.protocolVersion())
+	if !ok {
+		p, _ = mcversion.For(PROTOCOL_VERSION)
+	}
+	return p
+}
+
+func (o Options) idleTimeout() time.Duration {
+	if o.IdleTimeoutMs < 0 {
+		return 0
+	}
+	if o.IdleTimeoutMs == 0 {
+		return 300 * time.Second
+	}
+	return time.Duration(o.IdleTimeoutMs) * time.Millisecond
+}
@@ -0,0 +1,73 @@
+package minewire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// The largest packet WritePacket accepts is MaxPacketLength bytes of ID and
+// data, which still reads back; one byte more is refused before anything is
+// written.
+func TestWritePacketMaxLength(t *testing.T) {
+	const pid = PID_SB_PluginMsg // One-byte VarInt
+	tests := []struct {
+		name    string
+		dataLen int
+		wantErr error
+	}{
+		{"at the limit", MaxPacketLength - 1, nil},
+		{"one over", MaxPacketLength, ErrPacketTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{0x5A}, tt.dataLen)
+			var out bytes.Buffer
+			err := WritePacket(&out, pid, data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("WritePacket = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if out.Len() != 0 {
+					t.Errorf("%d bytes written for a refused packet", out.Len())
+				}
+				return
+			}
+
+			if !bytes.HasPrefix(out.Bytes(), []byte{0xFF, 0xFF, 0x7F}) {
+				t.Errorf("length prefix % x, want the 3-byte VarInt of %d", out.Bytes()[:3], MaxPacketLength)
+			}
+			gotPID, got, err := readRawPacket(bufio.NewReader(&out), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotPID != pid || !bytes.Equal(got, data) {
+				t.Errorf("read back packet 0x%02X with %d bytes, want 0x%02X with %d", gotPID, len(got), pid, len(data))
+			}
+		})
+	}
+}
+
+// With compression on, the Data Length field counts towards the limit too.
+func TestWriteCompressedPacketMaxLength(t *testing.T) {
+	const threshold = MaxPacketLength + 1 // Sent uncompressed, Data Length 0
+	var out bytes.Buffer
+	if err := WriteCompressedPacket(&out, threshold, PID_SB_PluginMsg, make([]byte, MaxPacketLength-2)); err != nil {
+		t.Fatalf("at the limit: %v", err)
+	}
+	out.Reset()
+	err := WriteCompressedPacket(&out, threshold, PID_SB_PluginMsg, make([]byte, MaxPacketLength-1))
+	if !errors.Is(err, ErrPacketTooLarge) || out.Len() != 0 {
+		t.Errorf("one over: %v with %d bytes written, want ErrPacketTooLarge and nothing", err, out.Len())
+	}
+}
+
+// A length prefix past MaxPacketLength is refused before the body is read.
+func TestReadPacketBodyRejectsOversizedLength(t *testing.T) {
+	var in bytes.Buffer
+	WriteVarInt(&in, MaxPacketLength+1)
+	if _, err := readPacketBody(bufio.NewReader(&in), MaxPacketLength); err == nil {
+		t.Error("readPacketBody accepted a length over MaxPacketLength")
+	}
+}
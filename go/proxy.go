@@ -4,14 +4,27 @@
 package minewire
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"minewire/localproxy"
+	"minewire/udpflow"
 )
 
 var dialer = &net.Dialer{
@@ -26,10 +39,107 @@ var dialer = &net.Dialer{
 	},
 }
 
-func handleSocks(localConn net.Conn) {
+// SOCKS5 reply codes (RFC 1928)
+const (
+	socksRepSuccess          = 0x00
+	socksRepGeneralFailure   = 0x01
+	socksRepNotAllowed       = 0x02
+	socksRepNetUnreachable   = 0x03
+	socksRepHostUnreachable  = 0x04
+	socksRepConnRefused      = 0x05
+	socksRepTTLExpired       = 0x06
+	socksRepCmdNotSupported  = 0x07
+	socksRepAtypNotSupported = 0x08
+)
+
+// SOCKS5 authentication methods
+const (
+	socksMethodNoAuth   = 0x00
+	socksMethodUserPass = 0x02
+)
+
+// socksAuthenticate runs the RFC 1929 username/password sub-negotiation and
+// reports whether the client may continue.
+func socksAuthenticate(conn net.Conn, user, pass string) bool {
+	// VER(1) ULEN(1) UNAME PLEN(1) PASSWD
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil || hdr[0] != 0x01 {
+		return false
+	}
+	uname := make([]byte, int(hdr[1]))
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(conn, hdr[:1]); err != nil {
+		return false
+	}
+	passwd := make([]byte, int(hdr[0]))
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare(uname, []byte(user)) == 1
+	passOK := subtle.ConstantTimeCompare(passwd, []byte(pass)) == 1
+	if !userOK || !passOK {
+		conn.Write([]byte{0x01, 0x01})
+		drainConn(conn)
+		return false
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return err == nil
+}
+
+// socksReply writes a SOCKS5 reply with an all-zero IPv4 bound address
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{0x05, rep, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReject sends a failure reply and drains whatever the client already
+// sent. Closing a socket with unread data makes the kernel send a RST, which
+// can destroy the reply before the client reads it.
+func socksReject(conn net.Conn, rep byte) {
+	if err := socksReply(conn, rep); err != nil {
+		return
+	}
+	drainConn(conn)
+}
+
+// socksFailureCode picks the reply for a failed dialDest so clients can tell
+// the tunnel being down from the destination failing. Streams through the
+// tunnel only fail locally; the server's own dial result isn't reported back.
+func socksFailureCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errKillSwitch):
+		return socksRepNotAllowed
+	case errors.Is(err, errNoSession), errors.Is(err, yamux.ErrSessionShutdown):
+		return socksRepNetUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(err.Error(), "refused"):
+		return socksRepConnRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socksRepHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksRepNetUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksRepTTLExpired
+	}
+	return socksRepGeneralFailure
+}
+
+func drainConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, io.LimitReader(conn, 64*1024))
+}
+
+func handleSocks(ctx context.Context, localConn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in handleSocks:", r)
+			logError("Recovered in handleSocks: %v", r)
 		}
 		localConn.Close()
 	}()
@@ -39,19 +149,39 @@ func handleSocks(localConn net.Conn) {
 	if _, err := io.ReadFull(localConn, buf[:2]); err != nil {
 		return
 	}
+	if buf[0] != 0x05 {
+		return
+	}
 	nMethods := int(buf[1])
 	if _, err := io.ReadFull(localConn, buf[:nMethods]); err != nil {
 		return
 	}
-	localConn.Write([]byte{0x05, 0x00})
+	// Username/password (0x02) when credentials are configured, else no auth
+	conf := getConfig()
+	requireAuth := conf.SocksUser != "" || conf.SocksPass != ""
+	method := byte(socksMethodNoAuth)
+	if requireAuth {
+		method = socksMethodUserPass
+	}
+	if bytes.IndexByte(buf[:nMethods], method) < 0 {
+		// No acceptable methods
+		localConn.Write([]byte{0x05, 0xFF})
+		drainConn(localConn)
+		return
+	}
+	localConn.Write([]byte{0x05, method})
+	if requireAuth && !socksAuthenticate(localConn, conf.SocksUser, conf.SocksPass) {
+		return
+	}
 
 	if _, err := io.ReadFull(localConn, buf[:4]); err != nil {
 		return
 	}
 
-	// 0x01 = CONNECT, 0x03 = UDP ASSOCIATE
+	// 0x01 = CONNECT, 0x02 = BIND, 0x03 = UDP ASSOCIATE
 	cmd := buf[1]
-	if cmd != 0x01 && cmd != 0x03 {
+	if cmd != 0x01 && cmd != 0x02 && cmd != 0x03 {
+		socksReject(localConn, socksRepCmdNotSupported)
 		return
 	}
 
@@ -59,45 +189,76 @@ func handleSocks(localConn net.Conn) {
 	switch buf[3] {
 	case 0x01:
 		ip := make([]byte, 4)
-		io.ReadFull(localConn, ip)
+		if _, err := io.ReadFull(localConn, ip); err != nil {
+			return
+		}
 		targetAddr = net.IP(ip).String()
 	case 0x03:
 		l := make([]byte, 1)
-		io.ReadFull(localConn, l)
+		if _, err := io.ReadFull(localConn, l); err != nil {
+			return
+		}
 		domain := make([]byte, int(l[0]))
-		io.ReadFull(localConn, domain)
+		if _, err := io.ReadFull(localConn, domain); err != nil {
+			return
+		}
 		targetAddr = string(domain)
 	case 0x04:
 		ip := make([]byte, 16)
-		io.ReadFull(localConn, ip)
+		if _, err := io.ReadFull(localConn, ip); err != nil {
+			return
+		}
 		targetAddr = net.IP(ip).String()
+	default:
+		socksReject(localConn, socksRepAtypNotSupported)
+		return
 	}
 
 	portBuf := make([]byte, 2)
-	io.ReadFull(localConn, portBuf)
+	if _, err := io.ReadFull(localConn, portBuf); err != nil {
+		return
+	}
 	port := binary.BigEndian.Uint16(portBuf)
-	fullDest := fmt.Sprintf("%s:%d", targetAddr, port)
-
-	if cmd == 0x03 {
+	fullDest := net.JoinHostPort(targetAddr, strconv.Itoa(int(port)))
+
+	switch cmd {
+	case 0x02:
+		// BIND needs the server to listen and open a stream back for the
+		// inbound connection, but the tunnel has no such message: every
+		// server-opened stream is a control stream. Say so explicitly
+		// rather than hang up, so the client can fall back (e.g. FTP PASV).
+		logDebug("SOCKS BIND %s: not supported by the tunnel", fullDest)
+		socksReject(localConn, socksRepCmdNotSupported)
+	case 0x03:
+		if killSwitchEngaged() {
+			socksReject(localConn, socksRepNotAllowed)
+			return
+		}
 		handleUDPAssociate(localConn)
-	} else {
-		proxyToTunnel(localConn, fullDest, true)
+	default:
+		proxyToTunnel(ctx, localConn, fullDest, true)
 	}
 }
 
 func handleUDPAssociate(localConn net.Conn) {
 	// 1. Start a UDP listener on a random port
-	udpListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	udpListener, err := net.ListenPacket("udp", localproxy.UDPRelayAddr(localConn.LocalAddr()))
 	if err != nil {
-		localConn.Write([]byte{0x05, 0x01, 0, 1, 0, 0, 0, 0, 0, 0})
+		socksReject(localConn, socksRepGeneralFailure)
 		return
 	}
 	defer udpListener.Close()
 
 	// 2. Send Success Reply with the Bound Address/Port
 	addr := udpListener.LocalAddr().(*net.UDPAddr)
-	reply := []byte{0x05, 0x00, 0, 0x01} // VER, REP, RSV, ATYP(IPv4)
-	reply = append(reply, addr.IP.To4()...)
+	reply := []byte{0x05, 0x00, 0} // VER, REP, RSV
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		reply = append(reply, 0x01) // ATYP(IPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, 0x04) // ATYP(IPv6)
+		reply = append(reply, addr.IP.To16()...)
+	}
 	portBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(portBytes, uint16(addr.Port))
 	reply = append(reply, portBytes...)
@@ -109,6 +270,12 @@ func handleUDPAssociate(localConn net.Conn) {
 		udpListener.Close() // Close UDP listener when TCP closes
 	}()
 
+	if getConfig().CloseUDPOnDisconnect {
+		done := make(chan struct{})
+		defer close(done)
+		go watchAssociateSession(done, localConn, udpListener)
+	}
+
 	// 4. Handle UDP Packets
 	buf := make([]byte, 65535)
 	for {
@@ -162,70 +329,203 @@ func handleUDPAssociate(localConn net.Conn) {
 			continue
 		}
 
-		payload := buf[pos:n]
+		// Copy: buf is reused by the next ReadFrom while the send runs
+		addrHdr := append([]byte(nil), buf[3:pos]...)
+		payload := append([]byte(nil), buf[pos:n]...)
 
 		// Forward to Tunnel
-		go sendUDPOverTunnel(dest, payload, udpListener, clientAddr)
+		go sendUDPOverTunnel(dest, addrHdr, payload, udpListener, clientAddr)
 	}
 }
 
-func sendUDPOverTunnel(dest string, data []byte, udpListener net.PacketConn, clientAddr net.Addr) {
+// watchAssociateSession ends a UDP associate once the tunnel session it
+// started on is gone, so the client re-associates after the reconnect instead
+// of sending into a dead association.
+func watchAssociateSession(done <-chan struct{}, localConn net.Conn, udpListener net.PacketConn) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var bound Tunnel
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		current := currentSession()
+
+		if bound == nil {
+			bound = current // Not connected yet; bind to the first session seen
+			continue
+		}
+		if current != bound || bound.IsClosed() {
+			udpListener.Close()
+			localConn.Close()
+			return
+		}
+	}
+}
+
+// activeStreams counts proxied connections and datagrams in flight, so Stop
+// can let them finish when draining is enabled. openStreams is the same count
+// in a form that can be read, for GetStats.
+var (
+	activeStreams sync.WaitGroup
+	openStreams   atomic.Int64
+)
+
+// trackStream registers a proxied connection or datagram; call the returned
+// func when it ends.
+func trackStream() func() {
+	activeStreams.Add(1)
+	openStreams.Add(1)
+	return func() {
+		openStreams.Add(-1)
+		activeStreams.Done()
+	}
+}
+
+// waitForStreams waits for activeStreams to reach zero, or for timeout.
+func waitForStreams(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		activeStreams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+var errNoSession = errors.New("tunnel session not established")
+
+// droppedUDPDatagrams counts datagrams discarded for being too large to frame
+// or to deliver back to the client.
+var droppedUDPDatagrams atomic.Int64
+
+// GetDroppedUDPDatagrams returns how many oversized UDP datagrams were dropped
+func GetDroppedUDPDatagrams() int64 {
+	return droppedUDPDatagrams.Load()
+}
+
+// sendUDPOverTunnel relays one datagram on its flow; replies come back
+// asynchronously. addrHdr is the ATYP, DST.ADDR and DST.PORT of the client's
+// request header, echoed back in the replies.
+func sendUDPOverTunnel(dest string, addrHdr, data []byte, udpListener net.PacketConn, clientAddr net.Addr) {
+	defer trackStream()()
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in sendUDPOverTunnel:", r)
+			logError("Recovered in sendUDPOverTunnel: %v", r)
 		}
 	}()
 
-	sessionLock.Lock()
-	sess := session
-	sessionLock.Unlock()
-	if sess == nil {
+	if host, _, _ := net.SplitHostPort(dest); GetBlocklist().IsBlocked(host) {
+		return
+	}
+	// The length prefix is a uint16; never let it wrap and desync the stream
+	if len(data) > udpflow.MaxPayload {
+		droppedUDPDatagrams.Add(1)
 		return
 	}
 
-	// Open stream with "udp:" prefix
-	stream, err := sess.Open()
-	if err != nil {
+	serverLock.Lock()
+	flows := udpFlows
+	serverLock.Unlock()
+	if flows == nil {
 		return
 	}
-	defer stream.Close()
 
-	destBuf := new(bytes.Buffer)
-	WriteString(destBuf, "udp:"+dest)
-	stream.Write(destBuf.Bytes())
+	deliver := func(respData []byte) {
+		// Send back to Client (Wrap in SOCKS UDP Header)
+		// RSV(2) + FRAG(1) + the request's ATYP/ADDR/PORT (the reply's source) + DATA
+		respHeader := append([]byte{0, 0, 0}, addrHdr...)
+		if len(respHeader)+len(respData) > udpflow.MaxPayload {
+			droppedUDPDatagrams.Add(1)
+			return
+		}
+		if countProxyTraffic() {
+			bytesDownloaded.Add(int64(len(respData)))
+		}
+		udpListener.WriteTo(append(respHeader, respData...), clientAddr)
+	}
 
-	// Send Data (Length + Bytes)
-	if err := binary.Write(stream, binary.BigEndian, uint16(len(data))); err != nil {
+	if flows.PerDatagram() {
+		stream, err := openUDPStream(udpflow.DatagramPrefix + dest)
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		respData, err := udpflow.Exchange(stream, data)
+		if err != nil {
+			return
+		}
+		if countProxyTraffic() {
+			bytesUploaded.Add(int64(len(data)))
+		}
+		deliver(respData)
 		return
 	}
-	if _, err := stream.Write(data); err != nil {
+
+	// Replies go back through this associate's socket, so it is part of the key
+	key := udpListener.LocalAddr().String() + "|" + clientAddr.String() + "|" + dest
+	flow, err := flows.Acquire(key, func() (net.Conn, error) {
+		return openUDPStream(udpflow.FlowPrefix + dest)
+	}, deliver)
+	if err != nil {
 		return
 	}
+	defer flows.Release(flow)
 
-	// Wait for Response (with timeout)
-	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
-
-	// Read Response Length
-	var respLen uint16
-	if err := binary.Read(stream, binary.BigEndian, &respLen); err != nil {
+	if err := flow.Send(data); err != nil {
+		flows.Remove(key, flow)
 		return
 	}
+	if countProxyTraffic() {
+		bytesUploaded.Add(int64(len(data)))
+	}
+}
 
-	respData := make([]byte, respLen)
-	if _, err := io.ReadFull(stream, respData); err != nil {
-		return
+// openUDPStream opens a tunnel stream for target, a udpflow prefix and the
+// destination
+func openUDPStream(target string) (net.Conn, error) {
+	sess := currentSession()
+	if sess == nil {
+		return nil, errNoSession
+	}
+	stream, err := sess.Open()
+	if err != nil {
+		return nil, err
 	}
+	destBuf := new(bytes.Buffer)
+	WriteString(destBuf, target)
+	if _, err := stream.Write(destBuf.Bytes()); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
 
-	// Send back to Client (Wrap in SOCKS UDP Header)
-	// RSV(2) + FRAG(1) + ATYP(1) + 0.0.0.0 + 0 + DATA
-	// We cheat a bit and don't put the real source addr because tun2socks doesn't care much
-	respHeader := []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
-	udpListener.WriteTo(append(respHeader, respData...), clientAddr)
+// udpFlowFallback reports a server that closed a UDP flow without replying
+func udpFlowFallback() {
+	logWarn("Server closed a UDP flow without replying; it may predate %q streams, so UDP uses a stream per datagram until the next connect", udpflow.FlowPrefix)
 }
 
 func handleHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodConnect {
 		dest := r.Host
+		if host, _, _ := net.SplitHostPort(dest); GetBlocklist().IsBlocked(host) {
+			http.Error(w, "Destination blocked", http.StatusForbidden)
+			return
+		}
+		// The 200 goes out before the tunnel is dialed, so refuse here
+		if killSwitchEngaged() {
+			http.Error(w, errKillSwitch.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		hijacker, ok := w.(http.Hijacker)
 		if !ok {
 			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
@@ -237,65 +537,214 @@ func handleHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-		proxyToTunnel(clientConn, dest, false)
+		proxyToTunnel(r.Context(), clientConn, dest, false)
 	} else {
-		http.Error(w, "Only CONNECT method supported", http.StatusMethodNotAllowed)
+		forwardHTTP(w, r)
 	}
 }
 
-func proxyToTunnel(localConn net.Conn, dest string, isSocks bool) {
+// hopHeaders apply to a single connection and are never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// forwardHTTP relays a plain absolute-form request ("GET http://host/path").
+// Every request gets its own connection and is sent with Connection: close,
+// so the response ends when the origin hangs up; keep-alive with the client
+// is left to net/http.
+func forwardHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "Only CONNECT and absolute http:// requests supported", http.StatusBadRequest)
+		return
+	}
+	host, port := r.URL.Hostname(), r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	if GetBlocklist().IsBlocked(host) {
+		http.Error(w, "Destination blocked", http.StatusForbidden)
+		return
+	}
+
+	defer trackStream()()
+
+	remote, err := dialDest(net.JoinHostPort(host, port))
+	if errors.Is(err, errKillSwitch) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	// Request.Write sends the origin-form request line ("GET /path HTTP/1.1")
+	out := r.Clone(r.Context())
+	removeHopHeaders(out.Header)
+	out.Close = true
+	up, down := countedWriters(remote, w)
+	up, down = limitedWriters(r.Context(), up, down)
+	if err := out.Write(up); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(remote), out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(down, resp.Body)
+}
+
+func proxyToTunnel(ctx context.Context, localConn net.Conn, dest string, isSocks bool) {
+	defer trackStream()()
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered in proxyToTunnel:", r)
+			logError("Recovered in proxyToTunnel: %v", r)
 		}
 	}()
 
 	host, _, _ := net.SplitHostPort(dest)
-	// Check Split Tunnel
-	if GetSplitTunnelManager().ShouldBypass(host) {
-		// Route Direct
-		// fmt.Printf("Direct Route: %s\n", dest)
-		remoteConn, err := dialer.Dial("tcp", dest)
-		if err != nil {
-			// fmt.Printf("Direct Dial Failed: %v\n", err)
-			return // Or fallback? No, direct fail means fail.
+	if GetBlocklist().IsBlocked(host) {
+		if isSocks {
+			socksReject(localConn, socksRepNotAllowed)
 		}
-		defer remoteConn.Close()
+		return
+	}
 
+	remote, err := dialDest(dest)
+	if err != nil {
 		if isSocks {
-			localConn.Write([]byte{0x05, 0x00, 0, 1, 0, 0, 0, 0, 0, 0})
+			socksReject(localConn, socksFailureCode(err))
 		}
-
-		go io.Copy(remoteConn, localConn)
-		io.Copy(localConn, remoteConn)
 		return
 	}
+	defer remote.Close()
 
-	sessionLock.Lock()
-	sess := session
-	sessionLock.Unlock()
+	if isSocks {
+		socksReply(localConn, socksRepSuccess)
+	}
 
-	if sess == nil {
-		if isSocks {
-			localConn.Write([]byte{0x05, 0x01, 0, 1, 0, 0, 0, 0, 0, 0})
+	up, down := countedWriters(remote, localConn)
+	up, down = limitedWriters(ctx, up, down)
+	up, down, stop := watchIdle(up, down, getConfig().idleTimeout(), localConn, remote)
+	defer stop()
+	go io.Copy(up, localConn)
+	io.Copy(down, remote)
+}
+
+// watchIdle wraps both directions of a relay and closes the connections once
+// no bytes moved either way for timeout, so a half-open client (gone without
+// a FIN) doesn't pin its tunnel stream forever. Call stop when the relay ends.
+// A timeout <= 0 disables the watch.
+func watchIdle(up, down io.Writer, timeout time.Duration, conns ...net.Conn) (io.Writer, io.Writer, func()) {
+	if timeout <= 0 {
+		return up, down, func() {}
+	}
+
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(max(timeout/4, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, last.Load())) >= timeout {
+					for _, c := range conns {
+						c.Close()
+					}
+					return
+				}
+			}
 		}
-		return
+	}()
+
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	return activityWriter{up, &last}, activityWriter{down, &last}, stop
+}
+
+// activityWriter records the time of every write in last
+type activityWriter struct {
+	w    io.Writer
+	last *atomic.Int64
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.last.Store(time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// dialDest connects to dest directly when split tunneling bypasses it and
+// over a new tunnel stream otherwise. Domains are resolved before the rules
+// are checked. DNS may be pinned to the tunnel so lookups never leak even
+// when the resolver's IP is in a bypassed range.
+func dialDest(dest string) (net.Conn, error) {
+	if killSwitchEngaged() {
+		return nil, errKillSwitch
+	}
+	host, port, _ := net.SplitHostPort(dest)
+	if port == "53" && getConfig().TunnelDNS {
+		return openStream(dest)
+	}
+	if ip, ok := GetSplitTunnelManager().bypassAddr(host); ok {
+		return dialer.Dial("tcp", net.JoinHostPort(ip, port))
 	}
+	return openStream(dest)
+}
 
-	stream, err := sess.Open()
-	if err != nil {
-		return
+// openStream opens a tunnel stream and sends the destination on it. Callers
+// only report success once this returns, i.e. once dest actually went out.
+func openStream(dest string) (net.Conn, error) {
+	sess := currentSession()
+	if sess == nil {
+		return nil, errNoSession
 	}
-	defer stream.Close()
+	return openStreamOn(sess, dest)
+}
 
+// openStreamOn is openStream over a given tunnel
+func openStreamOn(t Tunnel, dest string) (net.Conn, error) {
+	stream, err := t.Open()
+	if err != nil {
+		return nil, err
+	}
 	destBuf := new(bytes.Buffer)
 	WriteString(destBuf, dest)
-	stream.Write(destBuf.Bytes())
-
-	if isSocks {
-		localConn.Write([]byte{0x05, 0x00, 0, 1, 0, 0, 0, 0, 0, 0})
+	if _, err := stream.Write(destBuf.Bytes()); err != nil {
+		stream.Close()
+		return nil, err
 	}
-
-	go io.Copy(stream, localConn)
-	io.Copy(localConn, stream)
+	return stream, nil
 }
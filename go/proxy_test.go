@@ -0,0 +1,191 @@
+package minewire
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socksExchange runs handleSocks on one end of a pipe, writes req from the
+// other and returns the first n bytes handleSocks answers with. With n = 0
+// it checks handleSocks hung up without answering.
+func socksExchange(t *testing.T, req []byte, n int) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleSocks(context.Background(), server)
+		close(done)
+	}()
+	// handleSocks may stop reading part way; the rest goes with the pipe
+	go client.Write(req)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, n)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if n == 0 {
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after the greeting = %v, want EOF", err)
+		}
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleSocks didn't return")
+	}
+	return got
+}
+
+// setSocksCredentials configures SOCKS5 auth for the test
+func setSocksCredentials(t *testing.T, user, pass string) {
+	serverLock.Lock()
+	cfg.SocksUser, cfg.SocksPass = user, pass
+	serverLock.Unlock()
+	t.Cleanup(func() {
+		serverLock.Lock()
+		cfg.SocksUser, cfg.SocksPass = "", ""
+		serverLock.Unlock()
+	})
+}
+
+// socksReplyBytes is what socksReply sends for rep
+func socksReplyBytes(rep byte) []byte {
+	return []byte{0x05, rep, 0, 1, 0, 0, 0, 0, 0, 0}
+}
+
+func TestHandleSocksRejections(t *testing.T) {
+	noAuth := []byte{0x05, 0x01, socksMethodNoAuth}
+	userPass := []byte{0x05, 0x01, socksMethodUserPass}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name string
+		auth bool // Server requires user "u", password "p"
+		req  []byte
+		want []byte
+	}{
+		{
+			name: "SOCKS4 greeting",
+			req:  []byte{0x04, 0x01, 0x00, 0x50, 127, 0, 0, 1, 0},
+			want: nil,
+		},
+		{
+			name: "no acceptable method",
+			req:  userPass,
+			want: []byte{0x05, 0xFF},
+		},
+		{
+			name: "no auth offered when required",
+			auth: true,
+			req:  noAuth,
+			want: []byte{0x05, 0xFF},
+		},
+		{
+			name: "wrong password",
+			auth: true,
+			req:  cat(userPass, []byte{0x01, 1, 'u', 1, 'x'}),
+			want: []byte{0x05, socksMethodUserPass, 0x01, 0x01},
+		},
+		{
+			name: "bad auth version",
+			auth: true,
+			req:  cat(userPass, []byte{0x02, 1, 'u', 1, 'p'}),
+			want: []byte{0x05, socksMethodUserPass},
+		},
+		{
+			name: "unknown command",
+			req:  cat(noAuth, []byte{0x05, 0x09, 0x00, 0x01, 127, 0, 0, 1, 0, 80}),
+			want: cat([]byte{0x05, 0x00}, socksReplyBytes(socksRepCmdNotSupported)),
+		},
+		{
+			name: "BIND",
+			req:  cat(noAuth, []byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 80}),
+			want: cat([]byte{0x05, 0x00}, socksReplyBytes(socksRepCmdNotSupported)),
+		},
+		{
+			name: "unknown address type",
+			req:  cat(noAuth, []byte{0x05, 0x01, 0x00, 0x05, 127, 0, 0, 1, 0, 80}),
+			want: cat([]byte{0x05, 0x00}, socksReplyBytes(socksRepAtypNotSupported)),
+		},
+		{
+			name: "CONNECT without a tunnel",
+			req:  cat(noAuth, []byte{0x05, 0x01, 0x00, 0x03, 11}, []byte("example.com"), []byte{0, 80}),
+			want: cat([]byte{0x05, 0x00}, socksReplyBytes(socksRepNetUnreachable)),
+		},
+		{
+			name: "CONNECT over IPv6 without a tunnel",
+			req:  cat(noAuth, []byte{0x05, 0x01, 0x00, 0x04}, net.IPv6loopback, []byte{0, 80}),
+			want: cat([]byte{0x05, 0x00}, socksReplyBytes(socksRepNetUnreachable)),
+		},
+		{
+			name: "truncated request",
+			req:  cat(noAuth, []byte{0x05, 0x01, 0x00}),
+			want: []byte{0x05, 0x00},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.auth {
+				setSocksCredentials(t, "u", "p")
+			}
+			got := socksExchange(t, tt.req, len(tt.want))
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("reply = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// The right credentials get through to the request stage.
+func TestHandleSocksAuthenticates(t *testing.T) {
+	setSocksCredentials(t, "u", "p")
+	req := []byte{0x05, 0x01, socksMethodUserPass, 0x01, 1, 'u', 1, 'p',
+		0x05, 0x09, 0x00, 0x01, 127, 0, 0, 1, 0, 80}
+	want := append([]byte{0x05, socksMethodUserPass, 0x01, 0x00}, socksReplyBytes(socksRepCmdNotSupported)...)
+	got := socksExchange(t, req, len(want))
+	if !bytes.Equal(got, want) {
+		t.Errorf("reply = % x, want % x", got, want)
+	}
+}
+
+// A client that reached the proxy over ::1 is told to send its datagrams to
+// ::1 too.
+func TestUDPAssociateRepliesWithClientFamily(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			handleSocks(context.Background(), c)
+		}
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte{0x05, 0x01, socksMethodNoAuth, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	reply := make([]byte, 2+4+16+2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0x00 || reply[5] != 0x04 {
+		t.Fatalf("reply = % x, want success with an IPv6 address", reply)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[6:22]), Port: int(reply[22])<<8 | int(reply[23])}
+	if !relay.IP.Equal(net.IPv6loopback) || relay.Port == 0 {
+		t.Errorf("relay at %v, want ::1 and a port", relay)
+	}
+}
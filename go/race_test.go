@@ -0,0 +1,6 @@
+//go:build race
+
+package minewire
+
+// raceEnabled is set under -race, which makes sync.Pool drop items at random
+const raceEnabled = true
@@ -0,0 +1,77 @@
+package minewire
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// uploadLimiter and downloadLimiter cap proxied traffic across all streams
+// together; both are unlimited until Options set a rate.
+var (
+	uploadLimiter   = rate.NewLimiter(rate.Inf, 0)
+	downloadLimiter = rate.NewLimiter(rate.Inf, 0)
+)
+
+// applyRateLimits updates the shared limiters; streams already running pick
+// up the new rate on their next write.
+func applyRateLimits(o Options) {
+	setRate(uploadLimiter, o.MaxUploadBps)
+	setRate(downloadLimiter, o.MaxDownloadBps)
+}
+
+func setRate(l *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	// One second's worth of burst, so a cap never stalls a single write
+	l.SetBurst(int(bps))
+	l.SetLimit(rate.Limit(bps))
+}
+
+// limitedWriter waits for the limiter before every write, in pieces no
+// larger than its burst. ctx ends the waits, so Stop doesn't leave relays
+// blocked on a slow limit.
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rate.Limiter
+}
+
+// chunk is how much of n bytes one WaitN may ask for at the current rate
+func (lw limitedWriter) chunk(n int) int {
+	if lw.l.Limit() == rate.Inf {
+		return n
+	}
+	return min(n, lw.l.Burst())
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := lw.chunk(len(p))
+		if err := lw.l.WaitN(lw.ctx, n); err != nil {
+			// A lower rate set between chunk and WaitN shrank the burst
+			// under n; size the piece again
+			if lw.ctx.Err() == nil && lw.chunk(n) < n {
+				continue
+			}
+			return written, err
+		}
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// limitedWriters wraps the upload and download sides of a proxied
+// connection with the shared rate limiters, waiting until ctx is done.
+func limitedWriters(ctx context.Context, up, down io.Writer) (io.Writer, io.Writer) {
+	return limitedWriter{ctx, up, uploadLimiter}, limitedWriter{ctx, down, downloadLimiter}
+}
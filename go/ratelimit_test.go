@@ -0,0 +1,65 @@
+package minewire
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// pieceWriter records the size of every write
+type pieceWriter struct{ pieces []int }
+
+func (w *pieceWriter) Write(p []byte) (int, error) {
+	w.pieces = append(w.pieces, len(p))
+	return len(p), nil
+}
+
+func TestLimitedWriterSplitsToBurst(t *testing.T) {
+	l := rate.NewLimiter(rate.Inf, 0)
+	setRate(l, 4)
+	l.SetLimit(1e9) // Keep the burst of 4 without the wait
+	w := &pieceWriter{}
+	n, err := limitedWriter{context.Background(), w, l}.Write(make([]byte, 10))
+	if n != 10 || err != nil {
+		t.Fatalf("Write = %d, %v; want 10, nil", n, err)
+	}
+	for _, p := range w.pieces {
+		if p > 4 {
+			t.Errorf("pieces %v, want none over the burst of 4", w.pieces)
+			break
+		}
+	}
+
+	setRate(l, 0)
+	w.pieces = nil
+	limitedWriter{context.Background(), w, l}.Write(make([]byte, 10))
+	if len(w.pieces) != 1 {
+		t.Errorf("unlimited pieces %v, want one write", w.pieces)
+	}
+}
+
+// Cancelling the run ends a write waiting on a slow limit.
+func TestLimitedWriterStopsWithContext(t *testing.T) {
+	l := rate.NewLimiter(rate.Inf, 0)
+	setRate(l, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := limitedWriter{ctx, &pieceWriter{}, l}.Write(make([]byte, 10))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Write = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write kept waiting after cancel")
+	}
+}
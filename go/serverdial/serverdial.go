@@ -0,0 +1,145 @@
+// Package serverdial opens the connection to a tunnel server: a happy
+// eyeballs TCP dial, optionally wrapped in TLS. The library and the
+// standalone Windows build both use it so they connect the same way.
+package serverdial
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	serverDialTimeout   = 10 * time.Second       // Whole budget, resolving included
+	attemptDelay        = 250 * time.Millisecond // RFC 8305 Connection Attempt Delay
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// Dial connects to addr happy-eyeballs style (RFC 8305): it resolves
+// the name, interleaves IPv6 and IPv4 addresses and starts a new attempt every
+// attemptDelay (or as soon as one fails) until one connects. A dead address
+// family then costs a quarter second instead of the whole timeout.
+func Dial(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, serverDialTimeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = interleaveFamilies(ips)
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	var d net.Dialer
+	start := func(ip net.IPAddr) {
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- result{conn, err}
+		}()
+	}
+	// Late winners of a lost race still need closing
+	drain := func(n int) {
+		go func() {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}()
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+	started, pending := 0, 0
+	var firstErr error
+	for {
+		var nextC <-chan time.Time
+		if started < len(ips) {
+			nextC = next.C
+		}
+		select {
+		case <-nextC:
+			start(ips[started])
+			started++
+			pending++
+			next.Reset(attemptDelay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				drain(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if started < len(ips) {
+				next.Reset(0)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-ctx.Done():
+			drain(pending)
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			return nil, firstErr
+		}
+	}
+}
+
+// interleaveFamilies reorders ips to alternate between address families,
+// starting with the family the resolver preferred
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	if len(ips) == 0 {
+		return ips
+	}
+	var same, other []net.IPAddr
+	first := ips[0].IP.To4() == nil
+	for _, ip := range ips {
+		if (ip.IP.To4() == nil) == first {
+			same = append(same, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	out := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(same) || i < len(other); i++ {
+		if i < len(same) {
+			out = append(out, same[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out
+}
+
+// WrapTLS runs a TLS client handshake on conn, for servers behind a
+// Minecraft-over-TLS front, so an observer sees TLS instead of a Minecraft
+// login. serverName is sent as SNI and checked against the certificate; an
+// empty one means the host part of addr. conn is closed if the handshake
+// fails.
+func WrapTLS(ctx context.Context, conn net.Conn, addr, serverName string) (net.Conn, error) {
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12})
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return tc, nil
+}
@@ -0,0 +1,23 @@
+package serverdial
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	var ips []net.IPAddr
+	for _, s := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1"} {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "2001:db8::3"}
+	got := interleaveFamilies(ips)
+	if len(got) != len(want) {
+		t.Fatalf("interleaveFamilies = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].IP.String() != want[i] {
+			t.Fatalf("interleaveFamilies = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package minewire
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// serverListVersion is bumped if the export format changes incompatibly
+const serverListVersion = 1
+
+// ServerEntry is one saved server in an exported server list
+type ServerEntry struct {
+	Name      string `json:"name"`
+	Server    string `json:"server"`
+	Password  string `json:"password"`
+	ProxyType string `json:"proxyType"`
+	Link      string `json:"link,omitempty"`
+}
+
+type serverList struct {
+	Version int           `json:"version"`
+	Servers []ServerEntry `json:"servers"`
+}
+
+// BuildConnectionLink is the inverse of ParseConnectionLink: it produces an
+// mw://password@server#name link with the password and name escaped. server
+// must be host:port. Returns an empty string if it isn't.
+func BuildConnectionLink(name, server, password string) string {
+	if !validServerAddr(server) {
+		return ""
+	}
+	link := "mw://" + url.User(password).String() + "@" + server
+	if name != "" {
+		link += "#" + url.QueryEscape(name)
+	}
+	return link
+}
+
+// validServerAddr reports whether s is a host:port with a usable port
+func validServerAddr(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p <= 65535
+}
+
+// ExportServers takes a JSON array of {name, server, password, proxyType}
+// entries and returns the normalized list as {"version": 1, "servers": [...]}
+// with a connection link per entry, or an error JSON if any entry is invalid.
+func ExportServers(serversJSON string) string {
+	var entries []ServerEntry
+	if err := json.Unmarshal([]byte(serversJSON), &entries); err != nil {
+		return fmt.Sprintf(`{"error": "Invalid server list: %s"}`, err.Error())
+	}
+	for i := range entries {
+		if err := normalizeServerEntry(&entries[i]); err != nil {
+			return fmt.Sprintf(`{"error": "Server %d: %s"}`, i+1, err.Error())
+		}
+	}
+
+	b, _ := json.Marshal(serverList{Version: serverListVersion, Servers: entries})
+	return string(b)
+}
+
+// ImportServers reads a list made by ExportServers (or a bare JSON array of
+// entries). An entry may carry only a link, which is parsed with
+// ParseConnectionLink. Invalid entries are skipped and counted; the result is
+// {"servers": [...], "skipped": n} or an error JSON.
+func ImportServers(data string) string {
+	var list serverList
+	trimmed := strings.TrimSpace(data)
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal([]byte(trimmed), &list.Servers); err != nil {
+			return fmt.Sprintf(`{"error": "Invalid server list: %s"}`, err.Error())
+		}
+	} else {
+		if err := json.Unmarshal([]byte(trimmed), &list); err != nil {
+			return fmt.Sprintf(`{"error": "Invalid server list: %s"}`, err.Error())
+		}
+		if list.Version > serverListVersion {
+			return fmt.Sprintf(`{"error": "Unsupported server list version %d"}`, list.Version)
+		}
+	}
+
+	servers := make([]ServerEntry, 0, len(list.Servers))
+	skipped := 0
+	for _, e := range list.Servers {
+		if e.Server == "" && e.Link != "" {
+			var parsed map[string]string
+			json.Unmarshal([]byte(ParseConnectionLink(e.Link)), &parsed)
+			if parsed["error"] != "" {
+				skipped++
+				continue
+			}
+			e.Server = parsed["server"]
+			e.Password = parsed["password"]
+			if e.ProxyType == "" {
+				e.ProxyType = parsed["proxyType"]
+			}
+			if e.Name == "" {
+				e.Name = parsed["name"]
+			}
+		}
+		if err := normalizeServerEntry(&e); err != nil {
+			skipped++
+			continue
+		}
+		servers = append(servers, e)
+	}
+
+	b, _ := json.Marshal(map[string]any{"servers": servers, "skipped": skipped})
+	return string(b)
+}
+
+// normalizeServerEntry validates e and fills in defaults and the link
+func normalizeServerEntry(e *ServerEntry) error {
+	e.Name = strings.TrimSpace(e.Name)
+	e.Server = strings.TrimSpace(e.Server)
+	if e.Server == "" {
+		return fmt.Errorf("missing server address")
+	}
+	host, port, err := net.SplitHostPort(e.Server)
+	if err != nil {
+		// No port given; use the Minecraft default
+		host, port = e.Server, "25565"
+	}
+	if host == "" {
+		return fmt.Errorf("invalid server address %q", e.Server)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port in %q", e.Server)
+	}
+	e.Server = net.JoinHostPort(host, port)
+
+	if e.Name == "" {
+		e.Name = e.Server
+	}
+	e.ProxyType = NormalizeProxyType(e.ProxyType)
+	e.Link = BuildConnectionLink(e.Name, e.Server, e.Password)
+	return nil
+}
@@ -2,18 +2,31 @@ package minewire
 
 import (
 	"bufio"
+	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"strings"
 	"sync"
 
 	"github.com/yl2chen/cidranger"
+
+	"minewire/dnscache"
 )
 
 // SplitTunnelManager handles split tunneling logic
 type SplitTunnelManager struct {
 	ranger cidranger.Ranger
 	mu     sync.RWMutex
+
+	// Per-file entry counts for GetRuleStats
+	files []RuleFileStats
+}
+
+// RuleFileStats describes how many entries a loaded rule file contributed
+type RuleFileStats struct {
+	Path    string `json:"path"`
+	Entries int    `json:"entries"`
 }
 
 var (
@@ -36,6 +49,7 @@ func (m *SplitTunnelManager) ClearRules() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.ranger = cidranger.NewPCTrieRanger()
+	m.files = nil
 }
 
 // LoadRuleFile loads a file containing CIDR ranges (one per line)
@@ -49,29 +63,112 @@ func (m *SplitTunnelManager) LoadRuleFile(path string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	loaded := 0
+	defer func() {
+		m.files = append(m.files, RuleFileStats{Path: path, Entries: loaded})
+	}()
+
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		_, network, err := net.ParseCIDR(line)
+		network, ok := parseRule(line)
+		if !ok {
+			continue // Skip invalid lines
+		}
+		if m.ranger.Insert(cidranger.NewBasicRangerEntry(*network)) == nil {
+			loaded++
+		}
+	}
+	return scanner.Err()
+}
+
+// parseRule parses a CIDR range or a single IP, which becomes a /32 or /128
+func parseRule(line string) (*net.IPNet, bool) {
+	_, network, err := net.ParseCIDR(line)
+	if err == nil {
+		return network, true
+	}
+	ip := net.ParseIP(line)
+	if ip == nil {
+		return nil, false
+	}
+	mask := net.CIDRMask(32, 32)
+	if ip.To4() == nil {
+		mask = net.CIDRMask(128, 128)
+	}
+	return &net.IPNet{IP: ip, Mask: mask}, true
+}
+
+// UpdateRules loads rules from multiple files into a new ranger and only
+// swaps it in once every file was read, so a read failing midway leaves the
+// previous rules in place rather than half-replaced. Files that can't be
+// opened are logged and left out. skipped counts invalid lines.
+func (m *SplitTunnelManager) UpdateRules(paths []string) (loaded, skipped int, err error) {
+	newRanger := cidranger.NewPCTrieRanger()
+	files := []RuleFileStats{}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		f, err := os.Open(path)
 		if err != nil {
-			// Try parsing as single IP, assume /32
-			ip := net.ParseIP(line)
-			if ip != nil {
-				mask := net.CIDRMask(32, 32)
-				if ip.To4() == nil {
-					mask = net.CIDRMask(128, 128)
-				}
-				network = &net.IPNet{IP: ip, Mask: mask}
-			} else {
-				continue // Skip invalid lines
+			logWarn("Failed to load rule file %s: %v", path, err)
+			continue
+		}
+
+		fileCount := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			network, ok := parseRule(line)
+			if !ok || newRanger.Insert(cidranger.NewBasicRangerEntry(*network)) != nil {
+				skipped++
+				continue
 			}
+			fileCount++
 		}
-		m.ranger.Insert(cidranger.NewBasicRangerEntry(*network))
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return 0, 0, fmt.Errorf("reading %s: %w", path, err)
+		}
+		logInfo("Loaded rule file: %s", path)
+		files = append(files, RuleFileStats{Path: path, Entries: fileCount})
+		loaded += fileCount
 	}
-	return scanner.Err()
+
+	// Hot swap
+	m.mu.Lock()
+	m.ranger = newRanger
+	m.files = files
+	m.mu.Unlock()
+
+	return loaded, skipped, nil
+}
+
+// GetRuleStats returns a JSON summary of the currently loaded split tunnel
+// rules, so the UI can confirm that rule files actually took effect.
+func GetRuleStats() string {
+	m := GetSplitTunnelManager()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := m.files
+	if files == nil {
+		files = []RuleFileStats{}
+	}
+	b, _ := json.Marshal(map[string]any{
+		"entries": m.ranger.Len(),
+		"files":   files,
+	})
+	return string(b)
 }
 
 // ShouldBypass returns true if the IP should be routed directly (bypass VPN)
@@ -90,3 +187,46 @@ func (m *SplitTunnelManager) ShouldBypass(ipStr string) bool {
 	}
 	return contains
 }
+
+// bypassAddr reports whether host, an IP literal or a domain, should be
+// routed directly. Domains are resolved first and the matching address is
+// returned, so the direct dial goes to the IP that was actually checked.
+func (m *SplitTunnelManager) bypassAddr(host string) (string, bool) {
+	if net.ParseIP(host) != nil {
+		return host, m.ShouldBypass(host)
+	}
+
+	// With no rules loaded nothing can match; don't do a lookup for nothing
+	m.mu.RLock()
+	empty := m.ranger.Len() == 0
+	m.mu.RUnlock()
+	if empty {
+		return "", false
+	}
+
+	ips, err := resolveHost(host)
+	if err != nil {
+		return "", false
+	}
+	for _, ip := range ips {
+		if m.ShouldBypass(ip.String()) {
+			return ip.String(), true
+		}
+	}
+	return "", false
+}
+
+// dnsCache holds recent lookups of destination names; see resolveHost
+var dnsCache dnscache.Cache
+
+// resolveHost returns the addresses of host, cached for the configured
+// DNSCacheTTLMs
+func resolveHost(host string) ([]net.IP, error) {
+	opts := getConfig().Options
+	return dnsCache.Resolve(host, opts.dnsCacheTTL(), opts.dnsCacheSize())
+}
+
+// ClearDNSCache forgets every cached destination lookup
+func ClearDNSCache() {
+	dnsCache.Clear()
+}
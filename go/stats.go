@@ -0,0 +1,120 @@
+package minewire
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	latencySampleInterval = 10 * time.Second
+	latencyHistorySize    = 60 // 10 minutes at one sample per 10s
+
+	// rateWindow is how far back GetStats looks to compute transfer rates;
+	// short, so a dashboard sees a burst start and stop within a poll or two
+	rateWindow = 2 * time.Second
+)
+
+// latencySample is one tunnel round-trip measurement
+type latencySample struct {
+	Time      int64 `json:"time"` // Unix milliseconds
+	LatencyMs int64 `json:"latencyMs"`
+}
+
+// latencyHistory is a bounded ring of recent tunnel RTT samples
+var latencyHistory struct {
+	mu      sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+func recordLatency(rtt time.Duration) {
+	s := latencySample{Time: time.Now().UnixMilli(), LatencyMs: rtt.Milliseconds()}
+
+	latencyHistory.mu.Lock()
+	defer latencyHistory.mu.Unlock()
+	if len(latencyHistory.samples) < latencyHistorySize {
+		latencyHistory.samples = append(latencyHistory.samples, s)
+		return
+	}
+	latencyHistory.samples[latencyHistory.next] = s
+	latencyHistory.next = (latencyHistory.next + 1) % latencyHistorySize
+}
+
+func resetLatencyHistory() {
+	latencyHistory.mu.Lock()
+	latencyHistory.samples = nil
+	latencyHistory.next = 0
+	latencyHistory.mu.Unlock()
+}
+
+// GetLatencyHistory returns recent tunnel round-trip times as a JSON array of
+// {time, latencyMs} objects, oldest first, for drawing a latency sparkline.
+func GetLatencyHistory() string {
+	latencyHistory.mu.Lock()
+	n := len(latencyHistory.samples)
+	out := make([]latencySample, 0, n)
+	out = append(out, latencyHistory.samples[latencyHistory.next:]...)
+	out = append(out, latencyHistory.samples[:latencyHistory.next]...)
+	latencyHistory.mu.Unlock()
+
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+// sampleLatency pings the server over the tunnel until it closes, feeding
+// the latency history.
+func sampleLatency(s pinger) {
+	ticker := time.NewTicker(latencySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.CloseChan():
+			return
+		case <-ticker.C:
+			if rtt, err := s.Ping(); err == nil {
+				recordLatency(rtt)
+			}
+		}
+	}
+}
+
+// trafficRates turns the byte counters into rates. It samples them whenever
+// GetStats is called rather than on a timer, so nothing runs when nobody is
+// looking.
+var trafficRates rateMeter
+
+type rateSample struct {
+	at     time.Time // Carries the monotonic reading, so clock changes don't skew rates
+	tx, rx int64
+}
+
+type rateMeter struct {
+	mu      sync.Mutex
+	samples []rateSample
+}
+
+// sample records the current counters and returns the rates in bytes per
+// second since the newest sample at least rateWindow old (or the oldest one
+// kept, while the window is still filling).
+func (m *rateMeter) sample(tx, rx int64) (txRate, rxRate int64) {
+	now := rateSample{at: time.Now(), tx: tx, rx: rx}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// ResetStats starts the counters over; so does the window
+	if n := len(m.samples); n > 0 && (tx < m.samples[n-1].tx || rx < m.samples[n-1].rx) {
+		m.samples = nil
+	}
+	m.samples = append(m.samples, now)
+	for len(m.samples) > 2 && now.at.Sub(m.samples[1].at) >= rateWindow {
+		m.samples = m.samples[1:]
+	}
+
+	base := m.samples[0]
+	elapsed := now.at.Sub(base.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return int64(float64(tx-base.tx) / elapsed), int64(float64(rx-base.rx) / elapsed)
+}
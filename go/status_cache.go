@@ -0,0 +1,63 @@
+package minewire
+
+import (
+	"sync"
+	"time"
+)
+
+// statusCacheSize bounds the cache; server lists are rarely longer than this
+const statusCacheSize = 256
+
+type statusEntry struct {
+	status  ServerStatus
+	fetched time.Time
+}
+
+// statusCache holds recent successful GetServerStatus results by address so
+// a server list refreshed in a loop doesn't re-probe every server each time.
+var statusCache = &statusCacheMap{entries: make(map[string]statusEntry)}
+
+type statusCacheMap struct {
+	mu      sync.Mutex
+	entries map[string]statusEntry
+}
+
+func (c *statusCacheMap) get(addr string, ttl time.Duration) (ServerStatus, bool) {
+	if ttl <= 0 {
+		return ServerStatus{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[addr]
+	if !ok || time.Since(e.fetched) > ttl {
+		return ServerStatus{}, false
+	}
+	return e.status, true
+}
+
+func (c *statusCacheMap) put(addr string, status ServerStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[addr]; !ok && len(c.entries) >= statusCacheSize {
+		c.evictOldestLocked()
+	}
+	c.entries[addr] = statusEntry{status: status, fetched: time.Now()}
+}
+
+func (c *statusCacheMap) evictOldestLocked() {
+	var oldest string
+	var oldestTime time.Time
+	for addr, e := range c.entries {
+		if oldest == "" || e.fetched.Before(oldestTime) {
+			oldest, oldestTime = addr, e.fetched
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// ClearStatusCache forgets every cached server status
+func ClearStatusCache() {
+	statusCache.mu.Lock()
+	statusCache.entries = make(map[string]statusEntry)
+	statusCache.mu.Unlock()
+}
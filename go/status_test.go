@@ -0,0 +1,43 @@
+package minewire
+
+import (
+	"testing"
+	"time"
+)
+
+// Raising or lowering the limit never lets more probes run than it allows.
+func TestStatusSlotsAcrossLimitChange(t *testing.T) {
+	a := acquireStatusSlot(2, true)
+	b := acquireStatusSlot(2, true)
+	if a == nil || b == nil {
+		t.Fatal("no slot under the limit")
+	}
+	if acquireStatusSlot(2, true) != nil {
+		t.Fatal("third slot with a limit of 2")
+	}
+
+	c := acquireStatusSlot(3, true)
+	if c == nil {
+		t.Fatal("no slot after raising the limit to 3")
+	}
+	a()
+	if acquireStatusSlot(1, true) != nil {
+		t.Fatal("slot with a limit of 1 while 2 probes run")
+	}
+
+	got := make(chan func(), 1)
+	go func() { got <- acquireStatusSlot(1, false) }()
+	b()
+	select {
+	case <-got:
+		t.Fatal("waiting probe started while another still ran")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c()
+	select {
+	case release := <-got:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting probe never got a slot")
+	}
+}
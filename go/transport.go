@@ -0,0 +1,111 @@
+package minewire
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ObfuscationTransport establishes the disguised connection a tunnel runs
+// over. Dial returns a net.Conn that carries the tunnel's bytes both ways;
+// how they look on the wire (and how they are encrypted) is up to the
+// transport, so the tunnel core runs yamux or a single stream over it
+// without knowing which disguise is in use.
+type ObfuscationTransport interface {
+	Dial() (net.Conn, error)
+}
+
+// transportConn is implemented by transport connections that track their
+// receiving side. Tunnels use it when available: readerDone is closed once
+// the connection stopped delivering data for good, and lastReadAt is when
+// tunnel data last arrived, in Unix nanoseconds.
+type transportConn interface {
+	net.Conn
+	lastReadAt() int64
+	readerDone() <-chan struct{}
+}
+
+// Values of Options.Transport
+const (
+	transportMinecraft = "minecraft"
+	transportWebSocket = "websocket"
+)
+
+// checkTransport rejects a Transport newTransport doesn't know, which
+// would otherwise fail every connect with Start still retrying
+func checkTransport(o Options) error {
+	switch o.transportName() {
+	case transportMinecraft, transportWebSocket:
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q", o.Transport)
+}
+
+// newTransport returns the transport conf selects, set up for one
+// connection to addr that reports to h.
+func newTransport(ctx context.Context, conf config, addr string, h *connectHooks) (ObfuscationTransport, error) {
+	switch conf.transportName() {
+	case transportMinecraft:
+		return &minecraftTransport{ctx: ctx, conf: conf, addr: addr, hooks: h}, nil
+	case transportWebSocket:
+		return &websocketTransport{ctx: ctx, conf: conf, addr: addr}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", conf.Transport)
+	}
+}
+
+func dialTransport(ctx context.Context, conf config, addr string, h *connectHooks) (net.Conn, error) {
+	t, err := newTransport(ctx, conf, addr, h)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial()
+}
+
+// stageError tags a transport's error with the connect step that failed, for
+// the connect log. It reads as the underlying error.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+// minecraftTransport is the original disguise: it logs in to the server as
+// a Minecraft client and carries the tunnel in encrypted plugin messages
+// (see MinecraftConn), with background movement as cover traffic.
+type minecraftTransport struct {
+	ctx   context.Context
+	conf  config
+	addr  string
+	hooks *connectHooks
+}
+
+func (t *minecraftTransport) Dial() (net.Conn, error) {
+	c := &connector{ctx: t.ctx, conf: t.conf, addr: t.addr, hooks: t.hooks, compressionThreshold: -1}
+	if err := c.dial(); err != nil {
+		return nil, &stageError{"dial", err}
+	}
+	// The login only has read deadlines; Stop shouldn't wait them out
+	stop := context.AfterFunc(t.ctx, func() { c.conn.Close() })
+	defer stop()
+
+	steps := []struct {
+		stage string
+		run   func() error
+	}{
+		{"handshake", c.performHandshake},
+		{"login", c.performLogin},
+		{"settings", c.sendClientSettings},
+		{"brand", c.sendBrand},
+		{"cipher", c.setupCipher},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			c.conn.Close()
+			return nil, &stageError{step.stage, err}
+		}
+	}
+	return c.start(), nil
+}
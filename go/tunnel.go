@@ -3,126 +3,679 @@ package minewire
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"math"
+	mrand "math/rand/v2"
 	"net"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/yamux"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"minewire/mcversion"
+	"minewire/serverdial"
 )
 
 const (
-	PROTOCOL_VERSION      = 773
-	PID_SB_Handshake      = 0x00
-	PID_SB_LoginStart     = 0x00
-	PID_SB_ClientSettings = 0x08
-	PID_SB_PluginMsg      = 0x0D
-	PID_SB_PlayerPos      = 0x14
-	PID_SB_KeepAlive      = 0x15
-
-	PID_CB_LoginSuccess = 0x02
-	PID_CB_JoinGame     = 0x29
-	PID_CB_KeepAlive    = 0x24
-	PID_CB_ChunkData    = 0x25
+	PROTOCOL_VERSION           = mcversion.Latest
+	PID_SB_Handshake           = 0x00
+	PID_SB_LoginStart          = 0x00
+	PID_SB_LoginPluginResponse = 0x02
+	PID_SB_CookieResponse      = 0x04
+	PID_SB_ClientSettings      = 0x08
+	PID_SB_PluginMsg           = 0x0D
+	PID_SB_PlayerPos           = 0x14
+	PID_SB_PlayerRot           = 0x16
+	PID_SB_KeepAlive           = 0x15
+
+	PID_CB_LoginDisconnect    = 0x00
+	PID_CB_EncryptionRequest  = 0x01
+	PID_CB_LoginSuccess       = 0x02
+	PID_CB_SetCompression     = 0x03
+	PID_CB_LoginPluginRequest = 0x04
+	PID_CB_CookieRequest      = 0x05
+	PID_CB_KeepAlive          = 0x24
+	PID_CB_ChunkData          = 0x25
+
+	// Login Acknowledged moves both sides into the Configuration state
+	PID_SB_LoginAcknowledged = 0x03
+
+	// Status state (server list ping)
+	PID_SB_StatusPing = 0x01
+	PID_CB_StatusPong = 0x01
 )
 
 var (
-	session         *yamux.Session
+	session         Tunnel
 	sessionLock     sync.Mutex
 	lastKeepAliveID int64
 	keepAliveLock   sync.Mutex
+
+	// sessionWake cuts maintainSession's retry sleep short.
+	sessionWake = make(chan struct{}, 1)
+
+	// liveSession mirrors session for readers that mustn't wait on
+	// sessionLock, which a connect attempt holds for seconds at a time.
+	liveSession atomic.Pointer[sessionRef]
 )
 
+// sessionRef boxes a Tunnel for liveSession
+type sessionRef struct{ Tunnel }
+
+// setSession replaces session and publishes it to currentSession. The
+// caller holds sessionLock.
+func setSession(s Tunnel) {
+	session = s
+	if s == nil {
+		liveSession.Store(nil)
+		return
+	}
+	liveSession.Store(&sessionRef{s})
+}
+
+// currentSession returns the session without taking sessionLock, or nil
+func currentSession() Tunnel {
+	if r := liveSession.Load(); r != nil {
+		return r.Tunnel
+	}
+	return nil
+}
+
 // CloseSession closes the current yamux session if it exists.
 func CloseSession() {
 	sessionLock.Lock()
 	if session != nil {
 		session.Close()
-		session = nil
+		setSession(nil)
 	}
 	sessionLock.Unlock()
 }
 
+// NetworkChanged should be called by the host app when the active network
+// changes (e.g. Wi-Fi to cellular). The current session is bound to the old
+// network and would only fail after TCP timeouts, so it is closed right away
+// and maintainSession is woken up to reconnect over the new network.
+func NetworkChanged() {
+	if !IsRunning() {
+		return
+	}
+	logInfo("Network changed, reconnecting")
+	ClearDNSCache() // Answers may differ on the new network
+	CloseSession()
+	wakeSession()
+}
+
+// GetConnectionState returns "disconnected" when not running, "connected"
+// while the tunnel session is up, and "connecting" while the proxy is running
+// but the session is down and being re-established.
+func GetConnectionState() string {
+	if !IsRunning() {
+		return "disconnected"
+	}
+	if s := currentSession(); s != nil && !s.IsClosed() {
+		return "connected"
+	}
+	return "connecting"
+}
+
+// healthCheckTimeout bounds TunnelHealthCheck's round trip
+const healthCheckTimeout = 5 * time.Second
+
+// TunnelHealthCheck measures a round trip through the established tunnel and
+// returns it in milliseconds, or -1 if the session is down, can't be probed
+// (single-stream mode) or doesn't answer within healthCheckTimeout. The
+// probe is a yamux ping: its random ID goes through the same encryption and
+// Minecraft packet framing as stream data and is echoed by the server's
+// multiplexer, so unlike Ping it shows the tunnel itself works end to end.
+func TunnelHealthCheck() int64 {
+	if !IsRunning() {
+		return -1
+	}
+	s := currentSession()
+	p, ok := s.(pinger)
+	if !ok || s.IsClosed() {
+		return -1
+	}
+
+	done := make(chan time.Duration, 1)
+	go func() {
+		rtt, err := p.Ping()
+		if err != nil {
+			rtt = -1
+		}
+		done <- rtt
+	}()
+	select {
+	case rtt := <-done:
+		if rtt < 0 {
+			return -1
+		}
+		return rtt.Milliseconds()
+	case <-time.After(healthCheckTimeout):
+		return -1
+	}
+}
+
+// Reconnect drops the current session so maintainSession re-establishes it
+// right away. The local listener, VPN and system proxy are left alone.
+// Returns an error string or empty string on success.
+func Reconnect() string {
+	if !IsRunning() {
+		return "not running"
+	}
+	logInfo("Reconnect requested")
+	CloseSession()
+	wakeSession()
+	return ""
+}
+
+// wakeSession makes maintainSession run its next iteration immediately.
+func wakeSession() {
+	select {
+	case sessionWake <- struct{}{}:
+	default:
+	}
+}
+
+// sessionCheckInterval is how often a live session is checked for closure
+const sessionCheckInterval = 3 * time.Second
+
 // maintainSession maintains the tunnel connection to the server.
-// It automatically reconnects if the connection is lost.
-func maintainSession() {
+// It automatically reconnects if the connection is lost, backing off
+// exponentially (with jitter) while the server stays unreachable.
+func maintainSession(ctx context.Context) {
+	conf := getConfig()
+	base, limit := conf.reconnectBase(), conf.reconnectMax()
+	backoff := base
+
+	connected := false
+	next := 0 // Index of the server to try first
 	for {
-		// Check if we should stop
-		serverLock.Lock()
-		running := isRunning
-		serverLock.Unlock()
-		if !running {
+		beat()
+
+		if ctx.Err() != nil {
 			return
 		}
 
+		wait := sessionCheckInterval
+		// Read before taking sessionLock: Start and Stop hold serverLock
+		// while they close the session, so serverLock must never be taken
+		// with sessionLock held.
+		conf = getConfig()
+		var established Tunnel
+		reconnect := connected
 		sessionLock.Lock()
 		if session == nil || session.IsClosed() {
-			s, err := connectToServer()
-			if err == nil {
-				session = s
-				log.Println("Connected & Logged in as Player!")
-			} else {
-				log.Printf("Connect fail: %v", err)
+			if session != nil {
+				notifyState("connecting", "session lost")
+			}
+			s, idx, err := connectToServer(ctx, conf, next)
+			if err == nil && ctx.Err() != nil {
+				// Stopped while the login finished; this session belongs to
+				// a run that is over
+				s.Close()
+			} else if err == nil {
+				setSession(s)
+				// If this session drops, try the next server first
+				next = idx + 1
+				logInfo("Connected & Logged in as Player!")
+				established = s
+				connected = true
+				backoff = base
+			} else if ctx.Err() == nil {
+				logWarn("Connect fail: %v (retrying in %v)", err, backoff)
+				notifyState("connecting", err.Error())
+				wait = withJitter(backoff)
+				backoff = min(backoff*2, limit)
 			}
 		}
 		sessionLock.Unlock()
-		time.Sleep(3 * time.Second)
+		// Outside sessionLock, for the same reason as getConfig above
+		if established != nil {
+			onSessionEstablished(established, reconnect)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case <-sessionWake:
+			// Explicit reconnects (network change, Reconnect) retry right away
+			backoff = base
+		}
+	}
+}
+
+// withJitter spreads d over [d/2, d) so clients that lost the same server
+// don't all retry in lockstep.
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + mrand.N(half)
+}
+
+// onSessionEstablished runs after every successful connect. Everything tied
+// to the wire session (cipher, MinecraftConn, reader loop, noise) is rebuilt
+// by connectToServer from a fresh config snapshot; process-wide state such as
+// the split tunnel ranger is untouched. What remains is state that still
+// points at the previous session.
+func onSessionEstablished(s Tunnel, reconnect bool) {
+	if p, ok := s.(pinger); ok {
+		go sampleLatency(p)
+	}
+	if y, ok := s.(*yamuxTunnel); ok {
+		go acceptControlStreams(y.Session)
+	}
+
+	if reconnect {
+		// UDP flows hold streams of the dead session; drop them so the next
+		// datagram opens a stream on the new one instead of failing first.
+		serverLock.Lock()
+		flows := udpFlows
+		serverLock.Unlock()
+		if flows != nil {
+			flows.Reset()
+		}
+		logInfo("Session re-established")
+	}
+	notifyState("connected", "")
+}
+
+// connectToServer tries the servers of conf in order, starting at index
+// start, and returns the first that completes the login together with its
+// index.
+func connectToServer(ctx context.Context, conf config, start int) (Tunnel, int, error) {
+	t, idx, err := connectAny(ctx, conf, start, clientHooks)
+	if err == nil {
+		activeServer.Store(conf.serverList()[idx])
+	}
+	return t, idx, err
+}
+
+// connectHooks are where a tunnel reports to its owner: connect attempts go
+// to log, sessions dropped for not opening streams to stalled, and wake asks
+// for a reconnect right away.
+type connectHooks struct {
+	log     *connectLog
+	stalled *atomic.Int64
+	wake    func()
+}
+
+// clientHooks report to the state of the tunnel Start runs
+var clientHooks = &connectHooks{log: &clientConnectLog, stalled: &stalledSessions, wake: wakeSession}
+
+// connectAny is connectToServer for a given configuration, reporting to h
+// rather than the state of the running client.
+func connectAny(ctx context.Context, conf config, start int, h *connectHooks) (Tunnel, int, error) {
+	servers := conf.serverList()
+	var lastErr error
+	for i := range servers {
+		idx := (start + i) % len(servers)
+		t, err := connectTo(ctx, conf, servers[idx], h)
+		if err == nil {
+			return t, idx, nil
+		}
+		if len(servers) > 1 {
+			logWarn("Server %s failed: %v", servers[idx], err)
+		}
+		lastErr = err
+	}
+	return nil, start, lastErr
+}
+
+// serverList is the failover list, or just the server address if the
+// list is empty
+func (c config) serverList() []string {
+	if len(c.Servers) == 0 {
+		return []string{c.ServerAddress}
 	}
+	return c.Servers
 }
 
-func connectToServer() (*yamux.Session, error) {
-	d := net.Dialer{Timeout: 10 * time.Second}
-	conn, err := d.Dial("tcp", cfg.ServerAddress)
+// connectTo dials addr with the configured transport and starts a tunnel
+// over the resulting connection.
+func connectTo(ctx context.Context, conf config, addr string, h *connectHooks) (Tunnel, error) {
+	began := time.Now()
+	conn, err := dialTransport(ctx, conf, addr, h)
 	if err != nil {
+		stage := "dial"
+		var se *stageError
+		if errors.As(err, &se) {
+			stage = se.stage
+		}
+		h.log.record(addr, began, stage, err)
 		return nil, err
 	}
 
+	t, err := newTunnel(conf, conn, h)
+	h.log.record(addr, began, "session", err)
+	return t, err
+}
+
+// activeServer is the address of the server the current session runs over
+var activeServer atomic.Value // string
+
+// GetActiveServer returns the server the tunnel is currently connected
+// through, or "" if there is none.
+func GetActiveServer() string {
+	if GetConnectionState() != "connected" {
+		return ""
+	}
+	addr, _ := activeServer.Load().(string)
+	return addr
+}
+
+// connector walks one connection through the fake Minecraft login. Each step
+// only needs conn (and reader after performLogin), so the protocol steps can
+// be driven against any net.Conn, such as one end of a net.Pipe.
+type connector struct {
+	ctx    context.Context // The Start this connection belongs to
+	conf   config
+	addr   string // Server to dial
+	hooks  *connectHooks
+	conn   net.Conn
+	reader *bufio.Reader
+	salt   []byte    // Key derivation salt, nil for the legacy key
+	uuid   loginUUID // Sent in Login Start, announcing the settings
+	aead   cipher.AEAD
+
+	// compressionThreshold is set by the server's Set Compression packet;
+	// negative while compression is off.
+	compressionThreshold int
+	// configured is set once the Configuration phase ran; client settings
+	// and brand were sent there rather than in Play.
+	configured bool
+}
+
+// writePacket writes a packet in whatever framing the login negotiated
+func (c *connector) writePacket(packetID int, data []byte) error {
+	return WriteCompressedPacket(c.conn, c.compressionThreshold, packetID, data)
+}
+
+func (c *connector) dial() error {
+	conn, err := serverdial.Dial(c.ctx, c.addr)
+	if err != nil {
+		return err
+	}
+
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
+		tcpConn.SetNoDelay(!c.conf.DisableNoDelay)
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
+	if c.conf.UseTLS {
+		if conn, err = serverdial.WrapTLS(c.ctx, conn, c.addr, c.conf.TLSServerName); err != nil {
+			return err
+		}
+	}
+	c.conn = conn
+	return nil
+}
 
-	h := sha256.Sum256([]byte(cfg.Password))
-	username := "Player" + hex.EncodeToString(h[:])[:8]
+// performHandshake sends the handshake and Login Start packets
+func (c *connector) performHandshake() error {
+	uuid, err := newLoginUUID(c.conf.Options, c.conf.Password)
+	if err != nil {
+		return err
+	}
+	c.uuid, c.salt = uuid, uuid.salt(c.conf.Options)
+	username := c.loginUsername()
+	version := c.conf.protocolVersion()
 
 	buf := new(bytes.Buffer)
-	WriteVarInt(buf, PROTOCOL_VERSION)
-	WriteString(buf, "127.0.0.1")
+	WriteVarInt(buf, version)
+	WriteString(buf, c.conf.handshakeServerHost(c.addr))
 	buf.Write([]byte{0x63, 0xDD})
-	WriteVarInt(buf, 2)
-	WritePacket(conn, PID_SB_Handshake, buf.Bytes())
+	WriteVarInt(buf, c.conf.handshakeNextState())
+	if err := WritePacket(c.conn, PID_SB_Handshake, buf.Bytes()); err != nil {
+		return err
+	}
 
 	buf.Reset()
 	WriteString(buf, username)
-	WritePacket(conn, PID_SB_LoginStart, buf.Bytes())
+	if version < mcversion.LoginUUID {
+		buf.WriteByte(1) // Has UUID
+	}
+	buf.Write(c.uuid[:])
+	return WritePacket(c.conn, PID_SB_LoginStart, buf.Bytes())
+}
+
+// Values of Options.UsernamePattern besides a fixed name
+const (
+	usernameDerived = "derived"
+	usernameRandom  = "random"
+)
+
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_]{3,16}$`)
+
+// loginUsername returns the name sent in Login Start
+func (c *connector) loginUsername() string {
+	switch p := c.conf.UsernamePattern; {
+	case p == "" || p == usernameDerived:
+	case p == usernameRandom:
+		return randomUsername()
+	case validUsername.MatchString(p):
+		return p
+	default:
+		logWarn("Invalid username pattern %q, using the derived name", p)
+	}
+	return "Player" + hex.EncodeToString(deriveKey(c.conf.Password, c.salt))[:8]
+}
+
+// derivedUsername reports whether loginUsername sends the derived name
+func (o Options) derivedUsername() bool {
+	p := o.UsernamePattern
+	return p == "" || p == usernameDerived || p != usernameRandom && !validUsername.MatchString(p)
+}
 
-	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-	reader := bufio.NewReader(conn)
-	packetsToRead := 2
-	for packetsToRead > 0 {
-		l, err := ReadVarInt(reader)
+// randomUsername makes a name shaped like a typical player's: a
+// capitalized word-like stem, sometimes followed by digits or an underscore.
+func randomUsername() string {
+	const consonants = "bcdfghjklmnprstvwxz"
+	const vowels = "aeiouy"
+
+	var b strings.Builder
+	for i := range 2 + mrand.IntN(3) {
+		c := consonants[mrand.IntN(len(consonants))]
+		if i == 0 {
+			c -= 'a' - 'A'
+		}
+		b.WriteByte(c)
+		b.WriteByte(vowels[mrand.IntN(len(vowels))])
+	}
+	switch mrand.IntN(3) {
+	case 0:
+		fmt.Fprintf(&b, "%d", mrand.IntN(10000))
+	case 1:
+		b.WriteString("_")
+		b.WriteByte(consonants[mrand.IntN(len(consonants))])
+	}
+	return b.String()
+}
+
+// performLogin reads login-state packets until Login Success, answering the
+// requests a vanilla client would answer, runs the Configuration phase on
+// servers that have one, then waits for Join Game. Servers differ in what
+// they send in between, so packets are handled by ID rather than by position.
+func (c *connector) performLogin() error {
+	c.conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	c.reader = bufio.NewReader(c.conn)
+
+	joinGame := c.conf.packets().JoinGame
+	loggedIn := false
+	for {
+		pid, data, err := readRawPacket(c.reader, c.compressionThreshold)
 		if err != nil {
-			conn.Close()
-			return nil, err
+			return err
 		}
-		_, err = io.ReadFull(reader, make([]byte, l))
+
+		if loggedIn {
+			// Play state: anything before Join Game is noise we don't need
+			if pid == joinGame {
+				break
+			}
+			continue
+		}
+
+		switch pid {
+		case PID_CB_LoginDisconnect:
+			reason, _ := ReadString(bytes.NewReader(data))
+			if !c.conf.derivedUsername() {
+				logError("Login refused with usernamePattern %q; servers that validate the derived name only accept \"derived\"", c.conf.UsernamePattern)
+			}
+			return fmt.Errorf("server refused login: %s", reason)
+		case PID_CB_EncryptionRequest:
+			return errors.New("server requires online-mode encryption")
+		case PID_CB_SetCompression:
+			// Every packet from here on, both ways, uses the compressed framing
+			threshold, err := ReadVarInt(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			c.compressionThreshold = threshold
+		case PID_CB_LoginSuccess:
+			if mcversion.UsesConfigurationState(c.conf.protocolVersion()) {
+				if err := c.writePacket(PID_SB_LoginAcknowledged, nil); err != nil {
+					return err
+				}
+				if err := c.performConfiguration(); err != nil {
+					return err
+				}
+			}
+			loggedIn = true
+		case PID_CB_LoginPluginRequest:
+			// Decline: "we don't understand this channel"
+			msgID, err := ReadVarInt(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			buf := new(bytes.Buffer)
+			WriteVarInt(buf, msgID)
+			WriteBool(buf, false)
+			if err := c.writePacket(PID_SB_LoginPluginResponse, buf.Bytes()); err != nil {
+				return err
+			}
+		case PID_CB_CookieRequest:
+			key, err := ReadString(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			buf := new(bytes.Buffer)
+			WriteString(buf, key)
+			WriteBool(buf, false) // No cookie stored
+			if err := c.writePacket(PID_SB_CookieResponse, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// performConfiguration runs the Configuration state: it sends the client
+// information and brand, answers the server's requests like a vanilla client
+// and acknowledges Finish Configuration, after which the server is in Play.
+func (c *connector) performConfiguration() error {
+	ids := c.conf.packets().Config
+	version := c.conf.protocolVersion()
+	if err := c.writePacket(ids.SBClientInformation, clientInformation(version)); err != nil {
+		return err
+	}
+	if c.conf.Brand != "" {
+		if err := c.writePacket(ids.SBPluginMsg, brandPayload(c.conf.Brand)); err != nil {
+			return err
+		}
+	}
+	c.configured = true
+
+	for {
+		pid, data, err := readRawPacket(c.reader, c.compressionThreshold)
 		if err != nil {
-			conn.Close()
-			return nil, err
+			return err
+		}
+
+		switch pid {
+		case ids.CBDisconnect:
+			return errors.New("server disconnected during configuration")
+		case ids.CBFinish:
+			return c.writePacket(ids.SBFinishAck, nil)
+		case ids.CBKeepAlive:
+			err = c.writePacket(ids.SBKeepAlive, data)
+		case ids.CBPing:
+			err = c.writePacket(ids.SBPong, data)
+		case ids.CBKnownPacks:
+			// Same version as the server, so claim the packs it offers and
+			// it can skip sending their registry data
+			err = c.writePacket(ids.SBKnownPacks, data)
+		case ids.CBAddResourcePack:
+			buf := new(bytes.Buffer)
+			if version >= mcversion.ResourcePackUUID {
+				if len(data) < 16 {
+					return errors.New("short resource pack request")
+				}
+				buf.Write(data[:16]) // Pack UUID
+			}
+			WriteVarInt(buf, 1) // Declined
+			err = c.writePacket(ids.SBResourcePackResp, buf.Bytes())
+		case ids.CBCookieRequest:
+			key, rerr := ReadString(bytes.NewReader(data))
+			if rerr != nil {
+				return rerr
+			}
+			buf := new(bytes.Buffer)
+			WriteString(buf, key)
+			WriteBool(buf, false) // No cookie stored
+			err = c.writePacket(ids.SBCookieResponse, buf.Bytes())
+		case ids.CBCodeOfConduct:
+			err = c.writePacket(ids.SBAcceptConduct, nil)
+		}
+		// Registry data, tags, feature flags etc. need no answer
+		if err != nil {
+			return err
 		}
-		packetsToRead--
 	}
-	conn.SetReadDeadline(time.Time{})
+}
 
-	buf.Reset()
+// readRawPacket reads one packet and splits off its ID. A non-negative
+// compressionThreshold means the packet uses the compressed framing.
+func readRawPacket(r *bufio.Reader, compressionThreshold int) (int, []byte, error) {
+	body, err := readPacketBody(r, MaxPacketLength)
+	if err != nil {
+		return 0, nil, err
+	}
+	if compressionThreshold >= 0 {
+		if body, err = decompressPacket(body); err != nil {
+			return 0, nil, err
+		}
+	}
+	br := bytes.NewReader(body)
+	pid, err := ReadVarInt(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if pid < 0 {
+		return 0, nil, fmt.Errorf("negative packet ID %d", pid)
+	}
+	return pid, body[len(body)-br.Len():], nil
+}
+
+// clientInformation is the body of the Client Settings packet. 1.21.2
+// (protocol 768) appended the particle setting.
+func clientInformation(version int) []byte {
+	buf := new(bytes.Buffer)
 	WriteString(buf, "en_US")
 	WriteByte(buf, 8)
 	WriteVarInt(buf, 0)
@@ -131,11 +684,71 @@ func connectToServer() (*yamux.Session, error) {
 	WriteVarInt(buf, 1)
 	WriteBool(buf, false)
 	WriteBool(buf, true)
-	WritePacket(conn, PID_SB_ClientSettings, buf.Bytes())
+	if version >= 768 {
+		WriteVarInt(buf, 0) // Particles: all
+	}
+	return buf.Bytes()
+}
+
+func (c *connector) sendClientSettings() error {
+	if c.configured {
+		return nil // Sent during configuration
+	}
+	return c.writePacket(PID_SB_ClientSettings, clientInformation(c.conf.protocolVersion()))
+}
+
+func brandPayload(brand string) []byte {
+	buf := new(bytes.Buffer)
+	WriteString(buf, "minecraft:brand")
+	WriteString(buf, brand)
+	return buf.Bytes()
+}
+
+// sendBrand announces the client brand the way a vanilla client does after
+// login, so the first plugin message on the wire is an ordinary one.
+func (c *connector) sendBrand() error {
+	if c.conf.Brand == "" || c.configured {
+		return nil
+	}
+	return c.writePacket(PID_SB_PluginMsg, brandPayload(c.conf.Brand))
+}
+
+// setupCipher derives the tunnel AEAD from the password (and salt)
+func (c *connector) setupCipher() error {
+	key := deriveKey(c.conf.Password, c.salt)
+	aead, err := newAEAD(c.conf.cipherName(), key)
+	if err != nil {
+		return err
+	}
+	c.aead = aead
+	return nil
+}
 
-	key := sha256.Sum256([]byte(cfg.Password))
-	block, _ := aes.NewCipher(key[:])
-	aead, _ := cipher.NewGCM(block)
+// Tunnel ciphers. AES-GCM is the original and what servers assume when the
+// handshake doesn't name one.
+const (
+	cipherAESGCM   = "aes-gcm"
+	cipherChaCha20 = "chacha20-poly1305"
+)
+
+func newAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case cipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherChaCha20:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher %q", name)
+	}
+}
+
+// start wraps the logged-in connection and launches its background loops.
+func (c *connector) start() *MinecraftConn {
+	conf, conn, aead := c.conf, c.conn, c.aead
 
 	pr, pw := io.Pipe()
 	mc := &MinecraftConn{
@@ -143,104 +756,185 @@ func connectToServer() (*yamux.Session, error) {
 		r:         pr,
 		w:         pw,
 		aead:      aead,
-		rawReader: reader,
+		rawReader: c.reader,
 		writeBuf:  bytes.NewBuffer(make([]byte, 0, 16384)),
+		done:      make(chan struct{}),
+		channel:   conf.dataChannel(),
+		maxChunk:  conf.maxPluginMessageSize() - aead.NonceSize() - aead.Overhead(),
+
+		flushThreshold: conf.flushThreshold(),
+		flushDelay:     conf.flushDelay(),
+
+		compressionThreshold: c.compressionThreshold,
 	}
 
-	go startBackgroundNoise(conn)
-	go startReaderLoop(mc, pw, conn, aead)
+	var tracer *packetTracer
+	if conf.DebugPackets {
+		tracer = &packetTracer{}
+	}
 
-	conf := yamux.DefaultConfig()
-	conf.KeepAliveInterval = 30 * time.Second
-	conf.ConnectionWriteTimeout = 15 * time.Second
-	conf.MaxStreamWindowSize = 512 * 1024 // 512KB (Optimized for mix of small/large packets)
-	conf.StreamOpenTimeout = 30 * time.Second
-	conf.LogOutput = io.Discard
-	return yamux.Client(mc, conf)
+	if !conf.DisableNoise {
+		go startBackgroundNoise(c.ctx, conn, c.compressionThreshold)
+	}
+	go startReaderLoop(mc, pw, conn, aead, tracer, c.hooks.wake)
+	return mc
 }
 
 // startBackgroundNoise sends periodic position packets to maintain the connection
 // and make the traffic look more like a real Minecraft client.
-func startBackgroundNoise(conn net.Conn) {
-	posTicker := time.NewTicker(1 * time.Second)
-	defer posTicker.Stop()
-	posX, posY, posZ := 100.5, 64.0, 100.5
+func startBackgroundNoise(ctx context.Context, conn net.Conn, compressionThreshold int) {
+	w := newIdleWalker()
+	timer := time.NewTimer(noiseInterval())
+	defer timer.Stop()
 	for {
 		select {
-		case <-posTicker.C:
-			// Check if we should stop
-			serverLock.Lock()
-			running := isRunning
-			serverLock.Unlock()
-			if !running {
-				return
-			}
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		pid, data := w.next()
+		if err := WriteCompressedPacket(conn, compressionThreshold, pid, data); err != nil {
+			return // Connection is gone; a reconnect starts a new noise loop
+		}
+		// Keep-alive handling removed (now event-driven in reader loop)
+		timer.Reset(noiseInterval())
+	}
+}
+
+// noiseInterval is the random gap between cover packets, 0.5-3s, so they
+// don't tick like a metronome.
+func noiseInterval() time.Duration {
+	return 500*time.Millisecond + mrand.N(2500*time.Millisecond)
+}
+
+// idleWalker imitates an idle player: mostly standing, now and then looking
+// around or wandering a few blocks along a slowly turning heading.
+type idleWalker struct {
+	x, y, z    float64
+	yaw, pitch float32
+	heading    float64 // Radians
+	walking    int     // Steps left in the current walk
+}
+
+func newIdleWalker() *idleWalker {
+	return &idleWalker{
+		x:       100.5 + mrand.Float64()*8 - 4,
+		y:       64,
+		z:       100.5 + mrand.Float64()*8 - 4,
+		yaw:     mrand.Float32() * 360,
+		heading: mrand.Float64() * 2 * math.Pi,
+	}
+}
+
+// next returns the next packet to send: a rotation now and then, otherwise
+// the current position.
+func (w *idleWalker) next() (int, []byte) {
+	b := new(bytes.Buffer)
+
+	if w.walking == 0 && mrand.IntN(4) == 0 {
+		w.yaw = float32(math.Mod(float64(w.yaw)+mrand.NormFloat64()*40+360, 360))
+		w.pitch = float32(max(-60, min(60, float64(w.pitch)+mrand.NormFloat64()*10)))
+		WriteFloat(b, w.yaw)
+		WriteFloat(b, w.pitch)
+		WriteBool(b, true)
+		return PID_SB_PlayerRot, b.Bytes()
+	}
+
+	if w.walking == 0 && mrand.IntN(8) == 0 {
+		w.walking = 2 + mrand.IntN(5)
+	}
+	if w.walking > 0 {
+		w.walking--
+		w.heading += mrand.NormFloat64() * 0.4
+		// Walking speed is ~4.3 blocks/s; a step covers part of a second
+		step := 1 + mrand.Float64()*2
+		w.x += math.Cos(w.heading) * step
+		w.z += math.Sin(w.heading) * step
+	}
+	WriteDouble(b, w.x)
+	WriteDouble(b, w.y)
+	WriteDouble(b, w.z)
+	WriteBool(b, true)
+	return PID_SB_PlayerPos, b.Bytes()
+}
+
+// packetTracer logs received packet IDs, capped at packetTraceLimit lines per
+// second so a busy tunnel can't flood the log. Used by a single reader goroutine.
+type packetTracer struct {
+	windowStart time.Time
+	count       int
+	dropped     int
+}
+
+const packetTraceLimit = 20
 
-			jitter := (float64(time.Now().UnixNano()%100) / 5000.0)
-			b := new(bytes.Buffer)
-			WriteDouble(b, posX+jitter)
-			WriteDouble(b, posY)
-			WriteDouble(b, posZ+jitter)
-			WriteBool(b, true)
-			WritePacket(conn, PID_SB_PlayerPos, b.Bytes())
-			// Keep-alive handling removed (now event-driven in reader loop)
+func (t *packetTracer) trace(pid, length int) {
+	now := time.Now()
+	if now.Sub(t.windowStart) >= time.Second {
+		if t.dropped > 0 {
+			logDebug("Packet trace: %d packets not logged", t.dropped)
 		}
+		t.windowStart = now
+		t.count = 0
+		t.dropped = 0
 	}
+	if t.count >= packetTraceLimit {
+		t.dropped++
+		return
+	}
+	t.count++
+	logDebug("Packet trace: id=0x%02X len=%d", pid, length)
 }
 
-func startReaderLoop(mc *MinecraftConn, pw *io.PipeWriter, conn net.Conn, aead cipher.AEAD) {
+func startReaderLoop(mc *MinecraftConn, pw *io.PipeWriter, conn net.Conn, aead cipher.AEAD, tracer *packetTracer, wake func()) {
+	// A panic on a malformed packet must not take the process down. The
+	// closes below still run, which ends the yamux session, so
+	// maintainSession reconnects.
+	defer func() {
+		if r := recover(); r != nil {
+			logError("Recovered in startReaderLoop: %v", r)
+			wake()
+		}
+	}()
+	defer close(mc.done)
 	defer pw.Close()
 	defer conn.Close()
-	var r io.ByteReader
-	if br, ok := mc.rawReader.(io.ByteReader); ok {
+	var r packetReader
+	if br, ok := mc.rawReader.(packetReader); ok {
 		r = br
 	} else {
 		r = bufio.NewReader(mc.rawReader)
 	}
 
 	for {
-		l, err := ReadVarInt(r)
+		data, err := readPacketBody(r, MaxPacketLength)
 		if err != nil {
 			return
 		}
-		if l < 0 || l > 2097152 {
-			return
-		}
-
-		data := make([]byte, l)
-		_, err = io.ReadFull(mc.rawReader, data)
-		if err != nil {
-			return
+		l := len(data)
+		beat()
+		if mc.compressionThreshold >= 0 {
+			if data, err = decompressPacket(data); err != nil {
+				continue // The outer length still framed it; skip just this one
+			}
 		}
 
 		pBuf := bytes.NewBuffer(data)
 		pid, _ := ReadVarInt(pBuf)
+		if tracer != nil {
+			tracer.trace(pid, l)
+		}
 
 		if pid == PID_CB_ChunkData {
-			if pBuf.Len() < 8 {
-				continue
-			}
-			pBuf.Next(8)
-
-			if err := skipNBT(pBuf); err != nil {
-				continue
-			}
-
-			payloadSize, err := ReadVarInt(pBuf)
-			if err != nil {
-				continue
-			}
-			if pBuf.Len() < payloadSize {
-				continue
-			}
-
-			enc := pBuf.Next(payloadSize)
-			if len(enc) < aead.NonceSize() {
+			enc, ok := chunkPayload(pBuf)
+			if !ok || len(enc) < aead.NonceSize() {
 				continue
 			}
 			nonce := enc[:aead.NonceSize()]
 			pt, err := aead.Open(nil, nonce, enc[aead.NonceSize():], nil)
 			if err == nil {
+				mc.lastRead.Store(time.Now().UnixNano())
 				pw.Write(pt)
 			}
 
@@ -253,12 +947,41 @@ func startReaderLoop(mc *MinecraftConn, pw *io.PipeWriter, conn net.Conn, aead c
 				// This is optimal event-driven behavior.
 				b := new(bytes.Buffer)
 				WriteLong(b, kId)
-				WritePacket(conn, PID_SB_KeepAlive, b.Bytes())
+				WriteCompressedPacket(conn, mc.compressionThreshold, PID_SB_KeepAlive, b.Bytes())
 			}
 		}
 	}
 }
 
+// chunkPayload returns the sealed tunnel data in the body of a Chunk Data
+// packet (after the ID): chunk X and Z, the heightmaps NBT, then the data
+// with a VarInt length. false means the packet doesn't carry any.
+func chunkPayload(pBuf *bytes.Buffer) ([]byte, bool) {
+	if pBuf.Len() < 8 {
+		return nil, false
+	}
+	pBuf.Next(8)
+
+	if err := skipNBT(pBuf); err != nil {
+		return nil, false
+	}
+
+	payloadSize, err := ReadVarInt(pBuf)
+	// VarInts are signed; Next panics on a negative count
+	if err != nil || payloadSize < 0 || pBuf.Len() < payloadSize {
+		return nil, false
+	}
+	return pBuf.Next(payloadSize), true
+}
+
+// maxNBTDepth is the nesting limit the vanilla client enforces
+const maxNBTDepth = 512
+
+var errNBTTruncated = errors.New("truncated NBT")
+
+// skipNBT and skipNBTPayload move r past one NBT tag. Every read is bounds
+// checked, so a truncated or hostile packet gives an error instead of a
+// panic that would take the reader loop down.
 func skipNBT(r *bytes.Buffer) error {
 	tagType, err := r.ReadByte()
 	if err != nil {
@@ -267,57 +990,115 @@ func skipNBT(r *bytes.Buffer) error {
 	if tagType == 0 {
 		return nil
 	}
-	nameLen := int(binary.BigEndian.Uint16(r.Next(2)))
-	r.Next(nameLen)
-	return skipNBTPayload(r, tagType)
+	if err := skipNBTString(r); err != nil {
+		return err
+	}
+	return skipNBTPayload(r, tagType, 0)
 }
 
-func skipNBTPayload(r *bytes.Buffer, tagType byte) error {
+func skipNBTPayload(r *bytes.Buffer, tagType byte, depth int) error {
+	if depth > maxNBTDepth {
+		return errors.New("NBT nested too deeply")
+	}
 	switch tagType {
 	case 1:
-		r.Next(1)
+		return nbtSkip(r, 1)
 	case 2:
-		r.Next(2)
-	case 3:
-		r.Next(4)
-	case 4:
-		r.Next(8)
-	case 5:
-		r.Next(4)
-	case 6:
-		r.Next(8)
+		return nbtSkip(r, 2)
+	case 3, 5:
+		return nbtSkip(r, 4)
+	case 4, 6:
+		return nbtSkip(r, 8)
 	case 7:
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
-		r.Next(l)
+		l, err := nbtArrayLen(r, 1)
+		if err != nil {
+			return err
+		}
+		return nbtSkip(r, l)
 	case 8:
-		l := int(uint16(binary.BigEndian.Uint16(r.Next(2))))
-		r.Next(l)
+		return skipNBTString(r)
 	case 9:
-		subType, _ := r.ReadByte()
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
+		subType, err := r.ReadByte()
+		if err != nil {
+			return errNBTTruncated
+		}
+		// Every element takes at least a byte, which also bounds the loop
+		l, err := nbtArrayLen(r, 1)
+		if err != nil {
+			return err
+		}
+		if subType == 0 && l > 0 {
+			return errors.New("NBT list of end tags")
+		}
 		for i := 0; i < l; i++ {
-			skipNBTPayload(r, subType)
+			if err := skipNBTPayload(r, subType, depth+1); err != nil {
+				return err
+			}
 		}
+		return nil
 	case 10:
 		for {
-			subType, _ := r.ReadByte()
+			subType, err := r.ReadByte()
+			if err != nil {
+				return errNBTTruncated
+			}
 			if subType == 0 {
-				break
+				return nil
+			}
+			if err := skipNBTString(r); err != nil {
+				return err
+			}
+			if err := skipNBTPayload(r, subType, depth+1); err != nil {
+				return err
 			}
-			nLen := int(binary.BigEndian.Uint16(r.Next(2)))
-			r.Next(nLen)
-			skipNBTPayload(r, subType)
 		}
 	case 11:
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
-		r.Next(l * 4)
+		l, err := nbtArrayLen(r, 4)
+		if err != nil {
+			return err
+		}
+		return nbtSkip(r, l*4)
 	case 12:
-		l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
-		r.Next(l * 8)
+		l, err := nbtArrayLen(r, 8)
+		if err != nil {
+			return err
+		}
+		return nbtSkip(r, l*8)
 	}
+	return fmt.Errorf("unknown NBT tag type %d", tagType)
+}
+
+// nbtSkip discards n bytes of r, failing if it holds fewer
+func nbtSkip(r *bytes.Buffer, n int) error {
+	if n < 0 || n > r.Len() {
+		return errNBTTruncated
+	}
+	r.Next(n)
 	return nil
 }
 
+// nbtArrayLen reads an array or list length and checks that r can still
+// hold that many elements of elemSize bytes
+func nbtArrayLen(r *bytes.Buffer, elemSize int) (int, error) {
+	if r.Len() < 4 {
+		return 0, errNBTTruncated
+	}
+	l := int(int32(binary.BigEndian.Uint32(r.Next(4))))
+	if l < 0 || l > r.Len()/elemSize {
+		return 0, errNBTTruncated
+	}
+	return l, nil
+}
+
+// skipNBTString skips a tag name or string payload: a uint16 length and
+// that many bytes
+func skipNBTString(r *bytes.Buffer) error {
+	if r.Len() < 2 {
+		return errNBTTruncated
+	}
+	return nbtSkip(r, int(binary.BigEndian.Uint16(r.Next(2))))
+}
+
 type MinecraftConn struct {
 	conn      net.Conn
 	r         *io.PipeReader
@@ -328,10 +1109,33 @@ type MinecraftConn struct {
 	writeBuf   *bytes.Buffer
 	writeMu    sync.Mutex
 	flushTimer *time.Timer
+	// Write flushes once flushThreshold bytes are buffered, and otherwise
+	// after flushDelay, or right away if that is 0. Both are fixed at
+	// creation.
+	flushThreshold int
+	flushDelay     time.Duration
+
+	// channel is the plugin channel data is sent on
+	channel string
+	// maxChunk is the largest plaintext carried by a single plugin message
+	maxChunk int
+	// compressionThreshold is the negotiated Set Compression threshold,
+	// negative when packets aren't compressed
+	compressionThreshold int
+
+	// done is closed when the reader loop exits
+	done chan struct{}
+	// lastRead is when the reader loop last got tunnel data, in Unix
+	// nanoseconds. The cover server's own packets don't count, so a server
+	// that stopped handling our plugin messages shows up as silence.
+	lastRead atomic.Int64
 }
 
 func (mc *MinecraftConn) Read(b []byte) (int, error) { return mc.r.Read(b) }
 
+func (mc *MinecraftConn) lastReadAt() int64           { return mc.lastRead.Load() }
+func (mc *MinecraftConn) readerDone() <-chan struct{} { return mc.done }
+
 func (mc *MinecraftConn) flushLocked() error {
 	if mc.flushTimer != nil {
 		mc.flushTimer.Stop()
@@ -342,18 +1146,34 @@ func (mc *MinecraftConn) flushLocked() error {
 		return nil
 	}
 	data := mc.writeBuf.Bytes()
+	defer mc.writeBuf.Reset()
+
+	// After backpressure the buffer can hold far more than a real client
+	// would ever send in one plugin message, so split it into several
+	// independently sealed messages.
+	chunkSize := mc.maxChunk
+	if chunkSize <= 0 {
+		chunkSize = len(data)
+	}
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		if err := mc.writeChunk(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
 
+func (mc *MinecraftConn) writeChunk(data []byte) error {
 	nonce := make([]byte, mc.aead.NonceSize())
 	rand.Read(nonce)
 	encrypted := mc.aead.Seal(nonce, nonce, data, nil)
 	buf := new(bytes.Buffer)
-	WriteString(buf, "minecraft:brand")
+	WriteString(buf, mc.channel)
 	buf.Write(encrypted)
 
-	err := WritePacket(mc.conn, PID_SB_PluginMsg, buf.Bytes())
-
-	mc.writeBuf.Reset()
-	return err
+	return WriteCompressedPacket(mc.conn, mc.compressionThreshold, PID_SB_PluginMsg, buf.Bytes())
 }
 
 func (mc *MinecraftConn) Write(b []byte) (int, error) {
@@ -365,15 +1185,14 @@ func (mc *MinecraftConn) Write(b []byte) (int, error) {
 		return 0, err
 	}
 
-	// 4KB threshold for immediate flush (Consistent with server)
-	if mc.writeBuf.Len() >= 4096 {
+	if mc.writeBuf.Len() >= mc.flushThreshold || mc.flushDelay <= 0 {
 		if err := mc.flushLocked(); err != nil {
 			return n, err
 		}
 	} else {
 		// Delayed flush for small packets
 		if mc.flushTimer == nil {
-			mc.flushTimer = time.AfterFunc(5*time.Millisecond, func() {
+			mc.flushTimer = time.AfterFunc(mc.flushDelay, func() {
 				mc.writeMu.Lock()
 				defer mc.writeMu.Unlock()
 				mc.flushLocked()
@@ -383,8 +1202,18 @@ func (mc *MinecraftConn) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// closeFlushTimeout bounds the final flush in Close on a dead connection
+const closeFlushTimeout = time.Second
+
+// Close flushes whatever is still waiting on the flush timer, best-effort
+// and bounded by closeFlushTimeout, so the tail of a short exchange that
+// never filled the buffer isn't dropped.
 func (mc *MinecraftConn) Close() error {
 	mc.writeMu.Lock()
+	if mc.writeBuf.Len() > 0 {
+		mc.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		mc.flushLocked()
+	}
 	if mc.flushTimer != nil {
 		mc.flushTimer.Stop()
 	}
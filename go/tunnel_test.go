@@ -0,0 +1,224 @@
+package minewire
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse battery"
+
+// stopAfter runs Stop and fails the test if it doesn't return promptly,
+// which is how a lock-order deadlock shows up.
+func stopAfter(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop deadlocked")
+	}
+}
+
+// Start and Stop hold serverLock while they close the session, and
+// maintainSession holds sessionLock for a whole connect attempt. Run with
+// -race: both orders have to be exercised without deadlocking or racing.
+func TestStartStopDuringConnect(t *testing.T) {
+	for _, stall := range []bool{false, true} {
+		srv := newFakeServer(t, testPassword)
+		srv.stall.Store(stall)
+
+		for i := 0; i < 10; i++ {
+			if msg := Start("127.0.0.1:0", "", srv.addr(), testPassword, "socks5", "", ""); msg != "" {
+				t.Fatal(msg)
+			}
+
+			// Poke the state and options while a connect is in flight
+			var wg sync.WaitGroup
+			for j := 0; j < 4; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					GetConnectionState()
+					TunnelHealthCheck()
+					SetOptions(`{}`)
+				}()
+			}
+			time.Sleep(time.Duration(i*5) * time.Millisecond)
+			stopAfter(t)
+			wg.Wait()
+		}
+		srv.dropAll()
+	}
+}
+
+// echoThrough opens a stream on the current session and checks that data
+// makes the round trip through the fake server.
+func echoThrough(t *testing.T, dest string) {
+	t.Helper()
+	stream, err := openStream(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	msg := []byte("hello through " + dest)
+	if _, err := stream.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echo = %q, want %q", got, msg)
+	}
+}
+
+// A dropped session is replaced by a fresh login that negotiates the same
+// settings again, and data flows over the new one.
+func TestReconnectRenegotiates(t *testing.T) {
+	srv := newFakeServer(t, testPassword)
+	if msg := SetOptions(`{"cipher":"chacha20-poly1305","keyDerivation":2,"reconnectBaseMs":50}`); msg != "" {
+		t.Fatal(msg)
+	}
+	t.Cleanup(func() { SetOptions(`{"cipher":"","keyDerivation":0,"reconnectBaseMs":0}`) })
+	if msg := Start("127.0.0.1:0", "", srv.addr(), testPassword, "socks5", "", ""); msg != "" {
+		t.Fatal(msg)
+	}
+	t.Cleanup(Stop)
+
+	waitFor(t, "first session", func() bool { return GetConnectionState() == "connected" })
+	first := currentSession()
+	echoThrough(t, "example.com:80")
+
+	srv.dropAll()
+	waitFor(t, "session to be replaced", func() bool {
+		s := currentSession()
+		return s != nil && s != first && !s.IsClosed()
+	})
+	echoThrough(t, "example.com:443")
+
+	logins := srv.handshakes()
+	if len(logins) < 2 {
+		t.Fatalf("%d logins, want 2", len(logins))
+	}
+	for i, hs := range logins {
+		if hs.version != PROTOCOL_VERSION || hs.cipher != cipherChaCha20 || hs.salt == nil {
+			t.Errorf("login %d: %+v", i, hs)
+		}
+	}
+	if bytes.Equal(logins[0].salt, logins[1].salt) {
+		t.Error("reconnect reused the key derivation salt")
+	}
+}
+
+// The state comes from the published session, not from whether sessionLock
+// happens to be free.
+func TestConnectionStateIgnoresSessionLock(t *testing.T) {
+	srv := newFakeServer(t, testPassword)
+	if msg := Start("127.0.0.1:0", "", srv.addr(), testPassword, "socks5", "", ""); msg != "" {
+		t.Fatal(msg)
+	}
+	defer stopAfter(t)
+	waitFor(t, "connected", func() bool { return GetConnectionState() == "connected" })
+
+	sessionLock.Lock()
+	state := GetConnectionState()
+	sessionLock.Unlock()
+	if state != "connected" {
+		t.Errorf("state with sessionLock held = %q, want connected", state)
+	}
+
+	srv.stall.Store(true)
+	srv.dropAll()
+	waitFor(t, "connecting", func() bool { return GetConnectionState() == "connecting" })
+}
+
+// The health check probes the live session even while sessionLock is taken.
+func TestTunnelHealthCheckIgnoresSessionLock(t *testing.T) {
+	srv := newFakeServer(t, testPassword)
+	if msg := Start("127.0.0.1:0", "", srv.addr(), testPassword, "socks5", "", ""); msg != "" {
+		t.Fatal(msg)
+	}
+	defer stopAfter(t)
+	waitFor(t, "connected", func() bool { return GetConnectionState() == "connected" })
+
+	sessionLock.Lock()
+	rtt := TunnelHealthCheck()
+	sessionLock.Unlock()
+	if rtt < 0 {
+		t.Errorf("TunnelHealthCheck with sessionLock held = %d, want a round trip", rtt)
+	}
+}
+
+// FuzzChunkPayload feeds arbitrary Chunk Data bodies to the parser the
+// reader loop uses: chunk position, heightmaps NBT, sized payload. A panic
+// there would take the whole session down.
+func FuzzChunkPayload(f *testing.F) {
+	nbt := func(b ...byte) []byte { return append(make([]byte, 8), b...) }
+	f.Add(nbt(0, 3, 'a', 'b', 'c'))                                                    // No heightmaps
+	f.Add(nbt(10, 0, 0, 12, 0, 1, 'h', 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 'x')) // Compound with a long array
+	f.Add(nbt(0, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F))                                        // Negative payload size
+	f.Add(nbt(9, 0, 0, 0, 0x7F, 0xFF, 0xFF, 0xFF))                                     // List of end tags claiming 2^31
+	f.Add(nbt(10, 0, 0, 10, 0, 0, 10, 0, 0, 10, 0, 0))                                 // Nested, truncated
+	f.Add([]byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		payload, ok := chunkPayload(bytes.NewBuffer(body))
+		if ok && len(payload) > len(body) {
+			t.Fatalf("payload of %d bytes out of a %d byte body", len(payload), len(body))
+		}
+	})
+}
+
+// FuzzReadRawPacket checks the framing, compressed or not, never panics and
+// never hands back a negative packet ID.
+func FuzzReadRawPacket(f *testing.F) {
+	var plain, compressed bytes.Buffer
+	WritePacket(&plain, PID_CB_KeepAlive, make([]byte, 8))
+	WriteCompressedPacket(&compressed, 4, PID_CB_ChunkData, bytes.Repeat([]byte{7}, 64))
+	f.Add(plain.Bytes(), false)
+	f.Add(compressed.Bytes(), true)
+	f.Add([]byte{0x05, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F}, false)   // Negative packet ID
+	f.Add([]byte{0x06, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F, 0}, true) // Negative data length
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x0F}, false)         // Negative packet length
+
+	f.Fuzz(func(t *testing.T, data []byte, isCompressed bool) {
+		threshold := -1
+		if isCompressed {
+			threshold = 0
+		}
+		pid, _, err := readRawPacket(bufio.NewReader(bytes.NewReader(data)), threshold)
+		if err == nil && pid < 0 {
+			t.Fatalf("packet ID %d accepted", pid)
+		}
+	})
+}
+
+// A server without single-stream mode refuses the login that announces it
+// instead of mistaking the unmultiplexed stream for yamux.
+func TestSingleStreamRefusedByMuxServer(t *testing.T) {
+	srv := newFakeServer(t, testPassword)
+	conf := config{Password: testPassword, Options: Options{DisableMultiplexing: true}}
+	conn, err := dialTransport(context.Background(), conf, srv.addr(), clientHooks)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded, want the login refused")
+	}
+	if !strings.Contains(err.Error(), "single-stream mode not supported") {
+		t.Errorf("dial error = %v, want the server's refusal", err)
+	}
+	if n := len(srv.handshakes()); n != 0 {
+		t.Errorf("server completed %d logins, want 0", n)
+	}
+}
@@ -0,0 +1,324 @@
+// Package udpflow relays SOCKS UDP datagrams over tunnel streams, one stream
+// per client and destination pair instead of one per datagram, falling back
+// to a stream per datagram for servers that predate flows. The library and
+// the standalone Windows build both use it.
+package udpflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxPayload is the largest datagram the uint16 length prefix can frame
+const MaxPayload = 0xFFFF
+
+// ErrTooLarge is returned by Send for a datagram over MaxPayload
+var ErrTooLarge = errors.New("udp datagram exceeds 65535 bytes")
+
+// Prefixes of the destination written at the start of a UDP tunnel stream
+const (
+	// DatagramPrefix opens a stream for one datagram and its reply, the
+	// only kind the original servers know
+	DatagramPrefix = "udp:"
+	// FlowPrefix opens a stream for every datagram of a flow, both ways. A
+	// server that predates it closes the stream without a reply.
+	FlowPrefix = "udpflow:"
+)
+
+// replyTimeout bounds the wait for the reply to an Exchange
+const replyTimeout = 10 * time.Second
+
+// frame returns data behind its uint16 length prefix
+func frame(data []byte) ([]byte, error) {
+	if len(data) > MaxPayload {
+		return nil, ErrTooLarge
+	}
+	b := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	copy(b[2:], data)
+	return b, nil
+}
+
+// readFrame reads one length-prefixed datagram
+func readFrame(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Exchange sends one datagram on a stream opened with DatagramPrefix and
+// returns the single reply, the way servers without flows expect
+func Exchange(stream net.Conn, data []byte) ([]byte, error) {
+	b, err := frame(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(b); err != nil {
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Now().Add(replyTimeout))
+	return readFrame(stream)
+}
+
+// Flow is a tunnel stream reused for every datagram between one SOCKS
+// client address and one destination, instead of a stream per datagram.
+// Datagrams go out as they arrive and a reader goroutine hands every reply
+// back as it comes, so one slow reply doesn't hold up the rest of the flow.
+type Flow struct {
+	stream  net.Conn
+	writeMu sync.Mutex // one frame at a time on the stream
+
+	// Guarded by the owning table's mu
+	lastUsed time.Time
+	busy     int
+	replied  bool // A reply arrived, so the server knows flows
+	closing  bool // Closed from this side, not by the server
+}
+
+// Send writes one datagram as a length-prefixed frame
+func (f *Flow) Send(data []byte) error {
+	b, err := frame(data)
+	if err != nil {
+		return err
+	}
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	_, err = f.stream.Write(b)
+	return err
+}
+
+// readReplies passes each reply frame to deliver until the stream fails
+func (f *Flow) readReplies(deliver func([]byte)) error {
+	for {
+		respData, err := readFrame(f.stream)
+		if err != nil {
+			return err
+		}
+		deliver(respData)
+	}
+}
+
+// Table maps client/destination pairs to live flows, NAT style. A
+// single reaper goroutine closes flows that have been idle in both directions
+// longer than timeout. It starts with the first flow, so a table serving a
+// server without flows doesn't run it.
+//
+// A flow the server closes before any reply means a server that doesn't
+// know FlowPrefix, and the table switches to PerDatagram until Reset, which
+// callers run for every new session.
+type Table struct {
+	mu          sync.Mutex
+	flows       map[string]*Flow
+	timeout     time.Duration
+	perDatagram bool
+	fallback    func()
+	reaping     bool // reapLoop started
+	closed      bool
+	done        chan struct{}
+}
+
+// ErrTableClosed is returned by Acquire once the table is closed
+var ErrTableClosed = errors.New("udp flow table closed")
+
+// NewTable returns an empty table whose flows expire after timeout idle.
+// fallback, if not nil, is called each time the table switches to
+// PerDatagram.
+func NewTable(timeout time.Duration, fallback func()) *Table {
+	return &Table{
+		flows:    make(map[string]*Flow),
+		timeout:  timeout,
+		fallback: fallback,
+		done:     make(chan struct{}),
+	}
+}
+
+// Acquire returns the flow for key, opening one with open if needed. Replies
+// on a new flow are passed to deliver until the flow closes. The flow can't
+// be reaped until the caller hands it back with Release.
+func (t *Table) Acquire(key string, open func() (net.Conn, error), deliver func([]byte)) (*Flow, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrTableClosed
+	}
+	if f, ok := t.flows[key]; ok {
+		f.busy++
+		f.lastUsed = time.Now()
+		t.mu.Unlock()
+		return f, nil
+	}
+	t.mu.Unlock()
+
+	// Opening a stream can take until the open timeout; every other flow
+	// would stall behind it if mu were held
+	stream, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		stream.Close()
+		return nil, ErrTableClosed
+	}
+	f, ok := t.flows[key]
+	if ok {
+		// Another datagram for the same pair got there first
+		stream.Close()
+	} else {
+		f = &Flow{stream: stream}
+		t.flows[key] = f
+		if !t.reaping {
+			t.reaping = true
+			go t.reapLoop()
+		}
+		go func() {
+			f.readReplies(func(resp []byte) {
+				t.touch(f)
+				deliver(resp)
+			})
+			t.ended(key, f)
+		}()
+	}
+	f.busy++
+	f.lastUsed = time.Now()
+	return f, nil
+}
+
+// Release hands back a flow from Acquire, restarting its idle timer
+func (t *Table) Release(f *Flow) {
+	t.mu.Lock()
+	f.busy--
+	f.lastUsed = time.Now()
+	t.mu.Unlock()
+}
+
+// touch marks f as active when a reply arrives
+func (t *Table) touch(f *Flow) {
+	t.mu.Lock()
+	f.lastUsed = time.Now()
+	f.replied = true
+	t.mu.Unlock()
+}
+
+// Remove drops a broken flow so the next datagram opens a fresh stream
+func (t *Table) Remove(key string, f *Flow) {
+	t.mu.Lock()
+	if t.flows[key] == f {
+		delete(t.flows, key)
+	}
+	f.closing = true
+	t.mu.Unlock()
+	f.stream.Close()
+}
+
+// ended drops a flow whose stream stopped reading, switching to PerDatagram
+// if the server closed it without ever replying
+func (t *Table) ended(key string, f *Flow) {
+	t.mu.Lock()
+	if t.flows[key] == f {
+		delete(t.flows, key)
+	}
+	refused := !f.replied && !f.closing && !t.closed && !t.perDatagram
+	if refused {
+		t.perDatagram = true
+	}
+	t.mu.Unlock()
+	f.stream.Close()
+
+	if refused && t.fallback != nil {
+		t.fallback()
+	}
+}
+
+// PerDatagram reports whether the server closed a flow without replying,
+// so datagrams should go one per DatagramPrefix stream with Exchange
+func (t *Table) PerDatagram() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.perDatagram
+}
+
+func (t *Table) reapLoop() {
+	interval := t.timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.reap()
+		}
+	}
+}
+
+func (t *Table) reap() {
+	var idle []*Flow
+	now := time.Now()
+
+	t.mu.Lock()
+	for key, f := range t.flows {
+		if f.busy == 0 && now.Sub(f.lastUsed) > t.timeout {
+			f.closing = true
+			idle = append(idle, f)
+			delete(t.flows, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, f := range idle {
+		f.stream.Close()
+	}
+}
+
+// Reset closes every flow but keeps the table usable, trying flows again
+func (t *Table) Reset() {
+	t.mu.Lock()
+	flows := t.flows
+	for _, f := range flows {
+		f.closing = true
+	}
+	if !t.closed {
+		t.flows = make(map[string]*Flow)
+	}
+	t.perDatagram = false
+	t.mu.Unlock()
+
+	for _, f := range flows {
+		f.stream.Close()
+	}
+}
+
+// Close stops the reaper and closes every flow
+func (t *Table) Close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	flows := t.flows
+	t.flows = nil
+	t.mu.Unlock()
+
+	close(t.done)
+	for _, f := range flows {
+		f.stream.Close()
+	}
+}
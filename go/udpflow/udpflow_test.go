@@ -0,0 +1,222 @@
+package udpflow
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeOpener returns an open func handing out one end of a net.Pipe, after
+// waiting for gate if it isn't nil
+func pipeOpener(gate <-chan struct{}) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		if gate != nil {
+			<-gate
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+}
+
+func TestUDPFlowSlowOpenDoesNotBlockOthers(t *testing.T) {
+	table := NewTable(time.Minute, nil)
+	defer table.Close()
+
+	gate := make(chan struct{})
+	slow := make(chan error, 1)
+	go func() {
+		_, err := table.Acquire("slow", pipeOpener(gate), func([]byte) {})
+		slow <- err
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		f, err := table.Acquire("fast", pipeOpener(nil), func([]byte) {})
+		if err == nil {
+			table.Release(f)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire blocked behind another flow's open")
+	}
+
+	close(gate)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPFlowConcurrentOpensShareOneFlow(t *testing.T) {
+	table := NewTable(time.Minute, nil)
+	defer table.Close()
+
+	gate := make(chan struct{})
+	const n = 8
+	flows := make([]*Flow, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := table.Acquire("key", pipeOpener(gate), func([]byte) {})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			flows[i] = f
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // Let them all reach open
+	close(gate)
+	wg.Wait()
+
+	for _, f := range flows[1:] {
+		if f != flows[0] {
+			t.Fatal("concurrent acquires for one key got different flows")
+		}
+	}
+	table.mu.Lock()
+	busy := flows[0].busy
+	table.mu.Unlock()
+	if busy != n {
+		t.Errorf("busy = %d, want %d", busy, n)
+	}
+}
+
+func TestUDPFlowAcquireAfterClose(t *testing.T) {
+	table := NewTable(time.Minute, nil)
+	gate := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := table.Acquire("key", pipeOpener(gate), func([]byte) {})
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	table.Close()
+	close(gate)
+	if err := <-errc; err != ErrTableClosed {
+		t.Errorf("Acquire racing Close = %v, want ErrTableClosed", err)
+	}
+}
+
+// A server that closes a flow before replying predates flows: the table
+// falls back to a stream per datagram until Reset.
+func TestUDPFlowRefusedFallsBack(t *testing.T) {
+	fellBack := make(chan struct{}, 2)
+	table := NewTable(time.Minute, func() { fellBack <- struct{}{} })
+	defer table.Close()
+
+	client, server := net.Pipe()
+	f, err := table.Acquire("old", func() (net.Conn, error) { return client, nil }, func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Release(f)
+	server.Close()
+	select {
+	case <-fellBack:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no fallback after the server closed the flow")
+	}
+	if !table.PerDatagram() {
+		t.Error("PerDatagram = false after a refused flow")
+	}
+
+	table.Reset()
+	if table.PerDatagram() {
+		t.Error("PerDatagram = true after Reset")
+	}
+}
+
+// Flows that replied, or that this side closed, end without a fallback.
+func TestUDPFlowEndsWithoutFallback(t *testing.T) {
+	table := NewTable(time.Minute, func() { t.Error("fell back") })
+	defer table.Close()
+
+	client, server := net.Pipe()
+	replied := make(chan []byte, 1)
+	f, err := table.Acquire("new", func() (net.Conn, error) { return client, nil }, func(b []byte) { replied <- b })
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Release(f)
+	server.Write([]byte{0, 2, 'h', 'i'})
+	if got := <-replied; string(got) != "hi" {
+		t.Fatalf("reply = %q, want \"hi\"", got)
+	}
+	server.Close()
+
+	f, err = table.Acquire("local", pipeOpener(nil), func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Release(f)
+	table.Remove("local", f)
+
+	time.Sleep(50 * time.Millisecond) // Let the reader goroutines finish
+	if table.PerDatagram() {
+		t.Error("PerDatagram = true, want flows kept")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		req, err := readFrame(server)
+		if err != nil {
+			return
+		}
+		b, _ := frame(append([]byte("re:"), req...))
+		server.Write(b)
+	}()
+	resp, err := Exchange(client, []byte("ping"))
+	if err != nil || string(resp) != "re:ping" {
+		t.Errorf("Exchange = %q, %v; want \"re:ping\"", resp, err)
+	}
+}
+
+// The reaper starts with the first flow, not with the table, and closes the
+// flow once it's idle.
+func TestUDPFlowReaperStartsWithFirstFlow(t *testing.T) {
+	table := NewTable(10*time.Millisecond, nil)
+	defer table.Close()
+	reaping := func() bool {
+		table.mu.Lock()
+		defer table.mu.Unlock()
+		return table.reaping
+	}
+	if reaping() {
+		t.Fatal("reaper running before any flow")
+	}
+
+	f, err := table.Acquire("key", pipeOpener(nil), func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Release(f)
+	if !reaping() {
+		t.Fatal("reaper not running with a flow open")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		table.mu.Lock()
+		n := len(table.flows)
+		table.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow not reaped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
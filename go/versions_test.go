@@ -0,0 +1,50 @@
+package minewire
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Every version SetOptions accepts logs in against a server speaking it.
+func TestLoginPerProtocolVersion(t *testing.T) {
+	srv := newFakeServer(t, testPassword)
+	t.Cleanup(func() { SetOptions(`{"protocolVersion": 0}`) })
+
+	for version := 763; version <= PROTOCOL_VERSION; version++ {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			if msg := SetOptions(fmt.Sprintf(`{"protocolVersion": %d}`, version)); msg != "" {
+				t.Fatal(msg)
+			}
+			if msg := Start("127.0.0.1:0", "", srv.addr(), testPassword, "socks5", "", ""); msg != "" {
+				t.Fatal(msg)
+			}
+			defer stopAfter(t)
+			waitFor(t, "connected", func() bool { return GetConnectionState() == "connected" })
+			echoThrough(t, "example.com:80")
+		})
+	}
+}
+
+func TestSetOptionsRejectsUnknownProtocolVersion(t *testing.T) {
+	t.Cleanup(func() { SetOptions(`{"protocolVersion": 0}`) })
+	for _, version := range []int{340, 762, PROTOCOL_VERSION + 1} {
+		msg := SetOptions(fmt.Sprintf(`{"protocolVersion": %d}`, version))
+		if !strings.Contains(msg, "not supported") {
+			t.Errorf("protocolVersion %d: SetOptions = %q, want it refused", version, msg)
+		}
+	}
+	if got := getConfig().protocolVersion(); got != PROTOCOL_VERSION {
+		t.Errorf("protocolVersion after refused options = %d, want %d", got, PROTOCOL_VERSION)
+	}
+}
+
+func TestSetOptionsRejectsUnknownTransport(t *testing.T) {
+	t.Cleanup(func() { SetOptions(`{"transport": ""}`) })
+	if msg := SetOptions(`{"transport": "websockets"}`); !strings.Contains(msg, "unknown transport") {
+		t.Errorf("SetOptions = %q, want the transport refused", msg)
+	}
+	if msg := SetOptions(`{"transport": "WebSocket"}`); msg != "" {
+		t.Errorf("SetOptions = %q for a known transport", msg)
+	}
+}
@@ -0,0 +1,215 @@
+package minewire
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"minewire/serverdial"
+)
+
+const (
+	// wsMaxChunk is the most plaintext sealed into one WebSocket message
+	wsMaxChunk = 16 * 1024
+	// wsMaxMessage bounds a received message, so a broken or hostile peer
+	// can't make us buffer an arbitrary amount
+	wsMaxMessage = 1 << 20
+	// wsHandshakeTimeout bounds the HTTP upgrade
+	wsHandshakeTimeout = 15 * time.Second
+	// wsDefaultPath is requested when WebSocketURL is unset
+	wsDefaultPath = "/minecraft"
+)
+
+var errWSShortMessage = errors.New("websocket message shorter than a nonce")
+
+// websocketTransport carries the tunnel in binary WebSocket messages over
+// HTTPS, for networks that block Minecraft's port but let web traffic
+// through, CDNs and corporate proxies included. Each message is one
+// AEAD-sealed chunk, nonce followed by ciphertext, with the same key and
+// cipher as the Minecraft disguise. The loginUUID announcing the settings
+// (and salting the key) is sent as a session cookie. The server (or
+// whatever the URL reaches) must speak it.
+type websocketTransport struct {
+	ctx  context.Context
+	conf config
+	addr string // Server address, used when WebSocketURL is unset
+}
+
+// url is the endpoint to connect to: WebSocketURL, or the server address
+// over wss at wsDefaultPath.
+func (t *websocketTransport) url() (*url.URL, error) {
+	raw := t.conf.WebSocketURL
+	if raw == "" {
+		raw = "wss://" + t.addr + wsDefaultPath
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("websocket URL %q: scheme must be ws or wss", raw)
+	}
+	return u, nil
+}
+
+func (t *websocketTransport) Dial() (net.Conn, error) {
+	u, err := t.url()
+	if err != nil {
+		return nil, &stageError{"dial", err}
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "ws" {
+			port = "80"
+		}
+		hostPort = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := serverdial.Dial(t.ctx, hostPort)
+	if err != nil {
+		return nil, &stageError{"dial", err}
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(!t.conf.DisableNoDelay)
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+	if u.Scheme == "wss" {
+		if conn, err = serverdial.WrapTLS(t.ctx, conn, hostPort, t.conf.TLSServerName); err != nil {
+			return nil, &stageError{"dial", err}
+		}
+	}
+
+	uuid, err := newLoginUUID(t.conf.Options, t.conf.Password)
+	if err != nil {
+		conn.Close()
+		return nil, &stageError{"cipher", err}
+	}
+	aead, err := newAEAD(t.conf.cipherName(), deriveKey(t.conf.Password, uuid.salt(t.conf.Options)))
+	if err != nil {
+		conn.Close()
+		return nil, &stageError{"cipher", err}
+	}
+
+	wsConf := &websocket.Config{
+		Location: u,
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   http.Header{},
+	}
+	for k, v := range t.conf.WebSocketHeaders {
+		wsConf.Header.Set(k, v)
+	}
+	// The handshake always sends an Origin; a page served by the same host
+	// is what a browser would show, unless the headers name another
+	if wsConf.Origin, err = wsOrigin(u, wsConf.Header.Get("Origin")); err != nil {
+		conn.Close()
+		return nil, &stageError{"handshake", err}
+	}
+	wsConf.Header.Del("Origin")
+	cookie := "sid=" + base64.RawURLEncoding.EncodeToString(uuid[:])
+	if c := wsConf.Header.Get("Cookie"); c != "" {
+		cookie = c + "; " + cookie
+	}
+	wsConf.Header.Set("Cookie", cookie)
+
+	conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	stop := context.AfterFunc(t.ctx, func() { conn.Close() }) // Don't make Stop wait
+	ws, err := websocket.NewClient(wsConf, conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, &stageError{"handshake", err}
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = wsMaxMessage
+
+	return &wsConn{Conn: ws, aead: aead, done: make(chan struct{})}, nil
+}
+
+func wsOrigin(u *url.URL, origin string) (*url.URL, error) {
+	if origin != "" {
+		return url.Parse(origin)
+	}
+	scheme := "https"
+	if u.Scheme == "ws" {
+		scheme = "http"
+	}
+	return &url.URL{Scheme: scheme, Host: u.Host}, nil
+}
+
+// wsConn is the tunnel side of a WebSocket connection: Write seals data
+// into messages, Read opens them.
+type wsConn struct {
+	*websocket.Conn // Deadlines, addresses and Close
+	aead            cipher.AEAD
+
+	writeMu sync.Mutex
+
+	pending []byte // Opened but not yet read; only touched by Read
+
+	doneOnce sync.Once
+	done     chan struct{} // Closed once Read fails
+	lastRead atomic.Int64  // Unix nanoseconds of the last message opened
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+			return c.readFailed(err)
+		}
+		ns := c.aead.NonceSize()
+		if len(msg) < ns {
+			return c.readFailed(errWSShortMessage)
+		}
+		pt, err := c.aead.Open(msg[ns:ns], msg[:ns], msg[ns:], nil)
+		if err != nil {
+			// Same key on both ends or nothing works; don't limp along
+			return c.readFailed(fmt.Errorf("decrypt websocket message: %w", err))
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		c.pending = pt
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFailed marks the connection dead for readerDone and returns err
+func (c *wsConn) readFailed(err error) (int, error) {
+	c.doneOnce.Do(func() { close(c.done) })
+	return 0, err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(written+wsMaxChunk, len(b))]
+		nonce := make([]byte, c.aead.NonceSize())
+		rand.Read(nonce)
+		if err := websocket.Message.Send(c.Conn, c.aead.Seal(nonce, nonce, chunk, nil)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (c *wsConn) lastReadAt() int64           { return c.lastRead.Load() }
+func (c *wsConn) readerDone() <-chan struct{} { return c.done }
@@ -0,0 +1,54 @@
+package minewire
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// SetOptions must not write to the header map a websocket dial is reading.
+func TestSetOptionsDuringWebSocketDial(t *testing.T) {
+	// Hangs up on every upgrade, so each dial gets past the headers and fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	if msg := SetOptions(`{"transport":"websocket","webSocketUrl":"ws://` + ln.Addr().String() + `/mw","webSocketHeaders":{"X-A":"1"}}`); msg != "" {
+		t.Fatal(msg)
+	}
+	t.Cleanup(func() { SetOptions(`{"transport":"","webSocketUrl":"","webSocketHeaders":null}`) })
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			conf := getConfig()
+			conf.Password = testPassword
+			dialTransport(context.Background(), conf, ln.Addr().String(), clientHooks)
+		}
+	}()
+	for range 200 {
+		SetOptions(`{"webSocketHeaders":{"X-B":"2"}}`)
+	}
+	wg.Wait()
+
+	if msg := SetOptions(`{"webSocketHeaders":{"X-C":"3"},"protocolVersion":1}`); msg == "" {
+		t.Fatal("SetOptions accepted protocol version 1")
+	}
+	if _, ok := getConfig().WebSocketHeaders["X-C"]; ok {
+		t.Error("refused options changed the headers")
+	}
+}
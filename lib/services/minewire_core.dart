@@ -10,7 +10,7 @@ abstract class MinewireCore {
   Future<int> ping(String serverAddress);
   Future<Map<String, dynamic>> parseLink(String link);
   Future<void> updateConfig(String rulePaths);
-  Future<Map<String, dynamic>> getServerStatus(String serverAddress);
+  Future<Map<String, dynamic>> getServerStatus(String serverAddress, {bool stripColors = false});
 }
 
 class MinewireCoreAndroid implements MinewireCore {
@@ -62,9 +62,9 @@ class MinewireCoreAndroid implements MinewireCore {
   }
   
   @override
-  Future<Map<String, dynamic>> getServerStatus(String serverAddress) async {
+  Future<Map<String, dynamic>> getServerStatus(String serverAddress, {bool stripColors = false}) async {
     try {
-        final String jsonStr = await platform.invokeMethod('getServerStatus', {"serverAddress": serverAddress});
+        final String jsonStr = await platform.invokeMethod('getServerStatus', {"serverAddress": serverAddress, "stripColors": stripColors});
         return jsonDecode(jsonStr);
     } catch (e) {
         return {"error": e.toString()};
@@ -76,6 +76,10 @@ class MinewireCoreWindows implements MinewireCore {
   Process? _process;
   bool _running = false;
   final Map<String, Completer> _pendingRequests = {};
+  final _events = StreamController<Map<String, dynamic>>.broadcast();
+
+  /// Unsolicited lines from the core, e.g. {"event": "stateChange", "data": "connected"}
+  Stream<Map<String, dynamic>> get events => _events.stream;
   int _requestIdCounter = 0;
   
   // Singleton pattern to ensure only one process manager exists
@@ -114,6 +118,10 @@ class MinewireCoreWindows implements MinewireCore {
       if (line.isEmpty) return;
       try {
           final Map<String, dynamic> msg = jsonDecode(line);
+          if (msg.containsKey('event')) {
+              _events.add(msg);
+              return;
+          }
           final id = msg['id'] as String?;
           if (id != null && _pendingRequests.containsKey(id)) {
               final completer = _pendingRequests.remove(id)!;
@@ -210,7 +218,7 @@ class MinewireCoreWindows implements MinewireCore {
   }
   
   @override
-  Future<Map<String, dynamic>> getServerStatus(String serverAddress) async {
+  Future<Map<String, dynamic>> getServerStatus(String serverAddress, {bool stripColors = false}) async {
        if (_process == null) await _ensureProcess();
        try {
            // On Windows we might need to cast or parse differently if the IPC returns stringified JSON inside data?
@@ -219,7 +227,7 @@ class MinewireCoreWindows implements MinewireCore {
            // Let's assume on Windows the IPC returns the string from Go, so we parse it here.
            // Wait, handleResponse decodes the outer JSON. 
            // If GetServerStatus returns a STRING, then `msg['data']` is a string.
-           final String jsonStr = await _sendRequest<String>("getServerStatus", {"serverAddress": serverAddress});
+           final String jsonStr = await _sendRequest<String>("getServerStatus", {"serverAddress": serverAddress, "stripColors": stripColors});
            return jsonDecode(jsonStr);
        } catch (e) {
            return {"error": e.toString()};
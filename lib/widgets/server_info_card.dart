@@ -46,7 +46,7 @@ class _ServerInfoCardState extends State<ServerInfoCard> {
 
     try {
       final core = Platform.isWindows ? MinewireCoreWindows() : MinewireCoreAndroid();
-      final data = await core.getServerStatus(widget.serverAddress);
+      final data = await core.getServerStatus(widget.serverAddress, stripColors: true);
 
       if (mounted) {
         setState(() {
@@ -55,14 +55,9 @@ class _ServerInfoCardState extends State<ServerInfoCard> {
             _error = data['error'].toString();
           } else {
              // Parse successful response
-             // Structure: {version: {name, protocol}, players: {max, online}, description: {text}, favicon}
+             // Structure: {version: {name, protocol}, players: {max, online, sample}, description, favicon}
              
-             final desc = data['description'];
-             if (desc is Map) {
-                 _motd = desc['text']?.toString() ?? "";
-             } else {
-                 _motd = desc?.toString() ?? "";
-             }
+             _motd = data['description']?.toString() ?? "";
              
              final ver = data['version'];
              if (ver is Map) {
@@ -78,10 +73,9 @@ class _ServerInfoCardState extends State<ServerInfoCard> {
              }
              
              final fav = data['favicon'] as String?;
-             if (fav != null && fav.startsWith("data:image/png;base64,")) {
+             if (fav != null && fav.isNotEmpty) {
                  try {
-                    final base64Str = fav.split(",")[1];
-                    _favicon = MemoryImage(base64Decode(base64Str));
+                    _favicon = MemoryImage(base64Decode(fav));
                  } catch (e) {
                      print("Favicon decode error: $e");
                  }